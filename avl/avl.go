@@ -8,11 +8,10 @@
 package avl
 
 import (
-	"fmt"
-	"log"
+	"io"
 	"math/big"
-	"os"
-	"os/exec"
+
+	"github.com/canepat/bst/graph"
 )
 
 func Max(a, b *big.Int) *big.Int {
@@ -92,71 +91,37 @@ func (n *Node) WalkPathsInOrder() []string {
 	return paths
 }
 
-func Graph(n *Node, filename string) {
-	colors := []string{"#FDF3D0", "#DCE8FA", "#D9E7D6", "#F1CFCD", "#F5F5F5", "#E1D5E7", "#FFE6CC", "white"}
-	f, err := os.OpenFile(filename + ".dot", os.O_RDWR | os.O_CREATE, 0755)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer func () {
-		if err := f.Close(); err != nil {
-			log.Fatal(err)
-		}
-	}()
-	if _, err := f.WriteString("strict digraph {\nnode [shape=record];\n"); err != nil {
-		log.Fatal(err)
-	}
-	for _, n := range n.WalkNodesInOrder() {
-		left, right := "", ""
-		if n.Left != nil {
-			left = "<L>L"
-		}
-		if n.Right != nil {
-			right = "<R>R"
-		}
-		s := fmt.Sprintln(n.Key, " [label=\"", left, "|{<C>", n.Key, "|", n.Value, "}|", right, "\" style=filled fillcolor=\"", colors[2], "\"];")
-		if _, err := f.WriteString(s); err != nil {
-			log.Fatal(err)
-		}
-	}
-	for _, n := range n.WalkNodesInOrder() {
-		if n.Left != nil {
-			if _, err := f.WriteString(fmt.Sprintln(n.Key, ":L -> ", n.Left.Key, ":C;")); err != nil {
-				log.Fatal(err)
-			}
-		}
-		if n.Right != nil {
-			if _, err := f.WriteString(fmt.Sprintln(n.Key, ":R -> ", n.Right.Key, ":C;")); err != nil {
-				log.Fatal(err)
-			}
-		}
-	}
-	if _, err := f.WriteString("}\n"); err != nil {
-		log.Fatal(err)
-	}
+func Graph(n *Node, filename string) error {
+	return graph.Save(filename, graphNode(n), graph.DOT)
+}
+
+// GraphAndPicture saves the tree into dir as name.dot plus a picture, see graph.SaveAndPicture.
+func GraphAndPicture(n *Node, dir, name string) error {
+	return graph.SaveAndPicture(dir, name, n)
+}
+
+// Export writes the tree in format, see graph.Export.
+func (n *Node) Export(w io.Writer, format graph.Format) error {
+	return graph.Export(w, graphNode(n), format)
 }
 
-func GraphAndPicture(n *Node, filename string) error {
-	graphDir := "testdata/graph/"
-	_ = os.MkdirAll(graphDir, os.ModePerm)
-	filepath := graphDir + filename
-	Graph(n, filepath)
-	dotExecutable, _ := exec.LookPath("dot")
-	cmdDot := &exec.Cmd{
-		Path: dotExecutable,
-		Args: []string{dotExecutable, "-Tpng", filepath + ".dot", "-o", filepath + ".png"},
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+func graphNode(n *Node) *graph.Node {
+	if n == nil {
+		return nil
 	}
-	if err := cmdDot.Run(); err != nil {
-		return err
+	g := &graph.Node{Fields: []string{n.Key.String(), n.Value.String()}, Fill: graph.Palette[2]}
+	if n.Left != nil {
+		g.Edges = append(g.Edges, graph.Edge{Port: "L", To: graphNode(n.Left)})
+	}
+	if n.Right != nil {
+		g.Edges = append(g.Edges, graph.Edge{Port: "R", To: graphNode(n.Right)})
 	}
-	return nil
+	return g
 }
 
 func Expose(n *Node) (*big.Int, *big.Int, *big.Int, *Node, *Node) {
 	if n != nil && n.Key != nil {
-		return n.Key, n.Height, n.Value, n.Left, n.Right
+		return n.Key, n.Value, n.Height, n.Left, n.Right
 	}
 	return nil, nil, nil, nil, nil
 }
@@ -10,6 +10,9 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// graphDir is where tests picture their trees.
+const graphDir = "testdata/graph"
+
 func assertAvl(t *testing.T, n *Node, h int, expectedKeysInOrder []uint64) {
 	assert.True(t, n.IsBST(), "BST property failed for tree: %v", n.WalkKeysInOrder())
 	assert.True(t, n.IsBalanced(), "AVL balance property failed for tree: %v", n.WalkKeysInOrder())
@@ -98,6 +101,22 @@ func TestBasicOperations(t *testing.T) {
 	assert.Equal(t, []uint64{2, 0}, bst3.WalkKeysInOrder(), "different t3 keys")
 }
 
+func TestInsertDeleteKeepValues(t *testing.T) {
+	var bst *Node
+	for k := int64(1); k <= 16; k++ {
+		bst = Insert(bst, big.NewInt(k), big.NewInt(k*10))
+	}
+	bst = Delete(bst, big.NewInt(8))
+	for k := int64(1); k <= 16; k++ {
+		n := Search(bst, big.NewInt(k))
+		if k == 8 {
+			assert.Nil(t, n, "deleted key %d found", k)
+			continue
+		}
+		assert.Equal(t, big.NewInt(k*10), n.Value, "different value for key %d", k)
+	}
+}
+
 func TestSpineInsertion(t *testing.T) {
 	var bst1 Node
 	assert.Equal(t, bst1.WalkKeysInOrder(), []uint64{}, "different bst1 keys")
@@ -118,69 +137,69 @@ func TestSpineInsertion(t *testing.T) {
 func TestBulkOperations(t *testing.T) {
 	j1 := Join(t2, big.NewInt(50), big.NewInt(0), t3)
 	assertAvl(t, j1, 4, []uint64{188, 50, 18, 15, 21, 155, 154, 156, 210, 200, 199, 202, 300, 211, 1560})
-	GraphAndPicture(j1, "j1")
+	GraphAndPicture(j1, graphDir, "j1")
 
 	t4 := NewNode(big.NewInt(19), big.NewInt(0),
 		NewNode(big.NewInt(11), big.NewInt(0), nil, nil), NewNode(big.NewInt(157), big.NewInt(0), nil, nil),
 	)
 	assertAvl(t, t4, 2, []uint64{19, 11, 157})
-	GraphAndPicture(t4, "t4")
+	GraphAndPicture(t4, graphDir, "t4")
 
 	u1 := Union(j1, t4)
 	assertAvl(t, u1, 5, []uint64{157, 19, 15, 11, 18, 50, 21, 155, 154, 156, 210, 200, 188, 199, 202, 300, 211, 1560})
-	GraphAndPicture(u1, "u1")
+	GraphAndPicture(u1, graphDir, "u1")
 
 	t5 := NewNode(big.NewInt(4), big.NewInt(0),
 		NewNode(big.NewInt(1), big.NewInt(0), nil, nil), NewNode(big.NewInt(5), big.NewInt(0), nil, nil),
 	)
 	assertAvl(t, t5, 2, []uint64{4, 1, 5})
-	GraphAndPicture(t5, "t5")
+	GraphAndPicture(t5, graphDir, "t5")
 
 	t6 := NewNode(big.NewInt(3), big.NewInt(0),
 		NewNode(big.NewInt(2), big.NewInt(0), nil, nil), NewNode(big.NewInt(7), big.NewInt(0), nil, nil),
 	)
 	assertAvl(t, t6, 2, []uint64{3, 2, 7})
-	GraphAndPicture(t6, "t6")
+	GraphAndPicture(t6, graphDir, "t6")
 
 	u2 := Union(t5, t6)
 	assertAvl(t, u2, 3, []uint64{3, 2, 1, 5, 4, 7})
-	GraphAndPicture(u2, "u2")
+	GraphAndPicture(u2, graphDir, "u2")
 
 	t7 := NewNode(big.NewInt(18), big.NewInt(0),
 		NewNode(big.NewInt(15), big.NewInt(0), nil, nil), nil,
 	)
 	assertAvl(t, t7, 2, []uint64{18, 15})
-	GraphAndPicture(t7, "t7")
+	GraphAndPicture(t7, graphDir, "t7")
 
 	t8 := NewNode(big.NewInt(11), big.NewInt(0), nil, nil)
 	assertAvl(t, t8, 1, []uint64{11})
-	GraphAndPicture(t8, "t8")
+	GraphAndPicture(t8, graphDir, "t8")
 
 	u3 := Union(t7, t8)
 	assertAvl(t, u3, 2, []uint64{15, 11, 18})
-	GraphAndPicture(u3, "u3")
+	GraphAndPicture(u3, graphDir, "u3")
 
 	d1 := Difference(u2, t5)
 	assertAvl(t, d1, 2, []uint64{3, 2, 7})
-	GraphAndPicture(d1, "d1")
+	GraphAndPicture(d1, graphDir, "d1")
 
 	d2 := Difference(u2, t6)
 	assertAvl(t, d2, 2, []uint64{4, 1, 5})
-	GraphAndPicture(d2, "d2")
+	GraphAndPicture(d2, graphDir, "d2")
 
 	t9 := NewNode(big.NewInt(2), big.NewInt(0),
 		NewNode(big.NewInt(1), big.NewInt(0), nil, nil), NewNode(big.NewInt(3), big.NewInt(0), nil, nil),
 	)
 	assertAvl(t, t9, 2, []uint64{2, 1, 3})
-	GraphAndPicture(t9, "t9")
+	GraphAndPicture(t9, graphDir, "t9")
 
 	i1 := Intersect(u2, t9)
 	assertAvl(t, i1, 2, []uint64{2, 1, 3})
-	GraphAndPicture(i1, "i1")
+	GraphAndPicture(i1, graphDir, "i1")
 
 	i2 := Intersect(u2, t1)
 	assertAvl(t, i2, 0, []uint64{})
-	GraphAndPicture(i2, "i2")
+	GraphAndPicture(i2, graphDir, "i2")
 }
 
 func TestUnion(t *testing.T) {
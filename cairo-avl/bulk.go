@@ -3,12 +3,58 @@ package cairo_avl
 import (
 	"math/big"
 
+	"github.com/canepat/bst/graph"
 	log "github.com/sirupsen/logrus"
 )
 
 type Counters struct {
 	ExposedCount	uint64
 	HeightCount	uint64
+	Tracer		*Tracer	// if set, the bulk operation records its steps in it
+}
+
+// Tracer records the trees split and joined by Union and Difference, see graph.Trace. Each step converts the
+// trees involved, so it is meant for small trees.
+type Tracer struct {
+	trace	*graph.Trace
+	depth	int
+}
+
+func NewTracer(operation string) *Tracer {
+	return &Tracer{trace: graph.NewTrace(operation)}
+}
+
+func (tr *Tracer) Trace() *graph.Trace {
+	return tr.trace
+}
+
+// enter increases the recursion depth of the traced steps until the returned function is called.
+func (c *Counters) enter() func() {
+	if c.Tracer == nil {
+		return func() {}
+	}
+	c.Tracer.depth++
+	return func() { c.Tracer.depth-- }
+}
+
+// trace records a step involving trees, named by ports.
+func (c *Counters) trace(event string, k *Felt, ports []string, trees ...*Node) {
+	if c.Tracer == nil {
+		return
+	}
+	edges := make([]graph.Edge, len(trees))
+	for i, tree := range trees {
+		edges[i] = graph.Edge{Port: ports[i], To: tree.graphNode(false, nil)}
+	}
+	c.Tracer.trace.Add(event+" k="+k.String(), c.Tracer.depth, edges...)
+}
+
+// traceDict records a step of tree T with dictionary D.
+func (c *Counters) traceDict(event string, k *Felt, T *Node, D *Dict) {
+	if c.Tracer == nil {
+		return
+	}
+	c.Tracer.trace.Add(event+" k="+k.String(), c.Tracer.depth, graph.Edge{Port: "T", To: T.graphNode(false, nil)}, graph.Edge{Port: "D", To: D.graphNode()})
 }
 
 func computeHeight(h_L, h_R *Felt) (h *Felt) {
@@ -66,7 +112,7 @@ func joinLeft(k, v *Felt, T_L, T_R, T_N *Node, c *Counters) (h *Felt, T *Node) {
 			h := computeHeight(h_dash, h_RR)
 			return h, makeNode(k_R, v_R, h, T_dash, T_RR, T_RN)
 		} else {
-			return rotateLeft(k_R, v_R, T_dash, T_RR, T_RN, c)
+			return rotateRight(k_R, v_R, T_dash, T_RR, T_RN, c)
 		}
 	}
 }
@@ -97,6 +143,8 @@ func joinRight(k, v *Felt, T_L, T_R, T_N *Node, c *Counters) (h *Felt, T *Node)
 }
 
 func join(k, v *Felt, D_U, D_D *Dict, T_L, T_R, T_N *Node, c *Counters) (T *Node) {
+	defer c.enter()()
+	defer func() { c.trace("join", k, []string{"T_L", "T_R", "T"}, T_L, T_R, T) }()
 	h_L := height(T_L, c)
 	h_R := height(T_R, c)
 	log.Traceln("join: h_L=", h_L, " h_R=", h_R)
@@ -133,6 +181,8 @@ func split(T *Node, k *Felt, c *Counters) (T_L, T_R, T_N *Node) {
 	if T == nil {
 		return nil, nil, nil
 	} else {
+		defer c.enter()()
+		defer func() { c.trace("split", k, []string{"T", "T_L", "T_R", "T_N"}, T, T_L, T_R, T_N) }()
 		m, v, L, R, N := exposeNode(T, c)
 		if k.Cmp(m) == 0 {
 			return L, R, N
@@ -169,7 +219,10 @@ func Union(T0 *Node, D *Dict, c *Counters) (T1 *Node) {
 	} else if D == nil {
 		return T0
 	} else {
+		defer c.enter()()
 		k, v, D_L, D_R, D_U, D_D := exposeDict(D)
+		c.traceDict("union", k, T0, D)
+		defer func() { c.trace("union done", k, []string{"T"}, T1) }()
 		log.Traceln("Union k=", k, "D_U=", dictToNode(D_U).WalkKeysInOrder(), " D_D=", dictToNode(D_D).WalkKeysInOrder())
 		T_L, T_R, T_N := split(T0, k, c)
 		log.Traceln("Union T_L=", T_L.WalkKeysInOrder(), " T_R=", T_R.WalkKeysInOrder())
@@ -188,7 +241,10 @@ func Difference(T0 *Node, D *Dict, c *Counters) (T1 *Node) {
 	} else if D == nil {
 		return T0
 	} else {
+		defer c.enter()()
 		k, _, D_L, D_R, _, _ := exposeDict(D)
+		c.traceDict("difference", k, T0, D)
+		defer func() { c.trace("difference done", k, []string{"T"}, T1) }()
 		T_L, T_R, _ := split(T0, k, c)
 		L := Difference(T_L, D_L, c)
 		R := Difference(T_R, D_R, c)
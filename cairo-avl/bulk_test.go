@@ -5,11 +5,18 @@ package cairo_avl
 
 import (
 	"math/big"
+	"math/rand"
+	"strings"
 	"testing"
 
+	"github.com/canepat/bst/graph"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// graphDir is where tests picture their trees.
+const graphDir = "testdata/graph"
+
 func assertAvl(t *testing.T, n *Node, h int, expectedKeysInOrder []uint64) {
 	assert.True(t, n.IsBST(), "BST property failed for tree: %v", n.WalkKeysInOrder())
 	assert.True(t, n.IsBalanced(), "AVL balance property failed for tree: %v", n.WalkKeysInOrder())
@@ -56,13 +63,123 @@ func TestBulkOperations(t *testing.T) {
 		NewNode(NewFelt(15), NewFelt(0), nil, nil, nil), nil, nil,
 	)
 	assertAvl(t, t7, 2, []uint64{18, 15})
-	t7.GraphAndPicture("t7", /*debug=*/false)
+	t7.GraphAndPicture(graphDir, "t7", /*debug=*/false)
 
 	d8 := NewDict(NewFelt(11), NewFelt(0), nil, nil, nil, nil)
 
 	u3 := Union(t7, d8, &Counters{})
 	assertAvl(t, u3, 2, []uint64{15, 11, 18})
-	u3.GraphAndPicture("u3", /*debug=*/false)
+	u3.GraphAndPicture(graphDir, "u3", /*debug=*/false)
+}
+
+// assertAvlSubtrees checks the AVL balance property in every subtree, as IsBalanced checks just the root.
+func assertAvlSubtrees(t *testing.T, n *Node) {
+	if n == nil {
+		return
+	}
+	assert.True(t, n.IsBalanced(), "AVL balance property failed for subtree: %v", n.WalkKeysInOrder())
+	assertAvlSubtrees(t, n.treeLeft)
+	assertAvlSubtrees(t, n.treeRight)
+}
+
+func TestDifferenceMissingKey(t *testing.T) {
+	keys := []uint64{44, 35, 15, 34, 5, 37, 30, 29}
+	var state *Node
+	for _, k := range keys {
+		state = Union(state, NewDict(new(Felt).SetUint64(k), NewFelt(0), nil, nil, nil, nil), &Counters{})
+	}
+	// Splitting at 21 joins 29 with an empty left tree, rebalancing with joinLeft
+	state = Difference(state, NewDict(NewFelt(21), NewFelt(0), nil, nil, nil, nil), &Counters{})
+	require.Equal(t, len(keys), state.Size(), "keys dropped: %v", state.WalkKeysInOrder())
+	assert.True(t, state.IsBST(), "BST property failed for tree: %v", state.WalkKeysInOrder())
+	assertAvlSubtrees(t, state)
+	for _, k := range keys {
+		assert.NotNil(t, state.Search(new(Felt).SetUint64(k)), "key %d not found", k)
+	}
+}
+
+func TestDifferenceRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(48))
+	for i := 0; i < 500; i++ {
+		var state *Node
+		keys := make(map[uint64]bool)
+		for j := r.Intn(40); j > 0; j-- {
+			k := uint64(r.Intn(64))
+			keys[k] = true
+			state = Union(state, NewDict(new(Felt).SetUint64(k), NewFelt(0), nil, nil, nil, nil), &Counters{})
+		}
+		k := uint64(r.Intn(64))
+		delete(keys, k)
+		state = Difference(state, NewDict(new(Felt).SetUint64(k), NewFelt(0), nil, nil, nil, nil), &Counters{})
+		require.Equal(t, len(keys), state.Size(), "iteration %d: different size after deleting %d", i, k)
+		assert.True(t, state.IsBST(), "iteration %d: BST property failed", i)
+		assertAvlSubtrees(t, state)
+	}
+}
+
+func TestBatchReport(t *testing.T) {
+	state := NewNode(NewFelt(18), NewFelt(0),
+		NewNode(NewFelt(15), NewFelt(0), nil, nil, nil), NewNode(NewFelt(21), NewFelt(0), nil, nil, nil), nil,
+	)
+	marks := func(root *graph.Node) map[string]graph.Mark {
+		m := make(map[string]graph.Mark)
+		var visit func(g *graph.Node)
+		visit = func(g *graph.Node) {
+			m[g.Fields[0]] = g.Mark
+			for _, edge := range g.Edges {
+				visit(edge.To)
+			}
+		}
+		if root != nil {
+			visit(root)
+		}
+		return m
+	}
+
+	report := NewBatchReport(state)
+	c := &Counters{}
+	union := report.Report("union", Union(state, NewDict(NewFelt(11), NewFelt(0), nil, nil, nil, nil), c), c)
+	assert.Equal(t, graph.Created, marks(union.After)["11"])
+	assert.NotContains(t, marks(union.Before), "11")
+	assert.Equal(t, graph.Stat{Name: "Exposed nodes", Value: c.ExposedCount}, union.Stats[0])
+
+	report = NewBatchReport(state)
+	c = &Counters{}
+	difference := report.Report("difference", Difference(state, NewDict(NewFelt(15), NewFelt(0), nil, nil, nil, nil), c), c)
+	assert.Equal(t, graph.Deleted, marks(difference.Before)["15"])
+	assert.NotContains(t, marks(difference.After), "15")
+	assert.Equal(t, graph.Unchanged, marks(difference.After)["21"])
+	assert.Equal(t, graph.Updated, marks(difference.After)["18"])
+}
+
+func TestTracer(t *testing.T) {
+	state := NewNode(NewFelt(18), NewFelt(0),
+		NewNode(NewFelt(15), NewFelt(0), nil, nil, nil), NewNode(NewFelt(21), NewFelt(0), nil, nil, nil), nil,
+	)
+	tracer := NewTracer("union")
+	newState := Union(state, NewDict(NewFelt(16), NewFelt(0), nil, nil, nil, nil), &Counters{Tracer: tracer})
+	frames := tracer.Trace().Frames
+	require.NotEmpty(t, frames)
+	assert.Equal(t, "union k=16", frames[0].Event)
+	assert.Equal(t, 1, frames[0].Depth)
+	assert.Equal(t, []string{"T", "D"}, []string{frames[0].Trees[0].Port, frames[0].Trees[1].Port})
+	last := frames[len(frames)-1]
+	assert.Equal(t, "union done k=16", last.Event)
+	assert.Equal(t, 1, last.Depth)
+	assert.Equal(t, newState.graphNode(false, nil), last.Trees[0].To)
+	events := make(map[string]int)
+	for _, frame := range frames {
+		assert.GreaterOrEqual(t, frame.Depth, 1)
+		events[strings.Fields(frame.Event)[0]]++
+	}
+	assert.Equal(t, 2, events["split"], "split of the root and of its left child")
+	assert.NotZero(t, events["join"])
+
+	tracer = NewTracer("difference")
+	Difference(newState, NewDict(NewFelt(15), NewFelt(0), nil, nil, nil, nil), &Counters{Tracer: tracer})
+	frames = tracer.Trace().Frames
+	assert.Equal(t, "difference k=15", frames[0].Event)
+	assert.Equal(t, "difference done k=15", frames[len(frames)-1].Event)
 }
 
 func TestStateTree(t *testing.T) {
@@ -2,14 +2,12 @@ package cairo_avl
 
 import (
 	"bufio"
-	"fmt"
 	"io"
 	"math/rand"
-	"os"
-	"os/exec"
 	"strconv"
 	"strings"
 
+	"github.com/canepat/bst/graph"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -248,94 +246,38 @@ func StateChangesFromBinary(statesReader *bufio.Reader, keySize int, nested bool
 	return d, nil
 }
 
-func (d *Dict) Graph(filename string) {
-	colors := []string{"#FDF3D0", "#DCE8FA", "#D9E7D6", "#F1CFCD", "#F5F5F5", "#E1D5E7", "#FFE6CC", "white"}
-	f, err := os.OpenFile(filename + ".dot", os.O_RDWR | os.O_CREATE, 0755)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer func () {
-		if err := f.Close(); err != nil {
-			log.Fatal(err)
-		}
-	}()
-	if _, err := f.WriteString("strict digraph {\nnode [shape=record];\n"); err != nil {
-		log.Fatal(err)
-	}
-	for _, d := range d.WalkNodesInOrder() {
-		log.Traceln("k: ", d.key, " v: ", d.value, " left: ", d.left, " right: ", d.right, " nestedUpsert: ", d.upserts, " nestedDelete: ", d.deletes)
-		var down string
-		if d.upserts != nil {
-			if d.deletes != nil {
-				down = "{<N>Nu|Nd}"
-			} else {
-				down = "<N>Nu"
-			}
-		} else {
-			if d.deletes != nil {
-				down = "<N>Nd"
-			} else {
-				down = d.value.String()
-			}
-		}
-		left, right := "", ""
-		if d.left != nil {
-			left = "<L>L"
-		}
-		if d.right != nil {
-			right = "<R>R"
-		}
-		s := fmt.Sprintln(d.path, "[label=\"", left, "|{<C>", d.key, "|", down, "}|", right, "\" style=filled fillcolor=\"", colors[d.nesting()], "\"];")
-		log.Traceln(s)
-		if _, err := f.WriteString(s); err != nil {
-			log.Fatal(err)
-		}
-	}
-	for _, d := range d.WalkNodesInOrder() {
-		if d.upserts != nil {
-			if _, err := f.WriteString(fmt.Sprintln(d.path, ":N -> ", d.upserts.path, ":C;")); err != nil {
-				log.Fatal(err)
-			}
-		}
-		if d.deletes != nil {
-			if _, err := f.WriteString(fmt.Sprintln(d.path, ":N -> ", d.deletes.path, ":C;")); err != nil {
-				log.Fatal(err)
-			}
-		}
-		if d.left != nil {
-			if _, err := f.WriteString(fmt.Sprintln(d.path, ":L -> ", d.left.path, ":C;")); err != nil {
-				log.Fatal(err)
-			}
-		}
-		if d.right != nil {
-			if _, err := f.WriteString(fmt.Sprintln(d.path, ":R -> ", d.right.path, ":C;")); err != nil {
-				log.Fatal(err)
-			}
-		}
-	}
-	if _, err := f.WriteString("}\n"); err != nil {
-		log.Fatal(err)
-	}
+func (d *Dict) Graph(filename string) error {
+	return graph.Save(filename, d.graphNode(), graph.DOT)
+}
+
+// GraphAndPicture saves the dictionary into dir as name.dot plus a picture, see graph.SaveAndPicture.
+func (d *Dict) GraphAndPicture(dir, name string) error {
+	return graph.SaveAndPicture(dir, name, d)
+}
+
+// Export writes the dictionary in format, see graph.Export.
+func (d *Dict) Export(w io.Writer, format graph.Format) error {
+	return graph.Export(w, d.graphNode(), format)
 }
 
-func (d *Dict) GraphAndPicture(filename string) error {
-	graphDir := "testdata/graph/"
-	_ = os.MkdirAll(graphDir, os.ModePerm)
-	filepath := graphDir + filename
-	_ = os.Remove(filepath + ".dot")
-	_ = os.Remove(filepath + ".png")
-	d.Graph(filepath)
-	dotExecutable, _ := exec.LookPath("dot")
-	cmdDot := &exec.Cmd{
-		Path: dotExecutable,
-		Args: []string{dotExecutable, "-Tpng", filepath + ".dot", "-o", filepath + ".png"},
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+func (d *Dict) graphNode() *graph.Node {
+	if d == nil {
+		return nil
 	}
-	if err := cmdDot.Run(); err != nil {
-		return err
+	fields := []string{d.key.String()}
+	if d.upserts == nil && d.deletes == nil {
+		fields = append(fields, d.value.String())
 	}
-	return nil
+	g := &graph.Node{Fields: fields, Fill: graph.Palette[d.nesting()]}
+	for _, edge := range []struct {
+		port string
+		to   *Dict
+	}{{"L", d.left}, {"Nu", d.upserts}, {"Nd", d.deletes}, {"R", d.right}} {
+		if edge.to != nil {
+			g.Edges = append(g.Edges, graph.Edge{Port: edge.port, To: edge.to.graphNode()})
+		}
+	}
+	return g
 }
 
 func (d *Dict) Size() int {
@@ -4,12 +4,11 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"os"
-	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/canepat/bst/graph"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -49,6 +48,15 @@ func makeNode(k, v, h *Felt, T_L, T_R, T_N *Node) *Node {
 	return &n
 }
 
+func (n *Node) Key() *Felt {
+	return n.key
+}
+
+// Value returns the value of the node, nil for hash nodes.
+func (n *Node) Value() *Felt {
+	return n.value
+}
+
 func (n *Node) nesting() int {
 	return strings.Count(n.path, "N")
 }
@@ -302,104 +310,133 @@ func StateFromBinary(statesReader *bufio.Reader, keySize int, nested bool) (t *N
 	return t, nil
 }
 
-func (n *Node) Graph(filename string, debug bool) {
-	colors := []string{"#FDF3D0", "#DCE8FA", "#D9E7D6", "#F1CFCD", "#F5F5F5", "#E1D5E7", "#FFE6CC", "white"}
-	f, err := os.OpenFile(filename + ".dot", os.O_RDWR | os.O_CREATE, 0755)
-	if err != nil {
-		log.Fatal(err)
+func (n *Node) Graph(filename string, debug bool) error {
+	return graph.Save(filename, n.graphNode(debug, nil), graph.DOT)
+}
+
+// GraphAndPicture saves the tree into dir as name.dot plus a picture, see graph.SaveAndPicture.
+func (n *Node) GraphAndPicture(dir, name string, debug bool) error {
+	return graph.SaveAndPicture(dir, name, graph.NewExporter(n.graphNode(debug, nil)))
+}
+
+// Export writes the tree in format, see graph.Export.
+func (n *Node) Export(w io.Writer, format graph.Format) error {
+	return graph.Export(w, n.graphNode(false, nil), format)
+}
+
+// graphLabel returns key, value or nested tree mark and font colour: red if exposed, blue if only its height was taken.
+func (n *Node) graphLabel(debug bool) (nodeId, down, fontColor string) {
+	if n.treeNested != nil {
+		down = "N"
+	} else if n.value == nil {
+		// HASH node type
+		down = "H"
+	} else {
+		down = n.value.String()
 	}
-	defer func () {
-		if err := f.Close(); err != nil {
-			log.Fatal(err)
-		}
-	}()
-	if _, err := f.WriteString("strict digraph {\nnode [shape=record];\n"); err != nil {
-		log.Fatal(err)
-	}
-	for _, n := range n.WalkNodesInOrder() {
-		log.Tracef("p=%p %+v k=%d nesting=%d\n", n, n, n.key, n.nesting())
-		left, right := "", ""
-		if n.treeLeft != nil {
-			left = "<L>L"
-		}
-		if n.treeRight != nil {
-			right = "<R>R"
-		}
-		var down string
-		if n.treeNested != nil {
-			down = "<N>N"
-		} else if n.value == nil {
-			// HASH node type
-			down = "<N>H"
-		} else {
-			down = n.value.String()
-		}
-		var nodeId string
-		if debug {
-			nodeId = fmt.Sprintf("k=%d [%t]", n.key, n.exposed)
-		} else {
-			nodeId = n.key.String()
-		}
-		var fc string
-		if n.heightTaken {
-			if n.exposed {
-				fc = "red"
-			} else {
-				fc = "blue"
-			}
-		} else {
-			if (n.exposed) {
-				fc = "red"
-			} else {
-				fc = "black"
-			}
-		}
-		s := fmt.Sprintln(n.path,
-			" [label=\"", left, "|{<C>", nodeId, "|", down, "}|", right, "\" style=filled fontcolor=", fc ," fillcolor=\"", colors[n.nesting()], "\"];")
-		if _, err := f.WriteString(s); err != nil {
-			log.Fatal(err)
-		}
+	if debug {
+		nodeId = fmt.Sprintf("k=%d [%t]", n.key, n.exposed)
+	} else {
+		nodeId = n.key.String()
 	}
-	for _, n := range n.WalkNodesInOrder() {
-		if n.treeLeft != nil {
-			if _, err := f.WriteString(fmt.Sprintln(n.path, ":L -> ", n.treeLeft.path, ":C;")); err != nil {
-				log.Fatal(err)
-			}
-		}
-		if n.treeRight != nil {
-			if _, err := f.WriteString(fmt.Sprintln(n.path, ":R -> ", n.treeRight.path, ":C;")); err != nil {
-				log.Fatal(err)
-			}
-		}
-		if n.treeNested != nil {
-			if _, err := f.WriteString(fmt.Sprintln(n.path, ":N -> ", n.treeNested.path, ":C;")); err != nil {
-				log.Fatal(err)
-			}
+	if n.exposed {
+		fontColor = "red"
+	} else if n.heightTaken {
+		fontColor = "blue"
+	} else {
+		fontColor = "black"
+	}
+	return nodeId, down, fontColor
+}
+
+// graphNode converts the subtree rooted at n. If nodes is not nil, it collects the converted nodes.
+func (n *Node) graphNode(debug bool, nodes map[*Node]*graph.Node) *graph.Node {
+	if n == nil {
+		return nil
+	}
+	nodeId, down, fontColor := n.graphLabel(debug)
+	g := &graph.Node{Fields: []string{nodeId, down}, Fill: graph.Palette[n.nesting()], FontColor: fontColor}
+	if nodes != nil {
+		nodes[n] = g
+	}
+	for _, edge := range []struct {
+		port string
+		to   *Node
+	}{{"L", n.treeLeft}, {"N", n.treeNested}, {"R", n.treeRight}} {
+		if edge.to != nil {
+			g.Edges = append(g.Edges, graph.Edge{Port: edge.port, To: edge.to.graphNode(debug, nodes)})
 		}
 	}
-	if _, err := f.WriteString("}\n"); err != nil {
-		log.Fatal(err)
+	return g
+}
+
+// identities collects the keys of the nodes in the subtree rooted at n, prefixed by the keys of the nodes
+// holding their nested trees.
+func (n *Node) identities(prefix string, ids map[*Node]string) {
+	if n == nil {
+		return
 	}
+	ids[n] = prefix + n.key.String()
+	n.treeLeft.identities(prefix, ids)
+	n.treeNested.identities(ids[n]+"/", ids)
+	n.treeRight.identities(prefix, ids)
+}
+
+// BatchReport pictures the state tree before and after a bulk operation, see graph.WriteHTML.
+type BatchReport struct {
+	before *graph.Node
+	nodes  map[*Node]*graph.Node
+	ids    map[*Node]string
+}
+
+// NewBatchReport takes the picture of state before a bulk operation.
+func NewBatchReport(state *Node) *BatchReport {
+	r := &BatchReport{nodes: make(map[*Node]*graph.Node), ids: make(map[*Node]string)}
+	r.before = state.graphNode(false, r.nodes)
+	state.identities("", r.ids)
+	return r
 }
 
-func (n *Node) GraphAndPicture(filename string, debug bool) error {
-	graphDir := "testdata/graph/"
-	_ = os.MkdirAll(graphDir, os.ModePerm)
-	filepath := graphDir + filename
-	_ = os.Remove(filepath + ".dot")
-	_ = os.Remove(filepath + ".png")
-	n.Graph(filepath, debug)
-	dotExecutable, _ := exec.LookPath("dot")
-	cmdDot := &exec.Cmd{
-		Path: dotExecutable,
-		Args: []string{dotExecutable, "-Tpng", filepath + ".dot", "-o", filepath + ".png"},
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+// Report returns the report of the bulk operation with counters c which turned the state into newState. Nodes
+// of newState not in the state are marked as updated if their key was in the state, otherwise as created. The
+// state nodes missing in newState are marked as updated or deleted in the same way.
+func (r *BatchReport) Report(title string, newState *Node, c *Counters) graph.Report {
+	report := graph.Report{Title: title, Before: r.before, Stats: []graph.Stat{
+		{Name: "Exposed nodes", Value: c.ExposedCount},
+		{Name: "Nodes with height taken", Value: c.HeightCount},
+		{Name: "Re-hashed nodes", Value: uint64(newState.CountNewHashes())},
+	}}
+	after, ids := make(map[*Node]*graph.Node), make(map[*Node]string)
+	report.After = newState.graphNode(false, after)
+	newState.identities("", ids)
+	beforeIds, afterIds := make(map[string]bool), make(map[string]bool)
+	for _, id := range r.ids {
+		beforeIds[id] = true
+	}
+	for _, id := range ids {
+		afterIds[id] = true
+	}
+	for n, g := range r.nodes {
+		if _, shared := after[n]; shared {
+			if n.exposed {
+				g.Mark = graph.Exposed
+			}
+		} else if afterIds[r.ids[n]] {
+			g.Mark = graph.Updated
+		} else {
+			g.Mark = graph.Deleted
+		}
 	}
-	if err := cmdDot.Run(); err != nil {
-		return err
+	for n, g := range after {
+		if before, shared := r.nodes[n]; shared {
+			g.Mark = before.Mark
+		} else if beforeIds[ids[n]] {
+			g.Mark = graph.Updated
+		} else {
+			g.Mark = graph.Created
+		}
 	}
-	return nil
+	return report
 }
 
 func exposeNode(n *Node, c *Counters) (k, v *Felt, T_L, T_R, T_N *Node) {
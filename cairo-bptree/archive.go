@@ -0,0 +1,136 @@
+package cairo_bptree
+
+import (
+	"fmt"
+	"sort"
+)
+
+// historyEntry is the value of a key from block on, deleted if the key is missing.
+type historyEntry struct {
+	block   uint64
+	value   Felt
+	deleted bool
+}
+
+// Archive is a Tree23 keeping the history of its keys, one entry per block changing each key, to answer queries
+// at past blocks. History older than horizon blocks before the last one is dropped by Prune.
+type Archive struct {
+	tree     *Tree23
+	index    *Tree23 // keys having history, values unused
+	history  map[Felt][]historyEntry
+	block    uint64 // last block applied
+	applied  bool
+	horizon  uint64 // zero keeps all the history
+	prunedTo uint64 // first block whose state can be queried
+}
+
+func NewArchive(horizon uint64) *Archive {
+	return &Archive{tree: NewEmptyTree23(), index: NewEmptyTree23(), history: make(map[Felt][]historyEntry), horizon: horizon}
+}
+
+// Tree returns the state at the last block.
+func (a *Archive) Tree() *Tree23 {
+	return a.tree
+}
+
+func (a *Archive) Block() uint64 {
+	return a.block
+}
+
+// Apply applies batch as the state transition of block, which must follow the last block applied.
+func (a *Archive) Apply(block uint64, batch Batch) error {
+	if a.applied && block <= a.block {
+		return fmt.Errorf("archive: block %d not after last block %d", block, a.block)
+	}
+	// Keys are copied first, the tree takes over the batch slices
+	touchedKeys := append(batch.Upserts.Keys(), batch.Deletes...)
+	a.tree.Apply(batch)
+	a.block, a.applied = block, true
+	newKeys := make([]Felt, 0)
+	for _, key := range touchedKeys {
+		value, found := a.tree.Get(key)
+		entries := a.history[key]
+		if len(entries) == 0 {
+			if !found {
+				continue
+			}
+			newKeys = append(newKeys, key)
+		}
+		entry := historyEntry{block: block, value: value, deleted: !found}
+		if len(entries) == 0 {
+			a.history[key] = append(entries, entry)
+		} else if last := entries[len(entries)-1]; last.block == block {
+			entries[len(entries)-1] = entry // key both upserted and deleted
+		} else if last.value != entry.value || last.deleted != entry.deleted {
+			a.history[key] = append(entries, entry)
+		}
+	}
+	if len(newKeys) > 0 {
+		kvItems, _ := NewKeyValues(newKeys, make([]Felt, len(newKeys)))
+		a.index.Upsert(kvItems)
+	}
+	return nil
+}
+
+// GetAt returns the value of key at block, i.e. after the batch of block was applied.
+func (a *Archive) GetAt(key Felt, block uint64) (value Felt, found bool, err error) {
+	if block < a.prunedTo {
+		return 0, false, fmt.Errorf("archive: block %d pruned, history starts at block %d", block, a.prunedTo)
+	}
+	value, found = valueAt(a.history[key], block)
+	return value, found, nil
+}
+
+// RangeAt returns the pairs between from and to, both included, at block.
+func (a *Archive) RangeAt(from, to Felt, block uint64) (KeyValues, error) {
+	if block < a.prunedTo {
+		return KeyValues{}, fmt.Errorf("archive: block %d pruned, history starts at block %d", block, a.prunedTo)
+	}
+	keys, values := make([]Felt, 0), make([]Felt, 0)
+	for _, key := range a.index.Range(from, to).Keys() {
+		if value, found := valueAt(a.history[key], block); found {
+			keys, values = append(keys, key), append(values, value)
+		}
+	}
+	return NewKeyValues(keys, values)
+}
+
+func valueAt(entries []historyEntry, block uint64) (value Felt, found bool) {
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].block > block })
+	if i == 0 || entries[i-1].deleted {
+		return 0, false
+	}
+	return entries[i-1].value, true
+}
+
+// Prune drops the history older than horizon blocks before the last one and returns the number of entries dropped.
+// Each key keeps the entry valid at the first block still queried.
+func (a *Archive) Prune() int {
+	if a.horizon == 0 || a.block < a.horizon || a.block-a.horizon <= a.prunedTo {
+		return 0
+	}
+	a.prunedTo = a.block - a.horizon
+	dropped, droppedKeys := 0, make([]Felt, 0)
+	history := make(map[Felt][]historyEntry, len(a.history))
+	for key, entries := range a.history {
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].block > a.prunedTo })
+		// The entry valid at prunedTo is kept unless it is a deletion
+		if first := i - 1; i > 0 {
+			if entries[first].deleted {
+				first++
+			}
+			dropped += first
+			entries = append([]historyEntry{}, entries[first:]...)
+		}
+		if len(entries) == 0 {
+			droppedKeys = append(droppedKeys, key)
+			continue
+		}
+		history[key] = entries
+	}
+	a.history = history
+	if len(droppedKeys) > 0 {
+		a.index.Delete(sortedKeys(droppedKeys))
+	}
+	return dropped
+}
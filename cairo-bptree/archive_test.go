@@ -0,0 +1,116 @@
+package cairo_bptree
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveQueries(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 20; i++ {
+		horizon := uint64(r.Intn(20))
+		archive, states, blocks := NewArchive(horizon), make(map[uint64]map[Felt]Felt), make([]uint64, 0)
+		state, block := make(map[Felt]Felt), uint64(r.Intn(3))
+		for j := 0; j < 30; j++ {
+			batch := Batch{Upserts: randomKeyValues(r, r.Intn(16)), Deletes: randomKeys(r, r.Intn(32))}
+			for k, key := range batch.Upserts.keys {
+				state[*key] = *batch.Upserts.values[k]
+			}
+			state = withoutKeys(state, batch.Deletes)
+			require.NoError(t, archive.Apply(block, batch), "iteration %d block %d", i, block)
+			states[block], blocks = copyState(state), append(blocks, block)
+			block += 1 + uint64(r.Intn(3))
+		}
+		for _, prune := range []bool{false, true} {
+			if prune {
+				archive.Prune()
+			}
+			for _, b := range blocks {
+				_, _, err := archive.GetAt(0, b)
+				if b < archive.prunedTo {
+					assert.Error(t, err, "iteration %d block %d: pruned block queried", i, b)
+					continue
+				}
+				require.NoError(t, err, "iteration %d block %d", i, b)
+				for key := Felt(0); key < 256; key++ {
+					value, found, _ := archive.GetAt(key, b)
+					expected, present := states[b][key]
+					require.Equal(t, present, found, "iteration %d block %d key %d: different presence", i, b, key)
+					require.Equal(t, expected, value, "iteration %d block %d key %d: different value", i, b, key)
+				}
+				from := Felt(r.Intn(256))
+				to := from + Felt(r.Intn(64))
+				kvItems, err := archive.RangeAt(from, to, b)
+				require.NoError(t, err, "iteration %d block %d", i, b)
+				expected := make(map[Felt]Felt)
+				for key, value := range states[b] {
+					if key >= from && key <= to {
+						expected[key] = value
+					}
+				}
+				assert.Equal(t, expected, kvMap(kvItems), "iteration %d block %d: different range [%d, %d]", i, b, from, to)
+			}
+		}
+		assert.Equal(t, state, kvMap(archive.Tree().KeyValues()), "iteration %d: different last state", i)
+	}
+}
+
+func TestArchiveBlockOrder(t *testing.T) {
+	archive := NewArchive(0)
+	require.NoError(t, archive.Apply(0, Batch{Upserts: KV([]Felt{1}, []Felt{10})}))
+	require.NoError(t, archive.Apply(5, Batch{Upserts: KV([]Felt{1}, []Felt{50})}))
+	assert.Error(t, archive.Apply(5, Batch{Upserts: KV([]Felt{1}, []Felt{51})}), "block applied twice")
+	value, found, err := archive.GetAt(1, 4)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, Felt(10), value)
+}
+
+func TestArchivePrune(t *testing.T) {
+	archive := NewArchive(10)
+	require.NoError(t, archive.Apply(1, Batch{Upserts: KV([]Felt{1, 2}, []Felt{10, 20})}))
+	require.NoError(t, archive.Apply(2, Batch{Upserts: KV([]Felt{1}, []Felt{11}), Deletes: []Felt{2}}))
+	require.NoError(t, archive.Apply(3, Batch{Upserts: KV([]Felt{1}, []Felt{12})}))
+	require.NoError(t, archive.Apply(14, Batch{Upserts: KV([]Felt{1}, []Felt{13})}))
+	assert.Equal(t, 4, archive.Prune(), "different entries dropped")
+	assert.Equal(t, 0, archive.Prune(), "entries dropped twice")
+	value, found, err := archive.GetAt(1, 4)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, Felt(12), value)
+	_, _, err = archive.GetAt(1, 3)
+	assert.Error(t, err, "pruned block queried")
+	kvItems, err := archive.RangeAt(0, 10, 4)
+	require.NoError(t, err)
+	assert.Equal(t, KV([]Felt{1}, []Felt{12}), kvItems)
+	assert.Equal(t, 1, archive.index.Len(), "deleted key left in index")
+}
+
+func copyState(state map[Felt]Felt) map[Felt]Felt {
+	return withoutKeys(state, nil)
+}
+
+func withoutKeys(state map[Felt]Felt, keys []Felt) map[Felt]Felt {
+	removed := make(map[Felt]bool, len(keys))
+	for _, key := range keys {
+		removed[key] = true
+	}
+	c := make(map[Felt]Felt, len(state))
+	for key, value := range state {
+		if !removed[key] {
+			c[key] = value
+		}
+	}
+	return c
+}
+
+func kvMap(kvItems KeyValues) map[Felt]Felt {
+	m := make(map[Felt]Felt, kvItems.Len())
+	for i, key := range kvItems.keys {
+		m[*key] = *kvItems.values[i]
+	}
+	return m
+}
@@ -0,0 +1,24 @@
+package cairo_bptree
+
+const arenaSlabSize = 4096
+
+// nodeArena allocates nodes in slabs, so that building a tree costs one allocation every arenaSlabSize nodes.
+// Nodes are never freed one by one: a slab is reclaimed only when none of its nodes is reachable anymore.
+type nodeArena struct {
+	slab []Node23
+}
+
+func (a *nodeArena) newNode() *Node23 {
+	if len(a.slab) == cap(a.slab) {
+		a.slab = make([]Node23, 0, arenaSlabSize)
+	}
+	a.slab = a.slab[:len(a.slab)+1]
+	return &a.slab[len(a.slab)-1]
+}
+
+func (s *Stats) newNode() *Node23 {
+	if s.arena == nil {
+		return new(Node23)
+	}
+	return s.arena.newNode()
+}
@@ -0,0 +1,109 @@
+package cairo_bptree
+
+import (
+	"bufio"
+	"bytes"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArenaTree(t *testing.T) {
+	r := rand.New(rand.NewSource(31))
+	for i := 0; i < 100; i++ {
+		state, changes, deletes := randomKeyValues(r, r.Intn(1024)), randomKeyValues(r, r.Intn(128)), randomKeys(r, r.Intn(128))
+		heapTree, arenaTree := NewTree23(state.clone()), NewTree23WithArena(state.clone())
+		assert.Equal(t, heapTree.RootHash(), arenaTree.RootHash(), "iteration %d: different root after build", i)
+		heapTree.Upsert(changes.clone())
+		arenaTree.Upsert(changes.clone())
+		assert.Equal(t, heapTree.RootHash(), arenaTree.RootHash(), "iteration %d: different root after upsert", i)
+		heapTree.Delete(deletes)
+		arenaTree.Delete(deletes)
+		assert.Equal(t, heapTree.RootHash(), arenaTree.RootHash(), "iteration %d: different root after delete", i)
+	}
+}
+
+// treeLayout is a way to allocate the nodes. Slices are inline in the nodes unless built with -tags separateslices,
+// which allocates them apart as the former layout did.
+type treeLayout struct {
+	name  string
+	build func(KeyValues) *Tree23
+}
+
+var treeLayouts = []treeLayout{
+	{"heap", NewTree23},
+	{"arena", NewTree23WithArena},
+}
+
+func (layout treeLayout) run(b *testing.B, f func(*testing.B)) {
+	b.Run(layout.name, f)
+}
+
+// benchmarkKeyValues generates random pairs from the number of bytes in environment variable name or defaultSize,
+// e.g. BPTREE_STATE_SIZE=1073741824 BPTREE_STATE_CHANGES_SIZE=104857600 runs the README workload.
+func benchmarkKeyValues(b *testing.B, name string, defaultSize int, seed int64) KeyValues {
+	size := defaultSize
+	if value, ok := os.LookupEnv(name); ok {
+		var err error
+		if size, err = strconv.Atoi(value); err != nil {
+			b.Fatalf("invalid %s: %v", name, err)
+		}
+	}
+	data := randomBytes(rand.New(rand.NewSource(seed)), size)
+	return NewKeyBinaryFactory(8).NewUniqueKeyValues(bufio.NewReader(bytes.NewReader(data)))
+}
+
+func heapStats() runtime.MemStats {
+	runtime.GC()
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	return memStats
+}
+
+func BenchmarkLayoutNewTree23(b *testing.B) {
+	state := benchmarkKeyValues(b, "BPTREE_STATE_SIZE", 1024*1024, 31)
+	for _, layout := range treeLayouts {
+		layout.run(b, func(b *testing.B) {
+			b.ReportAllocs()
+			var bytesPerKey float64
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				kvItems, before := state.clone(), heapStats()
+				b.StartTimer()
+				tree := layout.build(kvItems)
+				b.StopTimer()
+				after := heapStats()
+				bytesPerKey = (float64(after.HeapAlloc) - float64(before.HeapAlloc)) / float64(tree.Len())
+				runtime.KeepAlive(tree)
+				b.StartTimer()
+			}
+			b.ReportMetric(bytesPerKey, "bytes/key")
+		})
+	}
+}
+
+func BenchmarkLayoutUpsert(b *testing.B) {
+	state := benchmarkKeyValues(b, "BPTREE_STATE_SIZE", 1024*1024, 31)
+	changes := benchmarkKeyValues(b, "BPTREE_STATE_CHANGES_SIZE", 64*1024, 32)
+	for _, layout := range treeLayouts {
+		layout.run(b, func(b *testing.B) {
+			b.ReportAllocs()
+			var mallocs uint64
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				tree, kvItems := layout.build(state.clone()), changes.clone()
+				before := heapStats()
+				b.StartTimer()
+				tree.Upsert(kvItems)
+				b.StopTimer()
+				mallocs += heapStats().Mallocs - before.Mallocs
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(mallocs)/float64(b.N*changes.Len()), "allocs/upsert")
+		})
+	}
+}
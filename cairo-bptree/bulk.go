@@ -7,11 +7,11 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func upsert(n *Node23, kvItems KeyValues, stats *Stats) (nodes []*Node23, newFirstKey *Felt, intermediateKeys []*Felt) {
+func upsert(n *Node23, kvItems KeyValues, stats *Stats) (nodes []*Node23, newFirstKey *Felt, intermediateKeys []Felt) {
 	ensure(sort.IsSorted(kvItems), "kvItems are not sorted by key")
 
 	if kvItems.Len() == 0 && n == nil {
-		return []*Node23{n}, nil, []*Felt{}
+		return []*Node23{n}, nil, []Felt{}
 	}
 	if n == nil {
 		n = makeEmptyLeafNode()
@@ -23,11 +23,11 @@ func upsert(n *Node23, kvItems KeyValues, stats *Stats) (nodes []*Node23, newFir
 	}
 }
 
-func upsertLeaf(n *Node23, kvItems KeyValues, stats *Stats) (nodes []*Node23, newFirstKey *Felt, intermediateKeys []*Felt) {
+func upsertLeaf(n *Node23, kvItems KeyValues, stats *Stats) (nodes []*Node23, newFirstKey *Felt, intermediateKeys []Felt) {
 	ensure(n.isLeaf, "node is not leaf")
 
 	if kvItems.Len() == 0 {
-		if n.nextKey() != nil {
+		if n.hasNextKey() {
 			intermediateKeys = append(intermediateKeys, n.nextKey())
 		}
 		return []*Node23{n}, nil, intermediateKeys
@@ -37,42 +37,39 @@ func upsertLeaf(n *Node23, kvItems KeyValues, stats *Stats) (nodes []*Node23, ne
 		n.exposed = true
 		stats.ExposedCount++
 		stats.OpeningHashes += n.howManyHashes()
+		stats.nodeExposed(n)
 	}
 
 	currentFirstKey := n.firstKey()
 	addOrReplaceLeaf(n, kvItems, stats)
 	if n.firstKey() != currentFirstKey {
-		newFirstKey = n.firstKey()
+		firstKey := n.firstKey()
+		newFirstKey = &firstKey
 	} else {
 		newFirstKey = nil
 	}
 
 	if n.keyCount() > 3 {
-		for n.keyCount() > 3 {
-			newLeaf := makeLeafNode(n.keys[:3], n.values[:3], stats)
-			intermediateKeys = append(intermediateKeys, n.keys[2])
-			nodes = append(nodes, newLeaf)
-			n.keys, n.values = n.keys[2:], n.values[2:]
-		}
-		newLeaf := makeLeafNode(n.keys[:], n.values[:], stats)
-		if n.nextKey() != nil {
-			intermediateKeys = append(intermediateKeys, n.nextKey())
+		nodes = splitLeaf(n, stats)
+		for _, leaf := range nodes {
+			if leaf.hasNextKey() {
+				intermediateKeys = append(intermediateKeys, leaf.nextKey())
+			}
 		}
-		nodes = append(nodes, newLeaf)
 		return nodes, newFirstKey, intermediateKeys
 	} else {
-		if n.nextKey() != nil {
+		if n.hasNextKey() {
 			intermediateKeys = append(intermediateKeys, n.nextKey())
 		}
 		return []*Node23{n}, newFirstKey, intermediateKeys
 	}
 }
 
-func upsertInternal(n *Node23, kvItems KeyValues, stats *Stats) (nodes []*Node23, newFirstKey *Felt, intermediateKeys []*Felt) {
+func upsertInternal(n *Node23, kvItems KeyValues, stats *Stats) (nodes []*Node23, newFirstKey *Felt, intermediateKeys []Felt) {
 	ensure(!n.isLeaf, "node is not internal")
 
 	if kvItems.Len() == 0 {
-		if n.lastLeaf().nextKey() != nil {
+		if n.lastLeaf().hasNextKey() {
 			intermediateKeys = append(intermediateKeys, n.lastLeaf().nextKey())
 		}
 		return []*Node23{n}, nil, intermediateKeys
@@ -82,15 +79,18 @@ func upsertInternal(n *Node23, kvItems KeyValues, stats *Stats) (nodes []*Node23
 		n.exposed = true
 		stats.ExposedCount++
 		stats.OpeningHashes += n.howManyHashes()
+		stats.nodeExposed(n)
 	}
 
 	itemSubsets := splitItems(n, kvItems)
 
 	newChildren := make([]*Node23, 0)
-	newKeys := make([]*Felt, 0)
+	newKeys := make([]Felt, 0)
 	for i := len(n.children)-1; i >= 0; i-- {
 		child := n.children[i]
+		stats.depth++
 		childNodes, childNewFirstKey, childIntermediateKeys := upsert(child, itemSubsets[i], stats)
+		stats.depth--
 		newChildren = append(childNodes, newChildren...)
 		newKeys = append(childIntermediateKeys, newKeys...)
 		if childNewFirstKey != nil {
@@ -99,13 +99,13 @@ func upsertInternal(n *Node23, kvItems KeyValues, stats *Stats) (nodes []*Node23
 				previousChild := n.children[i-1]
 				if previousChild.isLeaf {
 					ensure(len(previousChild.keys) > 0, "upsertInternal: previousChild has no keys")
-					if previousChild.nextKey() != childNewFirstKey {
+					if !previousChild.nextKeyIs(childNewFirstKey) {
 						previousChild.setNextKey(childNewFirstKey, stats)
 					}
 				} else {
 					ensure(len(previousChild.children) > 0, "upsertInternal: previousChild has no children")
 					lastLeaf := previousChild.lastLeaf()
-					if lastLeaf.nextKey() != childNewFirstKey {
+					if !lastLeaf.nextKeyIs(childNewFirstKey) {
 						lastLeaf.setNextKey(childNewFirstKey, stats)
 					}
 				}
@@ -162,10 +162,170 @@ func upsertInternal(n *Node23, kvItems KeyValues, stats *Stats) (nodes []*Node23
 		// TODO(canepat): n.keys changed instead of making new node
 		n.updated = true
 		stats.UpdatedCount++
+		stats.nodeUpdated(n)
 		return []*Node23{n}, newFirstKey, intermediateKeys
 	}
 }
 
+// splitLeaf splits the overflowing leaf n into leaves having 2 keys, but for the last one having 1 or 2 keys.
+// The keys of n are left untouched for the observer.
+func splitLeaf(n *Node23, stats *Stats) (nodes []*Node23) {
+	keys, values := n.keys, n.values
+	for len(keys) > 3 {
+		nodes = append(nodes, makeLeafNode(keys[:3], values[:3], false, stats))
+		keys, values = keys[2:], values[2:]
+	}
+	nodes = append(nodes, makeLeafNode(keys, values, n.noNextKey, stats))
+	stats.leafSplit(n, nodes)
+	return nodes
+}
+
+// keyMergeFunc works as MergeFunc also knowing the key.
+type keyMergeFunc func(key Felt, oldValue *Felt, delta Felt) (Felt, bool)
+
+// merge applies deltas with fn to the subtree n in a single traversal, adding, updating and dropping keys.
+// It returns the nodes replacing n, as high as n: none if n is left without keys, followingKey being then
+// the key following n, or a single node having one child if n underflows, which the parent merges as delete
+// does. Subtrees overflowing with added keys are split as upsert does.
+func merge(n *Node23, deltas KeyValues, fn keyMergeFunc, stats *Stats) (nodes []*Node23, followingKey *Felt) {
+	ensure(sort.IsSorted(deltas), "deltas are not sorted by key")
+
+	if deltas.Len() == 0 {
+		if n == nil {
+			return []*Node23{}, nil
+		}
+		return []*Node23{n}, nil
+	}
+	if n == nil {
+		n = makeEmptyLeafNode()
+	}
+
+	if !n.exposed {
+		n.exposed = true
+		stats.ExposedCount++
+		stats.OpeningHashes += n.howManyHashes()
+		stats.nodeExposed(n)
+	}
+
+	if n.isLeaf {
+		return mergeLeaf(n, deltas, fn, stats)
+	} else {
+		return mergeInternal(n, deltas, fn, stats)
+	}
+}
+
+// mergeLeaf merges the pairs of leaf n with deltas, both sorted by key.
+func mergeLeaf(n *Node23, deltas KeyValues, fn keyMergeFunc, stats *Stats) (nodes []*Node23, followingKey *Felt) {
+	ensure(n.isLeaf, "mergeLeaf: node is not leaf")
+
+	leafKeys, leafValues := n.keys[:n.keyCount()-1], n.values[:n.valueCount()-1]
+	keys, values := make([]Felt, 0, len(leafKeys)+deltas.Len()+1), make([]Felt, 0, len(leafValues)+deltas.Len()+1)
+	updated := false
+	for i, j := 0, 0; i < len(leafKeys) || j < deltas.Len(); {
+		switch {
+		case j == deltas.Len() || i < len(leafKeys) && leafKeys[i] < *deltas.keys[j]:
+			keys, values = append(keys, leafKeys[i]), append(values, leafValues[i])
+			i++
+		case i == len(leafKeys) || *deltas.keys[j] < leafKeys[i]:
+			if value, keep := fn(*deltas.keys[j], nil, *deltas.values[j]); keep {
+				keys, values = append(keys, *deltas.keys[j]), append(values, value)
+			}
+			j++
+		default:
+			oldValue := leafValues[i]
+			if value, keep := fn(leafKeys[i], &oldValue, *deltas.values[j]); keep {
+				keys, values = append(keys, leafKeys[i]), append(values, value)
+			}
+			updated = true
+			i, j = i+1, j+1
+		}
+	}
+	if len(keys) == 0 {
+		if len(leafKeys) > 0 {
+			stats.DeletedCount++
+		}
+		return []*Node23{}, n.nextKeyOrNil()
+	}
+
+	n.setSlices(nil, append(keys, n.nextKey()), append(values, n.nextValue()))
+	if updated {
+		n.updated = true
+		stats.UpdatedCount++
+		stats.nodeUpdated(n)
+	}
+	if n.keyCount() > 3 {
+		return splitLeaf(n, stats), nil
+	}
+	return []*Node23{n}, nil
+}
+
+// mergeInternal merges the children of n with the deltas split by the keys of n, then links the leaves across
+// children, merges the underflowing children and splits n if overflowing.
+func mergeInternal(n *Node23, deltas KeyValues, fn keyMergeFunc, stats *Stats) (nodes []*Node23, followingKey *Felt) {
+	ensure(!n.isLeaf, "mergeInternal: node is not internal")
+
+	itemSubsets := splitItems(n, deltas)
+	childNodes, childFollowingKeys := make([][]*Node23, n.childrenCount()), make([]*Felt, n.childrenCount())
+	for i := n.childrenCount() - 1; i >= 0; i-- {
+		stats.depth++
+		childNodes[i], childFollowingKeys[i] = merge(n.children[i], itemSubsets[i], fn, stats)
+		stats.depth--
+	}
+
+	// Link the last leaf of each remaining node to the first key of the following one
+	hasFollowingKey := false
+	children := make([]*Node23, 0, n.childrenCount())
+	for i := n.childrenCount() - 1; i >= 0; i-- {
+		if len(childNodes[i]) == 0 {
+			if !hasFollowingKey {
+				followingKey, hasFollowingKey = childFollowingKeys[i], true
+			}
+			continue
+		}
+		for j := len(childNodes[i]) - 1; j >= 0; j-- {
+			child := childNodes[i][j]
+			if hasFollowingKey {
+				if lastLeaf := child.lastLeaf(); !lastLeaf.nextKeyIs(followingKey) {
+					lastLeaf.setNextKey(followingKey, stats)
+				}
+			}
+			childFirstKey := child.firstLeaf().firstKey()
+			followingKey, hasFollowingKey = &childFirstKey, true
+			children = append([]*Node23{child}, children...)
+		}
+	}
+
+	children = mergeUnderflowingChildren(children, stats)
+	if len(children) == 0 {
+		n.children, n.keys = n.children[:0], n.keys[:0]
+		return []*Node23{}, followingKey
+	}
+	n.updated = true
+	stats.UpdatedCount++
+	stats.nodeUpdated(n)
+	for _, child := range children {
+		if !child.isLeaf && child.childrenCount() > 1 {
+			child.updateSeparators()
+		}
+	}
+	if len(children) <= 3 {
+		n.children = children
+		if n.childrenCount() > 1 {
+			n.updateSeparators()
+		} else {
+			n.keys = n.keys[:0]
+		}
+		return []*Node23{n}, nil
+	}
+	for len(children) > 3 {
+		nodes = append(nodes, makeInternalNode(children[:2], []Felt{children[0].lastLeaf().nextKey()}, stats))
+		children = children[2:]
+	}
+	last := makeInternalNode(children, []Felt{}, stats)
+	last.updateSeparators()
+	return append(nodes, last), nil
+}
+
 func addOrReplaceLeaf(n *Node23, kvItems KeyValues, stats *Stats) {
 	ensure(n.isLeaf, "addOrReplaceLeaf: node is not leaf")
 	ensure(len(n.keys) > 0 && len(n.values) > 0, "addOrReplaceLeaf: node keys/values are empty")
@@ -180,8 +340,8 @@ func addOrReplaceLeaf(n *Node23, kvItems KeyValues, stats *Stats) {
 	// kvItems are ordered by key: search there using n.keys that here are 1 or 2 by design (0 just for empty tree)
 	switch (n.keyCount()) {
 	case 0:
-		n.keys = append(n.keys, kvItems.keys...)
-		n.values = append(n.values, kvItems.values...)
+		n.keys = appendFelts(n.keys, kvItems.keys...)
+		n.values = appendFelts(n.values, kvItems.values...)
 	case 1:
 		addOrReplaceLeaf1(n, kvItems, stats)
 	case 2:
@@ -200,27 +360,29 @@ func addOrReplaceLeaf1(n *Node23, kvItems KeyValues, stats *Stats) {
 	ensure(n.keyCount() == 1, "addOrReplaceLeaf1: leaf has not 1 *canonical* key")
 
 	key0, value0 := n.keys[0], n.values[0]
-	index0 := sort.Search(kvItems.Len(), func(i int) bool { return *kvItems.keys[i] >= *key0 })
+	index0 := sort.Search(kvItems.Len(), func(i int) bool { return *kvItems.keys[i] >= key0 })
 	if index0 < kvItems.Len() {
 		// Insert keys/values concatenating new ones around key0
-		n.keys = append(make([]*Felt, 0), kvItems.keys[:index0]...)
-		n.values = append(make([]*Felt, 0), kvItems.values[:index0]...)
+		n.keys = appendFelts(make([]Felt, 0), kvItems.keys[:index0]...)
+		n.values = appendFelts(make([]Felt, 0), kvItems.values[:index0]...)
 		n.keys = append(n.keys, key0)
 		n.values = append(n.values, value0)
-		if *kvItems.keys[index0] == *key0 {
+		if *kvItems.keys[index0] == key0 {
 			// Incoming key matches an existing key: update
-			n.keys = append(n.keys, kvItems.keys[index0+1:]...)
-			n.values = append(n.values, kvItems.values[index0+1:]...)
+			n.values[len(n.values)-1] = *kvItems.values[index0]
+			n.keys = appendFelts(n.keys, kvItems.keys[index0+1:]...)
+			n.values = appendFelts(n.values, kvItems.values[index0+1:]...)
 			n.updated = true
 			stats.UpdatedCount++
+			stats.nodeUpdated(n)
 		} else {
-			n.keys = append(n.keys, kvItems.keys[index0:]...)
-			n.values = append(n.values, kvItems.values[index0:]...)
+			n.keys = appendFelts(n.keys, kvItems.keys[index0:]...)
+			n.values = appendFelts(n.values, kvItems.values[index0:]...)
 		}
 	} else {
 		// key0 greater than any input key
-		n.keys = append(kvItems.keys, key0)
-		n.values = append(kvItems.values, value0)
+		n.keys = append(appendFelts(make([]Felt, 0), kvItems.keys...), key0)
+		n.values = append(appendFelts(make([]Felt, 0), kvItems.values...), value0)
 	}
 }
 
@@ -229,55 +391,61 @@ func addOrReplaceLeaf2(n *Node23, kvItems KeyValues, stats *Stats) {
 	ensure(n.keyCount() == 2, "addOrReplaceLeaf2: leaf has not 2 *canonical* keys")
 
 	key0, value0, key1, value1 := n.keys[0], n.values[0], n.keys[1], n.values[1]
-	index0 := sort.Search(kvItems.Len(), func(i int) bool { return *kvItems.keys[i] >= *key0 })
-	index1 := sort.Search(kvItems.Len(), func(i int) bool { return *kvItems.keys[i] >= *key1 })
+	index0 := sort.Search(kvItems.Len(), func(i int) bool { return *kvItems.keys[i] >= key0 })
+	index1 := sort.Search(kvItems.Len(), func(i int) bool { return *kvItems.keys[i] >= key1 })
 	ensure(index1 >= index0, "addOrReplaceLeaf2: keys not ordered")
 	if index0 < kvItems.Len() {
 		if index1 < kvItems.Len() {
 			// Insert keys/values concatenating new ones around key0 and key1
-			n.keys = append(make([]*Felt, 0), kvItems.keys[:index0]...)
-			n.values = append(make([]*Felt, 0), kvItems.values[:index0]...)
+			n.keys = appendFelts(make([]Felt, 0), kvItems.keys[:index0]...)
+			n.values = appendFelts(make([]Felt, 0), kvItems.values[:index0]...)
 			n.keys = append(n.keys, key0)
 			n.values = append(n.values, value0)
-			if *kvItems.keys[index0] == *key0 {
+			if *kvItems.keys[index0] == key0 {
 				// Incoming key matches an existing key: update
-				n.keys = append(n.keys, kvItems.keys[index0+1:index1]...)
-				n.values = append(n.values, kvItems.values[index0+1:index1]...)
+				n.values[len(n.values)-1] = *kvItems.values[index0]
+				n.keys = appendFelts(n.keys, kvItems.keys[index0+1:index1]...)
+				n.values = appendFelts(n.values, kvItems.values[index0+1:index1]...)
 				n.updated = true
 				stats.UpdatedCount++
+				stats.nodeUpdated(n)
 			} else {
-				n.keys = append(n.keys, kvItems.keys[index0:index1]...)
-				n.values = append(n.values, kvItems.values[index0:index1]...)
+				n.keys = appendFelts(n.keys, kvItems.keys[index0:index1]...)
+				n.values = appendFelts(n.values, kvItems.values[index0:index1]...)
 			}
 			n.keys = append(n.keys, key1)
 			n.values = append(n.values, value1)
-			if *kvItems.keys[index1] == *key1 {
+			if *kvItems.keys[index1] == key1 {
 				// Incoming key matches an existing key: update
-				n.keys = append(n.keys, kvItems.keys[index1+1:]...)
-				n.values = append(n.values, kvItems.values[index1+1:]...)
+				n.values[len(n.values)-1] = *kvItems.values[index1]
+				n.keys = appendFelts(n.keys, kvItems.keys[index1+1:]...)
+				n.values = appendFelts(n.values, kvItems.values[index1+1:]...)
 				if !n.updated {
 					n.updated = true
 					stats.UpdatedCount++
+					stats.nodeUpdated(n)
 				}
 			} else {
-				n.keys = append(n.keys, kvItems.keys[index1:]...)
-				n.values = append(n.values, kvItems.values[index1:]...)
+				n.keys = appendFelts(n.keys, kvItems.keys[index1:]...)
+				n.values = appendFelts(n.values, kvItems.values[index1:]...)
 			}
 		} else {
 			// Insert keys/values concatenating new ones around key0, then add key1
-			n.keys = append(make([]*Felt, 0), kvItems.keys[:index0]...)
-			n.values = append(make([]*Felt, 0), kvItems.values[:index0]...)
+			n.keys = appendFelts(make([]Felt, 0), kvItems.keys[:index0]...)
+			n.values = appendFelts(make([]Felt, 0), kvItems.values[:index0]...)
 			n.keys = append(n.keys, key0)
 			n.values = append(n.values, value0)
-			if *kvItems.keys[index0] == *key0 {
+			if *kvItems.keys[index0] == key0 {
 				// Incoming key matches an existing key: update
-				n.keys = append(n.keys, kvItems.keys[index0+1:]...)
-				n.values = append(n.values, kvItems.values[index0+1:]...)
+				n.values[len(n.values)-1] = *kvItems.values[index0]
+				n.keys = appendFelts(n.keys, kvItems.keys[index0+1:]...)
+				n.values = appendFelts(n.values, kvItems.values[index0+1:]...)
 				n.updated = true
 				stats.UpdatedCount++
+				stats.nodeUpdated(n)
 			} else {
-				n.keys = append(n.keys, kvItems.keys[index0:]...)
-				n.values = append(n.values, kvItems.values[index0:]...)
+				n.keys = appendFelts(n.keys, kvItems.keys[index0:]...)
+				n.values = appendFelts(n.values, kvItems.values[index0:]...)
 			}
 			n.keys = append(n.keys, key1)
 			n.values = append(n.values, value1)
@@ -285,8 +453,8 @@ func addOrReplaceLeaf2(n *Node23, kvItems KeyValues, stats *Stats) {
 	} else {
 		ensure(index1 == index0, "addOrReplaceLeaf2: keys not ordered")
 		// Both key0 and key1 greater than any input key
-		n.keys = append(kvItems.keys, key0, key1)
-		n.values = append(kvItems.values, value0, value1)
+		n.keys = append(appendFelts(make([]Felt, 0), kvItems.keys...), key0, key1)
+		n.values = append(appendFelts(make([]Felt, 0), kvItems.values...), value0, value1)
 	}
 }
 
@@ -296,7 +464,7 @@ func splitItems(n *Node23, kvItems KeyValues) []KeyValues {
 
 	itemSubsets := make([]KeyValues, 0)
 	for i, key := range n.keys {
-		splitIndex := sort.Search(kvItems.Len(), func(i int) bool { return *kvItems.keys[i] >= *key })
+		splitIndex := sort.Search(kvItems.Len(), func(i int) bool { return *kvItems.keys[i] >= key })
 		itemSubsets = append(itemSubsets, KeyValues{kvItems.keys[:splitIndex], kvItems.values[:splitIndex]})
 		kvItems = KeyValues{kvItems.keys[splitIndex:], kvItems.values[splitIndex:]}
 		if i == len(n.keys)-1 {
@@ -307,7 +475,7 @@ func splitItems(n *Node23, kvItems KeyValues) []KeyValues {
 	return itemSubsets
 }
 
-func delete(n *Node23, keysToDelete []Felt, stats *Stats) (deleted *Node23, nextKey *Felt, intermediateKeys []*Felt) {
+func delete(n *Node23, keysToDelete []Felt, stats *Stats) (deleted *Node23, nextKey *Felt, intermediateKeys []Felt) {
 	log.Tracef("delete: n=%p keysToDelete=%v\n", n, keysToDelete)
 	ensure(sort.IsSorted(Keys(keysToDelete)), "keysToDelete are not sorted")
 
@@ -321,11 +489,11 @@ func delete(n *Node23, keysToDelete []Felt, stats *Stats) (deleted *Node23, next
 	}
 }
 
-func deleteLeaf(n *Node23, keysToDelete []Felt, stats *Stats) (deleted *Node23, nextKey *Felt, intermediateKeys []*Felt) {
+func deleteLeaf(n *Node23, keysToDelete []Felt, stats *Stats) (deleted *Node23, nextKey *Felt, intermediateKeys []Felt) {
 	ensure(n.isLeaf, fmt.Sprintf("node %s is not leaf", n))
 
 	if len(keysToDelete) == 0 {
-		if n.nextKey() != nil {
+		if n.hasNextKey() {
 			intermediateKeys = append(intermediateKeys, n.nextKey())
 		}
 		return n, nil, intermediateKeys
@@ -335,72 +503,66 @@ func deleteLeaf(n *Node23, keysToDelete []Felt, stats *Stats) (deleted *Node23,
 		n.exposed = true
 		stats.ExposedCount++
 		stats.OpeningHashes += n.howManyHashes()
+		stats.nodeExposed(n)
 	}
 
 	currentFirstKey := n.firstKey()
 	deleteLeafKeys(n, keysToDelete, stats)
 	if n.keyCount() == 1 {
-		return nil, n.nextKey(), intermediateKeys
+		return nil, n.nextKeyOrNil(), intermediateKeys
 	} else {
-		if n.nextKey() != nil {
+		if n.hasNextKey() {
 			intermediateKeys = append(intermediateKeys, n.nextKey())
 		}
-		if n.firstKey() != currentFirstKey {
-			return n, n.firstKey(), intermediateKeys
+		if firstKey := n.firstKey(); firstKey != currentFirstKey {
+			return n, &firstKey, intermediateKeys
 		} else {
 			return n, nil, intermediateKeys
 		}
 	}
 }
 
-func deleteLeafKeys(n *Node23, keysToDelete []Felt, stats *Stats) (deleted KeyValues) {
+func deleteLeafKeys(n *Node23, keysToDelete []Felt, stats *Stats) {
 	ensure(n.isLeaf, "deleteLeafKeys: node is not leaf")
 	switch n.keyCount() {
 	case 2:
-		if Keys(keysToDelete).Contains(*n.keys[0]) {
-			deleted.keys = n.keys[:1]
-			deleted.values = n.values[:1]
+		if Keys(keysToDelete).Contains(n.keys[0]) {
 			n.keys = n.keys[1:]
 			n.values = n.values[1:]
 			stats.DeletedCount++
 		}
 	case 3:
-		if Keys(keysToDelete).Contains(*n.keys[0]) {
-			if Keys(keysToDelete).Contains(*n.keys[1]) {
-				deleted.keys = n.keys[:2]
-				deleted.values = n.values[:2]
+		if Keys(keysToDelete).Contains(n.keys[0]) {
+			if Keys(keysToDelete).Contains(n.keys[1]) {
 				n.keys = n.keys[2:]
 				n.values = n.values[2:]
 				stats.DeletedCount++
 			} else {
-				deleted.keys = n.keys[:1]
-				deleted.values = n.values[:1]
 				n.keys = n.keys[1:]
 				n.values = n.values[1:]
 				n.updated = true
 				stats.UpdatedCount++
+				stats.nodeUpdated(n)
 			}
 		} else {
-			if Keys(keysToDelete).Contains(*n.keys[1]) {
-				deleted.keys = n.keys[1:2]
-				deleted.values = n.values[1:2]
+			if Keys(keysToDelete).Contains(n.keys[1]) {
 				n.keys = append(n.keys[:1], n.keys[2])
 				n.values = append(n.values[:1], n.values[2])
 				n.updated = true
 				stats.UpdatedCount++
+				stats.nodeUpdated(n)
 			}
 		}
 	default:
 		ensure(false, fmt.Sprintf("unexpected number of keys in %s", n))
 	}
-	return deleted
 }
 
-func deleteInternal(n *Node23, keysToDelete []Felt, stats *Stats) (deleted *Node23, nextKey *Felt, intermediateKeys []*Felt) {
+func deleteInternal(n *Node23, keysToDelete []Felt, stats *Stats) (deleted *Node23, nextKey *Felt, intermediateKeys []Felt) {
 	ensure(!n.isLeaf, fmt.Sprintf("node %s is not internal", n))
 
 	if len(keysToDelete) == 0 {
-		if n.lastLeaf().nextKey() != nil {
+		if n.lastLeaf().hasNextKey() {
 			intermediateKeys = append(intermediateKeys, n.lastLeaf().nextKey())
 		}
 		return n, nil, intermediateKeys
@@ -410,80 +572,141 @@ func deleteInternal(n *Node23, keysToDelete []Felt, stats *Stats) (deleted *Node
 		n.exposed = true
 		stats.ExposedCount++
 		stats.OpeningHashes += n.howManyHashes()
+		stats.nodeExposed(n)
 	}
 
 	keySubsets := splitKeys(n, keysToDelete)
+	return deleteChildren(n, func(i int) (*Node23, *Felt, []Felt) {
+		return delete(n.children[i], keySubsets[i], stats)
+	}, stats)
+}
 
-	newKeys := make([]*Felt, 0)
-	for i := len(n.children) - 1; i >= 0; i-- {
-		child, childNextKey, childIntermediateKeys := delete(n.children[i], keySubsets[i], stats)
-		newKeys = append(childIntermediateKeys, newKeys...)
+// deleteChildren applies deleteChild to the children of n from last to first, then fixes next keys, merges
+// underflowing children and updates the keys of n. All children are processed before any merge, so that no
+// child can be moved to a sibling before its own keys have been deleted.
+func deleteChildren(n *Node23, deleteChild func(i int) (*Node23, *Felt, []Felt), stats *Stats) (deleted *Node23, nextKey *Felt, intermediateKeys []Felt) {
+	firstKey := n.firstLeaf().firstKey()
+	childNextKeys := make([]*Felt, n.childrenCount())
+	for i := n.childrenCount() - 1; i >= 0; i-- {
+		stats.depth++
+		child, childNextKey, _ := deleteChild(i)
+		stats.depth--
 		log.Tracef("delete: n=%s child=%s childNextKey=%s\n", n, child, pointerValue(childNextKey))
-		if i > 0 {
-			previousIndex := i - 1
-			previousChild := n.children[previousIndex]
-			for previousChild.isEmpty() && previousIndex - 1 >= 0 {
-				previousChild = n.children[previousIndex - 1]
-				previousIndex = previousIndex - 1
-			}
-			if child == nil || childNextKey != nil {
-				if previousChild.isLeaf {
-					ensure(len(previousChild.keys) > 0, "delete: previousChild has no keys")
-					if previousChild.nextKey() != childNextKey {
-						previousChild.setNextKey(childNextKey, stats)
-					}
-				} else {
-					ensure(len(previousChild.children) > 0, "delete: previousChild has no children")
-					lastLeaf := previousChild.lastLeaf()
-					if lastLeaf.nextKey() != childNextKey {
-						lastLeaf.setNextKey(childNextKey, stats)
-					}
-				}
-			}
-			if !previousChild.isEmpty() && child != nil && child.childrenCount() == 1 {
-				child.keys = child.keys[:0]
-				newLeft, newRight := mergeRight2Left(previousChild, child, stats)
-				n.children = append(n.children[:previousIndex], append([]*Node23{newLeft, newRight}, n.children[i + 1:]...)...)
-			}
-		} else {
-			nextIndex := i + 1
-			nextChild := n.children[nextIndex]
-			for nextChild.isEmpty() && nextIndex + 1 < n.childrenCount() {
-				nextChild = n.children[nextIndex + 1]
-				nextIndex = nextIndex + 1
-			}
-			if !nextChild.isEmpty() && child != nil && child.childrenCount() == 1 {
-				child.keys = child.keys[:0]
-				newLeft, newRight := mergeLeft2Right(child, nextChild, stats)
-				n.children = append([]*Node23{newLeft, newRight}, n.children[nextIndex + 1:]...)
+		childNextKeys[i] = childNextKey
+	}
+
+	// Link the last leaf of each remaining child to the first key of the following one
+	var followingKey *Felt
+	hasFollowingKey := false
+	children := make([]*Node23, 0, n.childrenCount())
+	for i := n.childrenCount() - 1; i >= 0; i-- {
+		child := n.children[i]
+		if child.isEmpty() {
+			if !hasFollowingKey {
+				followingKey, hasFollowingKey = childNextKeys[i], true
 			}
-			if childNextKey != nil {
-				nextKey = childNextKey
+			continue
+		}
+		if hasFollowingKey {
+			if lastLeaf := child.lastLeaf(); !lastLeaf.nextKeyIs(followingKey) {
+				lastLeaf.setNextKey(followingKey, stats)
 			}
 		}
+		childFirstKey := child.firstLeaf().firstKey()
+		followingKey, hasFollowingKey = &childFirstKey, true
+		children = append([]*Node23{child}, children...)
 	}
-	switch len(n.children) {
-	case 2:
-		nextKey, intermediateKeys = update2Node(n, newKeys, nextKey, intermediateKeys, stats)
-	case 3:
-		nextKey, intermediateKeys = update3Node(n, newKeys, nextKey, intermediateKeys, stats)
-	default:
-		ensure(false, fmt.Sprintf("unexpected number of children in %s", n))
+
+	n.children = mergeUnderflowingChildren(children, stats)
+
+	if n.isEmpty() {
+		n.keys = n.keys[:0]
+		return nil, followingKey, []Felt{}
+	}
+	// Separators and the key following n come from the leaf chain, whatever merges happened below
+	if n.childrenCount() > 1 {
+		n.updateSeparators()
+	} else {
+		n.keys = n.keys[:0]
+	}
+	for _, child := range n.children {
+		if !child.isLeaf && child.childrenCount() > 1 {
+			child.updateSeparators()
+		}
+	}
+	intermediateKeys = []Felt{}
+	if lastLeaf := n.lastLeaf(); lastLeaf.hasNextKey() {
+		intermediateKeys = append(intermediateKeys, lastLeaf.nextKey())
+	}
+	if newFirstKey := n.firstLeaf().firstKey(); newFirstKey != firstKey {
+		nextKey = &newFirstKey
 	}
 
 	for _, child := range n.children {
 		if child.updated {
 			n.updated = true
 			stats.UpdatedCount++
+			stats.nodeUpdated(n)
 			break
 		}
 	}
+	return n, nextKey, intermediateKeys
+}
 
-	if n.keyCount() == 0 {
-		return nil, nextKey, intermediateKeys
-	} else {
-		return n, nextKey, intermediateKeys
+// mergeUnderflowingChildren merges each underflowing child, having one child, with its previous sibling or, for
+// the first one, with the next sibling. It returns the non-empty children left.
+func mergeUnderflowingChildren(children []*Node23, stats *Stats) []*Node23 {
+	for i := len(children) - 1; i >= 0 && len(children) > 1; i-- {
+		child := children[i]
+		if child.isLeaf || child.childrenCount() != 1 {
+			continue
+		}
+		child.keys = child.keys[:0]
+		stats.depth++
+		if i > 0 && !children[i-1].isLeaf && children[i-1].childrenCount() == 1 {
+			children[i-1], children[i] = mergeUnderflowing(children[i-1], child, stats)
+		} else if i > 0 {
+			children[i-1], children[i] = mergeRight2Left(children[i-1], child, stats)
+		} else {
+			children[i], children[i+1] = mergeLeft2Right(child, children[i+1], stats)
+		}
+		stats.depth--
+		children = nonEmpty(children)
+	}
+	return nonEmpty(children)
+}
+
+func deleteRange(n *Node23, from, to Felt, stats *Stats) (deleted *Node23, nextKey *Felt, intermediateKeys []Felt) {
+	log.Tracef("deleteRange: n=%p from=%d to=%d\n", n, from, to)
+	if n == nil {
+		return n, nil, intermediateKeys
 	}
+	if n.isLeaf {
+		return deleteLeaf(n, n.keysInRange(from, to), stats)
+	}
+
+	if !n.exposed {
+		n.exposed = true
+		stats.ExposedCount++
+		stats.OpeningHashes += n.howManyHashes()
+		stats.nodeExposed(n)
+	}
+
+	return deleteChildren(n, func(i int) (*Node23, *Felt, []Felt) {
+		child := n.children[i]
+		firstKey, lastKey := child.firstLeaf().firstKey(), child.lastKey()
+		if lastKey < from || firstKey > to {
+			return delete(child, []Felt{}, stats)
+		}
+		if child.isLeaf || firstKey < from || lastKey > to {
+			return deleteRange(child, from, to, stats)
+		}
+		// Child subtree fully inside range: replace it with an empty node, as if all its leaves were deleted
+		nextKey := child.lastLeaf().nextKeyOrNil()
+		stats.DeletedCount += uint(child.leaves)
+		n.children[i] = makeInternalNode(make([]*Node23, 0), make([]Felt, 0), &Stats{}) // do not count it into stats
+		return nil, nextKey, []Felt{}
+	}, stats)
 }
 
 func mergeLeft2Right(left, right *Node23, stats *Stats) (newLeft, newRight *Node23) {
@@ -491,7 +714,9 @@ func mergeLeft2Right(left, right *Node23, stats *Stats) (newLeft, newRight *Node
 	ensure(left.childrenCount() > 0, "mergeLeft2Right: left has no children")
 
 	if left.firstChild().childrenCount() == 1 {
+		stats.depth++
 		newLeftFirstChild, newRightFirstChild := mergeLeft2Right(left.firstChild(), right.firstChild(), stats)
+		stats.depth--
 		left = makeInternalNode(
 			[]*Node23{newLeftFirstChild},
 			left.keys,
@@ -509,11 +734,11 @@ func mergeLeft2Right(left, right *Node23, stats *Stats) (newLeft, newRight *Node
 			if right.childrenCount() == 1 {
 				if right.firstChild().isEmpty() {
 					newLeft = left
-					newRight = makeInternalNode([]*Node23{}, []*Felt{}, stats)
+					newRight = makeInternalNode([]*Node23{}, []Felt{}, stats)
 				} else {
 					newRight = makeInternalNode(
 						append([]*Node23{left.firstChild()}, right.children...),
-						[]*Felt{left.lastLeaf().nextKey()},
+						[]Felt{left.lastLeaf().nextKey()},
 						stats,
 					)
 					if left.keyCount() > 1 {
@@ -525,7 +750,7 @@ func mergeLeft2Right(left, right *Node23, stats *Stats) (newLeft, newRight *Node
 			} else {
 				newRight = makeInternalNode(
 					append([]*Node23{left.firstChild()}, right.children...),
-					append([]*Felt{left.lastLeaf().nextKey()}, right.keys...),
+					append([]Felt{left.lastLeaf().nextKey()}, right.keys...),
 					stats,
 				)
 				if left.keyCount() > 1 {
@@ -536,11 +761,12 @@ func mergeLeft2Right(left, right *Node23, stats *Stats) (newLeft, newRight *Node
 			}
 		} else {
 			newRight = right
-			newLeft = makeInternalNode([]*Node23{}, []*Felt{}, stats)
+			newLeft = makeInternalNode([]*Node23{}, []Felt{}, stats)
 		}
 	} else {
-		newLeft, newRight = mergeRight2Left(left, right, stats)
+		return mergeRight2Left(left, right, stats)
 	}
+	stats.nodesMerged(newLeft, newRight)
 	return newLeft, newRight
 }
 
@@ -549,7 +775,9 @@ func mergeRight2Left(left, right *Node23, stats *Stats) (newLeft, newRight *Node
 	ensure(right.childrenCount() > 0, "mergeRight2Left: right has no children")
 
 	if right.firstChild().childrenCount() == 1 {
+		stats.depth++
 		newLeftLastChild, newRightFirstChild := mergeRight2Left(left.lastChild(), right.firstChild(), stats)
+		stats.depth--
 		left = makeInternalNode(
 			append(left.children[:len(left.children)-1], newLeftLastChild),
 			left.keys,
@@ -566,12 +794,12 @@ func mergeRight2Left(left, right *Node23, stats *Stats) (newLeft, newRight *Node
 		if !right.firstChild().isEmpty() {
 			if left.childrenCount() == 1 {
 				if left.firstChild().isEmpty() {
-					newLeft = makeInternalNode([]*Node23{}, []*Felt{}, stats)
+					newLeft = makeInternalNode([]*Node23{}, []Felt{}, stats)
 					newRight = right
 				} else {
 					newLeft = makeInternalNode(
 						append(left.children, right.firstChild()),
-						[]*Felt{right.firstLeaf().firstKey()},
+						[]Felt{right.firstLeaf().firstKey()},
 						stats,
 					)
 					if right.keyCount() > 1 {
@@ -594,22 +822,69 @@ func mergeRight2Left(left, right *Node23, stats *Stats) (newLeft, newRight *Node
 			}
 		} else {
 			newLeft = left
-			newRight = makeInternalNode([]*Node23{}, []*Felt{}, stats)
+			newRight = makeInternalNode([]*Node23{}, []Felt{}, stats)
 		}
 	} else {
-		newLeft, newRight = mergeLeft2Right(left, right, stats)
+		if !right.firstChild().isEmpty() {
+			// Left is full: move its last child to right
+			newRight = makeInternalNode(
+				append([]*Node23{left.lastChild()}, right.children...),
+				append([]Felt{left.lastLeaf().nextKey()}, right.keys...),
+				stats,
+			)
+			newLeft = makeInternalNode(left.children[:2], left.keys[:1], stats)
+		} else {
+			newLeft = left
+			newRight = makeInternalNode([]*Node23{}, []Felt{}, stats)
+		}
 	}
+	stats.nodesMerged(newLeft, newRight)
+	return newLeft, newRight
+}
+
+// mergeUnderflowing joins two adjacent nodes having one child each, merging their children in turn when any of
+// them is underflowing too.
+func mergeUnderflowing(left, right *Node23, stats *Stats) (newLeft, newRight *Node23) {
+	leftChild, rightChild := left.firstChild(), right.firstChild()
+	if !leftChild.isLeaf {
+		stats.depth++
+		switch {
+		case leftChild.childrenCount() == 1 && rightChild.childrenCount() == 1:
+			leftChild, rightChild = mergeUnderflowing(leftChild, rightChild, stats)
+		case leftChild.childrenCount() == 1:
+			leftChild, rightChild = mergeLeft2Right(leftChild, rightChild, stats)
+		case rightChild.childrenCount() == 1:
+			leftChild, rightChild = mergeRight2Left(leftChild, rightChild, stats)
+		}
+		stats.depth--
+	}
+	newLeft = makeInternalNode(nonEmpty([]*Node23{leftChild, rightChild}), []Felt{}, stats)
+	if newLeft.childrenCount() > 1 {
+		newLeft.updateSeparators()
+	}
+	newRight = makeInternalNode([]*Node23{}, []Felt{}, stats)
+	stats.nodesMerged(newLeft, newRight)
 	return newLeft, newRight
 }
 
+func nonEmpty(nodes []*Node23) []*Node23 {
+	nonEmptyNodes := make([]*Node23, 0, len(nodes))
+	for _, node := range nodes {
+		if !node.isEmpty() {
+			nonEmptyNodes = append(nonEmptyNodes, node)
+		}
+	}
+	return nonEmptyNodes
+}
+
 func splitKeys(n *Node23, keysToDelete []Felt) [][]Felt {
 	ensure(!n.isLeaf, "splitKeys: node is not internal")
 	ensure(len(n.keys) > 0, fmt.Sprintf("splitKeys: internal node %s has no keys", n))
 
 	keySubsets := make([][]Felt, 0)
 	for i, key := range n.keys {
-		splitIndex := sort.Search(len(keysToDelete), func(i int) bool { return keysToDelete[i] >= *key })
-		log.Tracef("splitKeys: key=%d-(%p) splitIndex=%d\n", *key, key, splitIndex)
+		splitIndex := sort.Search(len(keysToDelete), func(i int) bool { return keysToDelete[i] >= key })
+		log.Tracef("splitKeys: key=%d splitIndex=%d\n", key, splitIndex)
 		keySubsets = append(keySubsets, keysToDelete[:splitIndex])
 		keysToDelete = keysToDelete[splitIndex:]
 		if i == len(n.keys)-1 {
@@ -620,155 +895,7 @@ func splitKeys(n *Node23, keysToDelete []Felt) [][]Felt {
 	return keySubsets
 }
 
-func update2Node(n *Node23, newKeys []*Felt, nextKey *Felt, intermediateKeys []*Felt, stats *Stats) (*Felt, []*Felt) {
-	ensure(len(n.children) == 2, "update2Node: wrong number of children")
-
-	switch len(newKeys) {
-	case 0:
-		break
-	case 1:
-		n.keys = newKeys
-	case 2:
-		n.keys = newKeys[:1]
-		intermediateKeys = append(intermediateKeys, newKeys[1])
-	default:
-		ensure(false, fmt.Sprintf("update2Node: wrong number of newKeys=%d", len(newKeys)))
-	}
-	nodeA, nodeC := n.children[0], n.children[1]
-	if nodeA.isEmpty() {
-		if nodeC.isEmpty() {
-			/* A is empty, a_next is the "next key"; C is empty, c_next is the "next key" */
-			n.children = n.children[:0]
-			n.keys = n.keys[:0]
-			if nodeC.isLeaf {
-				return nodeC.nextKey(), intermediateKeys
-			}
-			return nextKey, intermediateKeys
-		} else {
-			/* A is empty, a_next is the "next key"; C is not empty */
-			n.children = n.children[1:]
-			/// n.keys = []*Felt{nodeC.lastLeaf().nextKey()}
-			if nodeA.isLeaf {
-				return nodeA.nextKey(), intermediateKeys
-			}
-			return nextKey, intermediateKeys
-		}
-	} else {
-		if nodeC.isEmpty() {
-			/* A is not empty; C is empty, c_next is the "next key" */
-			n.children = n.children[:1]
-			/// n.keys = []*Felt{nodeA.lastLeaf().nextKey()}
-			if nodeC.isLeaf {
-				nodeA.setNextKey(nodeC.nextKey(), stats)
-			}
-			return nextKey, intermediateKeys
-		} else {
-			/* A is not empty; C is not empty */
-			n.keys = []*Felt{nodeA.lastLeaf().nextKey()}
-			return nextKey, intermediateKeys
-		}
-	}
-}
-
-func update3Node(n *Node23, newKeys []*Felt, nextKey *Felt, intermediateKeys []*Felt, stats *Stats) (*Felt, []*Felt) {
-	ensure(len(n.children) == 3, "update3Node: wrong number of children")
-
-	switch len(newKeys) {
-	case 0:
-		break
-	case 1:
-		n.keys = newKeys
-	case 2:
-		n.keys = newKeys
-	case 3:
-		n.keys = newKeys[:2]
-		intermediateKeys = append(intermediateKeys, newKeys[2])
-	default:
-		ensure(false, fmt.Sprintf("update3Node: wrong number of newKeys=%d", len(newKeys)))
-	}
-	nodeA, nodeB, nodeC := n.children[0], n.children[1], n.children[2]
-	if nodeA.isEmpty() {
-		if nodeB.isEmpty() {
-			if nodeC.isEmpty() {
-				/* A is empty, a_next is the "next key"; B is empty, b_next is the "next key"; C is empty, c_next is the "next key" */
-				n.children = n.children[:0]
-				n.keys = n.keys[:0]
-				if nodeA.isLeaf {
-					return nodeC.nextKey(), intermediateKeys
-				}
-				return nextKey, intermediateKeys
-			} else {
-				/* A is empty, a_next is the "next key"; B is empty, b_next is the "next key"; C is not empty */
-				n.children = n.children[2:]
-				/// n.keys = []*Felt{nodeC.lastLeaf().nextKey()}
-				if nodeA.isLeaf {
-					return nodeB.nextKey(), intermediateKeys
-				}
-				return nextKey, intermediateKeys
-			}
-		} else {
-			if nodeC.isEmpty() {
-				/* A is empty, a_next is the "next key"; B is not empty; C is empty, c_next is the "next key" */
-				n.children = n.children[1:2]
-				/// n.keys = []*Felt{nodeB.lastLeaf().nextKey()}
-				if nodeA.isLeaf {
-					nodeB.setNextKey(nodeC.nextKey(), stats)
-					return nodeA.nextKey(), intermediateKeys
-				}
-				return nextKey, intermediateKeys
-			} else {
-				/* A is empty, a_next is the "next key"; B is not empty; C is not empty */
-				n.children = n.children[1:]
-				if nodeA.isLeaf {
-					n.keys = []*Felt{nodeB.nextKey()}
-					return nodeA.nextKey(), intermediateKeys
-				}
-				n.keys = []*Felt{nodeB.lastLeaf().nextKey()}
-				return nextKey, intermediateKeys
-			}
-		}
-	} else {
-		if nodeB.isEmpty() {
-			if nodeC.isEmpty() {
-				/* A is not empty; B is empty, b_next is the "next key"; C is empty, c_next is the "next key" */
-				n.children = n.children[:1]
-				if nodeA.isLeaf {
-					nodeA.setNextKey(nodeC.nextKey(), stats)
-				}
-				/// n.keys = []*Felt{nodeA.lastLeaf().nextKey()}
-				return nextKey, intermediateKeys
-			} else {
-				/* A is not empty; B is empty, b_next is the "next key"; C is not empty */
-				n.children = append(n.children[:1], n.children[2])
-				if nodeA.isLeaf {
-					n.keys = []*Felt{nodeB.nextKey()}
-					nodeA.setNextKey(nodeB.nextKey(), stats)
-				} else {
-					n.keys = []*Felt{nodeA.lastLeaf().nextKey()}
-				}
-				return nextKey, intermediateKeys
-			}
-		} else {
-			if nodeC.isEmpty() {
-				/* A is not empty; B is not empty; C is empty, c_next is the "next key" */
-				n.children = n.children[:2]
-				if nodeA.isLeaf {
-					n.keys = []*Felt{nodeA.nextKey()}
-					nodeB.setNextKey(nodeC.nextKey(), stats)
-				} else {
-					n.keys = []*Felt{nodeA.lastLeaf().nextKey()}
-				}
-				return nextKey, intermediateKeys
-			} else {
-				/* A is not empty; B is not empty; C is not empty */
-				///n.keys = []*Felt{nodeA.lastLeaf().nextKey(), nodeB.lastLeaf().nextKey()}
-				return nextKey, intermediateKeys
-			}
-		}
-	}
-}
-
-func demote(node *Node23, nextKey *Felt, intermediateKeys []*Felt, stats *Stats) (*Node23, *Felt) {
+func demote(node *Node23, nextKey *Felt, intermediateKeys []Felt, stats *Stats) (*Node23, *Felt) {
 	if node == nil {
 		return nil, nextKey
 	} else if len(node.children) == 0 {
@@ -778,23 +905,37 @@ func demote(node *Node23, nextKey *Felt, intermediateKeys []*Felt, stats *Stats)
 			return node, nextKey
 		}
 	} else if len(node.children) == 1 {
-		return demote(node.children[0], nextKey, intermediateKeys, stats)
+		stats.depth++
+		demoted, nextKey := demote(node.children[0], nextKey, intermediateKeys, stats)
+		if demoted != nil && demoted == node.children[0] {
+			stats.demote(demoted)
+		}
+		stats.depth--
+		return demoted, nextKey
 	} else if len(node.children) == 2 {
 		firstChild, secondChild := node.children[0], node.children[1]
 		if firstChild.keyCount() == 0 && secondChild.keyCount() == 0 {
 			return nil, nextKey
 		}
 		if firstChild.keyCount() == 0 && secondChild.keyCount() > 0 {
+			stats.depth++
+			stats.demote(secondChild)
+			stats.depth--
 			return secondChild, nextKey
 		}
 		if firstChild.keyCount() > 0 && secondChild.keyCount() == 0 {
+			stats.depth++
+			stats.demote(firstChild)
+			stats.depth--
 			return firstChild, nextKey
 		}
 		if firstChild.keyCount() == 2 && secondChild.keyCount() == 2 {
 			if firstChild.isLeaf {
-				keys := []*Felt{firstChild.firstKey(), secondChild.firstKey(), secondChild.nextKey()}
-				values := []*Felt{firstChild.firstValue(), secondChild.firstValue(), secondChild.nextValue()}
-				return makeLeafNode(keys, values, stats), nextKey
+				keys := []Felt{firstChild.firstKey(), secondChild.firstKey(), secondChild.nextKey()}
+				values := []Felt{firstChild.firstValue(), secondChild.firstValue(), secondChild.nextValue()}
+				leaf := makeLeafNode(keys, values, secondChild.noNextKey, stats)
+				stats.demote(leaf)
+				return leaf, nextKey
 			}
 		}
 	}
@@ -16,24 +16,20 @@ type MergeTest struct {
 	final	*Node23
 }
 
-func K2K(keys []Felt) []*Felt {
-	kv := KV(keys, keys)
-	return kv.keys
+func K2K(keys []Felt) []Felt {
+	return append(make([]Felt, 0, len(keys)), keys...)
 }
 
-func K2KV(keys []Felt) ([]*Felt, []*Felt) {
-	values := make([]Felt, len(keys))
-	copy(values, keys)
-	kv := KV(keys, values)
-	return kv.keys, kv.values
+func K2KV(keys []Felt) ([]Felt, []Felt) {
+	return K2K(keys), K2K(keys)
 }
 
-func newInternalNode(children []*Node23, keys []*Felt) *Node23 {
+func newInternalNode(children []*Node23, keys []Felt) *Node23 {
 	return makeInternalNode(children, keys, &Stats{})
 }
 
-func newLeafNode(keys, values []*Felt) *Node23 {
-	return makeLeafNode(keys, values, &Stats{})
+func newLeafNode(keys, values []Felt) *Node23 {
+	return makeLeafNode(keys, values, false, &Stats{})
 }
 
 var mergeLeft2RightTestTable = []MergeTest {
@@ -0,0 +1,109 @@
+package cairo_bptree
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// randomChunks shuffles keys and splits them in random sized chunks.
+func randomChunks(r *rand.Rand, keys []Felt) [][]Felt {
+	shuffled := append(make([]Felt, 0, len(keys)), keys...)
+	r.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	chunks := make([][]Felt, 0)
+	for len(shuffled) > 0 {
+		size := 1 + r.Intn(len(shuffled))
+		chunk := shuffled[:size]
+		sort.Slice(chunk, func(i, j int) bool { return chunk[i] < chunk[j] })
+		chunks, shuffled = append(chunks, chunk), shuffled[size:]
+	}
+	return chunks
+}
+
+func TestCanonicalTreeIsHistoryIndependent(t *testing.T) {
+	r := rand.New(rand.NewSource(28))
+	for i := 0; i < 200; i++ {
+		keys, extraKeys := make([]Felt, 0), make([]Felt, 0)
+		for _, key := range r.Perm(256)[:r.Intn(128)] {
+			if r.Intn(3) == 0 {
+				extraKeys = append(extraKeys, Felt(key))
+			} else {
+				keys = append(keys, Felt(key))
+			}
+		}
+		expected := NewCanonicalTree23(K(sortedKeys(keys)))
+		ensureValid := func(tree *Tree23, history string) {
+			valid, err := tree.IsValid()
+			require.True(t, valid, "iteration %d %s: invalid tree: %v", i, history, err)
+			assert.Equal(t, expected.RootHash(), tree.RootHash(), "iteration %d %s: different root hash", i, history)
+		}
+
+		upserted := NewCanonicalTree23(KeyValues{})
+		for _, chunk := range randomChunks(r, keys) {
+			upserted.Upsert(K(chunk))
+		}
+		ensureValid(upserted, "upserts only")
+
+		deleted := NewCanonicalTree23(K(sortedKeys(append(append(make([]Felt, 0), keys...), extraKeys...))))
+		for _, chunk := range randomChunks(r, extraKeys) {
+			deleted.Delete(chunk)
+		}
+		ensureValid(deleted, "deletes only")
+
+		mixed := NewCanonicalTree23(KeyValues{})
+		extraChunks := randomChunks(r, extraKeys)
+		for _, chunk := range randomChunks(r, keys) {
+			mixed.Upsert(K(chunk))
+			if len(extraChunks) > 0 && r.Intn(2) == 0 {
+				mixed.Apply(Batch{Upserts: K(extraChunks[0]), Deletes: extraChunks[0]})
+				extraChunks = extraChunks[1:]
+			}
+		}
+		for _, chunk := range extraChunks {
+			mixed.Upsert(K(chunk))
+			mixed.Delete(chunk)
+		}
+		ensureValid(mixed, "mixed")
+	}
+}
+
+func TestNonCanonicalTreeIsHistoryDependent(t *testing.T) {
+	keys := []Felt{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	oneShot, stepwise := NewTree23(K(keys)), NewEmptyTree23()
+	for i := len(keys) - 1; i >= 0; i-- {
+		stepwise.Upsert(K(keys[i : i+1]))
+	}
+	assert.NotEqual(t, oneShot.RootHash(), stepwise.RootHash(), "same root hash from different histories")
+
+	canonical := NewCanonicalTree23(KeyValues{})
+	for i := len(keys) - 1; i >= 0; i-- {
+		canonical.Upsert(K(keys[i : i+1]))
+	}
+	assert.True(t, canonical.IsCanonical())
+	assert.Equal(t, oneShot.RootHash(), canonical.RootHash(), "canonical tree differs from one-shot tree")
+}
+
+func TestCanonicalTreeRefusesWitnessesAndProofs(t *testing.T) {
+	tree := NewCanonicalTree23(K([]Felt{1, 3, 5, 7, 9}))
+	rootHash := tree.RootHash()
+	_, _, err := tree.UpsertWithWitness(K([]Felt{4}), &Stats{})
+	assert.Error(t, err, "witness of upsert on canonical tree")
+	_, _, err = tree.DeleteWithWitness([]Felt{3}, &Stats{})
+	assert.Error(t, err, "witness of delete on canonical tree")
+	_, err = tree.MultiProof(Batch{Upserts: K([]Felt{4})})
+	assert.Error(t, err, "proof on canonical tree")
+	assert.Equal(t, rootHash, tree.RootHash(), "canonical tree changed")
+}
+
+func TestCanonicalTreeStatsCountRepackedTree(t *testing.T) {
+	tree := NewCanonicalTree23(K([]Felt{1, 3, 5, 7, 9, 11, 13, 15}))
+	upsertStats := &Stats{}
+	tree.UpsertWithStats(K([]Felt{4}), upsertStats)
+	assert.Equal(t, uint(tree.Size()), upsertStats.RehashedCount, "upsert")
+	deleteStats := &Stats{}
+	tree.DeleteWithStats([]Felt{4}, deleteStats)
+	assert.Equal(t, uint(tree.Size()), deleteStats.RehashedCount, "delete")
+}
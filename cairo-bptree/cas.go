@@ -0,0 +1,38 @@
+package cairo_bptree
+
+import "fmt"
+
+// Expected is a pair read by a transaction: nil Value means the key was absent.
+type Expected struct {
+	Key   Felt
+	Value *Felt
+}
+
+// ConflictError lists the expected keys whose current value is different.
+type ConflictError struct {
+	Keys []Felt
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("compare-and-swap conflict on keys %v", e.Keys)
+}
+
+// CompareAndSwap applies updates only if every expected pair matches the tree, otherwise it returns
+// a *ConflictError leaving the tree unchanged.
+func (t *Tree23) CompareAndSwap(expected []Expected, updates Batch) (*Tree23, error) {
+	return t.CompareAndSwapWithStats(expected, updates, &Stats{}, &Stats{})
+}
+
+func (t *Tree23) CompareAndSwapWithStats(expected []Expected, updates Batch, upsertStats, deleteStats *Stats) (*Tree23, error) {
+	conflicts := make([]Felt, 0)
+	for _, pair := range expected {
+		value, found := t.Get(pair.Key)
+		if found != (pair.Value != nil) || found && value != *pair.Value {
+			conflicts = append(conflicts, pair.Key)
+		}
+	}
+	if len(conflicts) > 0 {
+		return t, &ConflictError{Keys: sortedKeys(conflicts)}
+	}
+	return t.ApplyWithStats(updates, upsertStats, deleteStats), nil
+}
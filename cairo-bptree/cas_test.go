@@ -0,0 +1,57 @@
+package cairo_bptree
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func feltPointer(value Felt) *Felt {
+	return &value
+}
+
+func TestGet(t *testing.T) {
+	tree := NewTree23(KV([]Felt{2, 4, 6, 8, 10, 12, 14}, []Felt{20, 40, 60, 80, 100, 120, 140}))
+	for _, key := range []Felt{2, 4, 6, 8, 10, 12, 14} {
+		value, found := tree.Get(key)
+		assert.True(t, found, "key %d not found", key)
+		assert.Equal(t, key*10, value, "different value of key %d", key)
+	}
+	for _, key := range []Felt{0, 1, 7, 15} {
+		_, found := tree.Get(key)
+		assert.False(t, found, "missing key %d found", key)
+	}
+	_, found := NewEmptyTree23().Get(1)
+	assert.False(t, found)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	tree := NewTree23(KV([]Felt{1, 2, 3}, []Felt{10, 20, 30}))
+	updates := Batch{Upserts: KV([]Felt{2, 4}, []Felt{21, 40}), Deletes: []Felt{1}}
+	stats := &Stats{}
+	_, err := tree.CompareAndSwapWithStats(
+		[]Expected{{1, feltPointer(10)}, {2, feltPointer(20)}, {4, nil}},
+		updates,
+		stats,
+		&Stats{},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []Felt{2, 3, 4}, tree.KeyValues().Keys())
+	assert.Equal(t, []Felt{21, 30, 40}, tree.KeyValues().Values())
+	assert.Greater(t, stats.ExposedCount, uint(0), "updates not applied with stats")
+}
+
+func TestCompareAndSwapConflict(t *testing.T) {
+	tree := NewTree23(KV([]Felt{1, 2, 3}, []Felt{10, 20, 30}))
+	rootHash := tree.RootHash()
+	_, err := tree.CompareAndSwap(
+		[]Expected{{3, feltPointer(31)}, {1, feltPointer(10)}, {2, nil}, {5, feltPointer(50)}},
+		Batch{Upserts: KV([]Felt{1}, []Felt{11}), Deletes: []Felt{3}},
+	)
+	var conflict *ConflictError
+	require.True(t, errors.As(err, &conflict), "no conflict error: %v", err)
+	assert.Equal(t, []Felt{2, 3, 5}, conflict.Keys, "different conflicting keys")
+	assert.Equal(t, rootHash, tree.RootHash(), "tree changed after conflict")
+}
@@ -0,0 +1,49 @@
+package cairo_bptree
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteRangeAsDelete(t *testing.T) {
+	repeatRandom(35, 1000, func(r *rand.Rand, i int) {
+		kvItems := randomTreeItems(r)
+		from, to := Felt(r.Intn(256)), Felt(r.Intn(256))
+		if from > to {
+			from, to = to, from
+		}
+		keysInRange := make([]Felt, 0)
+		for _, key := range kvItems.Keys() {
+			if key >= from && key <= to {
+				keysInRange = append(keysInRange, key)
+			}
+		}
+		expected, tree := NewTree23(kvItems.clone()), NewTree23(kvItems.clone())
+		expected.Delete(keysInRange)
+		tree.DeleteRange(from, to)
+		requireValidKeys(t, tree, expected.WalkKeysPostOrder(), "iteration %d range [%d, %d]: different keys", i, from, to)
+		require.Equal(t, expected.RootHash(), tree.RootHash(), "iteration %d range [%d, %d]: different root hash", i, from, to)
+	})
+}
+
+func TestDeleteRangeSkipsCoveredSubtrees(t *testing.T) {
+	keys := make([]Felt, 0)
+	for key := Felt(0); key < 100; key++ {
+		keys = append(keys, key)
+	}
+	keysStats, rangeStats := &Stats{}, &Stats{}
+	NewTree23(K(keys)).DeleteWithStats(keys[10:90], keysStats)
+	tree := NewTree23(K(keys)).DeleteRangeWithStats(10, 89, rangeStats)
+	assert.Equal(t, 20, tree.Len())
+	assert.Less(t, rangeStats.ExposedCount, keysStats.ExposedCount, "covered subtrees exposed")
+	assert.Equal(t, keysStats.DeletedCount, rangeStats.DeletedCount, "different deleted count")
+
+	unchanged := NewTree23(K(keys))
+	rootHash := unchanged.RootHash()
+	unchanged.DeleteRangeWithStats(200, 300, rangeStats)
+	unchanged.DeleteRange(50, 40)
+	assert.Equal(t, rootHash, unchanged.RootHash(), "tree changed by empty range")
+}
@@ -0,0 +1,31 @@
+package cairo_bptree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestDeleteAfterUpserts(t *testing.T) {
+	repeatRandom(36, 300, func(r *rand.Rand, i int) {
+		kvItems := randomTreeItems(r)
+		state := make(map[Felt]bool)
+		for _, key := range kvItems.Keys() {
+			state[key] = true
+		}
+		tree := NewTree23(kvItems)
+		for j := 0; j < 5; j++ {
+			applyRandomBatch(r, tree, state)
+			requireValidKeys(t, tree, presentKeys(state), "iteration %d step %d: different keys", i, j)
+		}
+	})
+}
+
+func TestDeleteNextToUpsertedLeaf(t *testing.T) {
+	keys := []Felt{0, 2, 7, 8, 9, 11, 13, 15, 17, 18, 19, 20, 22, 24, 27, 28, 29, 30, 31, 32, 33, 35, 36, 41, 42, 43, 48, 49,
+		51, 52, 54, 56, 57, 60, 61, 62, 64, 70, 76, 77, 80, 83, 84}
+	tree := NewTree23(K(keys))
+	tree.Upsert(K([]Felt{63}))
+	tree.Delete([]Felt{64, 70})
+	expected := append(append(append([]Felt{}, keys[:36]...), 63), keys[38:]...) // 64 and 70 deleted
+	requireValidKeys(t, tree, expected)
+}
@@ -0,0 +1,70 @@
+package cairo_bptree
+
+// EstimateUpsert returns the stats UpsertWithStats would produce for kvItems, leaving the tree untouched.
+func (t *Tree23) EstimateUpsert(kvItems KeyValues) Stats {
+	stats := Stats{}
+	t.scratch(deref(kvItems.keys)).UpsertWithStats(kvItems.clone(), &stats)
+	return stats
+}
+
+// EstimateDelete returns the stats DeleteWithStats would produce for keysToDelete, leaving the tree untouched.
+func (t *Tree23) EstimateDelete(keysToDelete []Felt) Stats {
+	stats := Stats{}
+	t.scratch(keysToDelete).DeleteWithStats(keysToDelete, &stats)
+	return stats
+}
+
+// scratch copies the nodes that a batch on keys can reach, whose exposed and updated flags batches change in place,
+// to run the batch on. The nodes flagged by the last batch are copied too, since the batch starts clearing them.
+// Other subtrees are shared, batches never write through them. The observer is not kept, while canonical trees
+// repack the scratch copy, which builds new nodes, so that the stats count the repacked tree.
+func (t *Tree23) scratch(keys []Felt) *Tree23 {
+	touched := touchedNodes(t.root, keys)
+	paths := make([][]int, 0, len(t.flagged))
+	for _, n := range t.flagged {
+		path, found := pathTo(t.root, n)
+		if !found {
+			continue // dropped by the last batch
+		}
+		paths = append(paths, path)
+		for current, depth := t.root, 0; !current.isLeaf; depth++ {
+			touched[current] = true
+			if depth == len(path) {
+				break
+			}
+			current = current.children[path[depth]]
+		}
+	}
+	scratch := &Tree23{root: cloneTouched(t.root, touched), canonical: t.canonical}
+	for _, path := range paths {
+		n := scratch.root
+		for _, i := range path {
+			n = n.children[i]
+		}
+		scratch.flagged = append(scratch.flagged, n)
+	}
+	return scratch
+}
+
+// pathTo returns the child indexes leading from root to n, descending by the first key below n.
+func pathTo(root, n *Node23) (path []int, found bool) {
+	leaf := n
+	for !leaf.isLeaf && len(leaf.children) > 0 {
+		leaf = leaf.children[0]
+	}
+	if !leaf.isLeaf || leaf.keyCount() < 2 {
+		return nil, false
+	}
+	key := leaf.firstKey()
+	for current := root; current != nil; {
+		if current == n {
+			return path, true
+		}
+		if current.isLeaf || current.isPruned() {
+			return nil, false
+		}
+		i := current.childIndex(key)
+		path, current = append(path, i), current.children[i]
+	}
+	return nil, false
+}
@@ -0,0 +1,64 @@
+package cairo_bptree
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateMatchesBatch(t *testing.T) {
+	r := rand.New(rand.NewSource(38))
+	for i := 0; i < 200; i++ {
+		tree := NewTree23(randomKeyValues(r, r.Intn(256)))
+		if i%4 == 0 {
+			tree = NewCanonicalTree23(tree.KeyValues())
+		}
+		for j := 0; j < 5; j++ {
+			rootHash, keys := tree.RootHash(), tree.KeysInLevelOrder()
+			stats := &Stats{}
+			if r.Intn(2) == 0 {
+				batch := randomKeyValues(r, r.Intn(32))
+				estimate := tree.EstimateUpsert(batch)
+				require.Equal(t, rootHash, tree.RootHash(), "iteration %d step %d: tree changed by estimate", i, j)
+				require.Equal(t, keys, tree.KeysInLevelOrder(), "iteration %d step %d: tree changed by estimate", i, j)
+				tree.UpsertWithStats(batch, stats)
+				require.Equal(t, *stats, estimate, "iteration %d step %d: different upsert stats", i, j)
+			} else {
+				keysToDelete := randomKeys(r, r.Intn(64))
+				estimate := tree.EstimateDelete(keysToDelete)
+				require.Equal(t, rootHash, tree.RootHash(), "iteration %d step %d: tree changed by estimate", i, j)
+				require.Equal(t, keys, tree.KeysInLevelOrder(), "iteration %d step %d: tree changed by estimate", i, j)
+				tree.DeleteWithStats(keysToDelete, stats)
+				require.Equal(t, *stats, estimate, "iteration %d step %d: different delete stats", i, j)
+			}
+		}
+	}
+}
+
+func TestEstimateEmptyTree(t *testing.T) {
+	tree := NewEmptyTree23()
+	estimate := tree.EstimateUpsert(K([]Felt{1, 2, 3}))
+	assert.Equal(t, uint(0), estimate.ExposedCount)
+	assert.NotZero(t, estimate.CreatedCount)
+	assert.Nil(t, tree.root, "empty tree changed by estimate")
+	assert.Equal(t, Stats{}, tree.EstimateDelete([]Felt{1}))
+}
+
+func TestEstimateSharesUntouchedNodes(t *testing.T) {
+	tree := NewTree23(K([]Felt{0, 2, 4, 6, 8, 10, 12, 14, 16, 18, 20, 22, 24, 26, 28, 30, 32, 34, 36, 38, 40}))
+	keys := []Felt{1}
+	scratch := tree.scratch(keys)
+	shared := make(map[*Node23]bool)
+	tree.WalkPostOrder(func(n *Node23) interface{} { shared[n] = true; return nil })
+	sharedCount := 0
+	scratch.WalkPostOrder(func(n *Node23) interface{} {
+		if shared[n] {
+			sharedCount++
+		}
+		return nil
+	})
+	assert.Greater(t, sharedCount, 0, "no subtree shared with the tree")
+	assert.False(t, shared[scratch.root], "root shared with the tree")
+}
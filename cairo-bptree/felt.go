@@ -31,6 +31,22 @@ func pointerValue(pointer *Felt) string {
 	}
 }
 
+// valueOrZero returns the value pointed to by pointer, zero if nil.
+func valueOrZero(pointer *Felt) Felt {
+	if pointer == nil {
+		return 0
+	}
+	return *pointer
+}
+
+func copyFelt(pointer *Felt) *Felt {
+	if pointer == nil {
+		return nil
+	}
+	value := *pointer
+	return &value
+}
+
 func deref(pointers []*Felt) []Felt {
 	pointees := make([]Felt, 0)
 	for _, ptr := range pointers {
@@ -42,3 +58,11 @@ func deref(pointers []*Felt) []Felt {
 	}
 	return pointees
 }
+
+// appendFelts appends the values pointed to by pointers to felts.
+func appendFelts(felts []Felt, pointers ...*Felt) []Felt {
+	for _, pointer := range pointers {
+		felts = append(felts, *pointer)
+	}
+	return felts
+}
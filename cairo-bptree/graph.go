@@ -2,11 +2,10 @@ package cairo_bptree
 
 import (
 	"fmt"
-	"os"
-	"os/exec"
+	"io"
 	"strconv"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/canepat/bst/graph"
 )
 
 type Node23Graph struct {
@@ -17,137 +16,295 @@ func NewGraph(node *Node23) *Node23Graph {
 	return &Node23Graph{node}
 }
 
-func (g *Node23Graph) saveDot(filename string, debug bool) {
-	palette := []string{"#FDF3D0", "#DCE8FA", "#D9E7D6", "#F1CFCD", "#F5F5F5", "#E1D5E7", "#FFE6CC", "white"}
-	const unexposedIndex = 0
-	const exposedIndex = 1
-	const updatedIndex = 2
+const (
+	unexposedIndex = 0
+	exposedIndex   = 1
+	updatedIndex   = 2
+)
+
+func (g *Node23Graph) root(debug bool) (*graph.Node, error) {
+	if g.node == nil {
+		return nil, nil
+	}
+	return graphNode(g.node, debug, nil)
+}
+
+func (g *Node23Graph) saveDot(filename string, debug bool) error {
+	root, err := g.root(debug)
+	if err != nil {
+		return err
+	}
+	return graph.Save(filename, root, graph.DOT)
+}
 
-	f, err := os.OpenFile(filename+".dot", os.O_RDWR|os.O_CREATE, 0755)
+func (g *Node23Graph) saveDotAndPicture(dir, name string, debug bool) error {
+	root, err := g.root(debug)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer func() {
-		if err := f.Close(); err != nil {
-			log.Fatal(err)
+	return graph.SaveAndPicture(dir, name, graph.NewExporter(root))
+}
+
+func nodeLabel(n *Node23, debug bool) string {
+	if n.isLeaf {
+		if n.keyCount() == 0 {
+			return "k=[]"
 		}
-	}()
-	if g.node == nil {
-		if _, err := f.WriteString("strict digraph {\nnode [shape=record];}\n"); err != nil {
-			log.Fatal(err)
+		next := "nil"
+		if n.hasNextKey() {
+			next = strconv.FormatUint(uint64(n.nextKey()), 10)
 		}
-		return
+		if debug {
+			return fmt.Sprintf("k=%v %s-%p", n.keys[:len(n.keys)-1], next, n.keys)
+		}
+		return fmt.Sprintf("k=%v %s", n.keys[:len(n.keys)-1], next)
+	}
+	if debug {
+		return fmt.Sprintf("k=%v-%p", n.keys, n.keys)
 	}
-	if _, err := f.WriteString("strict digraph {\nnode [shape=record];\n"); err != nil {
-		log.Fatal(err)
-	}
-	for _, n := range g.node.walkNodesPostOrder() {
-		log.Tracef("graph: %+v nesting=%d\n", n, 0)
-		left, down, right := "", "", ""
-		switch n.childrenCount() {
-		case 1:
-			left = "<L>L"
-		case 2:
-			left = "<L>L"
-			right = "<R>R"
-		case 3:
-			left = "<L>L"
-			down = "<D>D"
-			right = "<R>R"
+	return fmt.Sprintf("k=%v", n.keys)
+}
+
+func nodeColor(n *Node23) (string, error) {
+	if n.exposed {
+		if n.updated {
+			return graph.Palette[updatedIndex], nil
 		}
-		var nodeId string
-		if n.isLeaf {
-			next := ""
-			if n.keyCount() > 0 {
-				if n.nextKey() == nil {
-					next = "nil"
-				} else {
-					next = strconv.FormatUint(uint64(*n.nextKey()), 10)
-				}
-				if debug {
-					nodeId = fmt.Sprintf("k=%v %s-%v", deref(n.keys[:len(n.keys)-1]), next, n.keys)
-				} else {
-					nodeId = fmt.Sprintf("k=%v %s", deref(n.keys[:len(n.keys)-1]), next)
-				}
-			} else {
-				nodeId = "k=[]"
-			}
-		} else {
-			if debug {
-				nodeId = fmt.Sprintf("k=%v-%v", deref(n.keys), n.keys)
-			} else {
-				nodeId = fmt.Sprintf("k=%v", deref(n.keys))
-			}
+		return graph.Palette[exposedIndex], nil
+	}
+	if n.updated {
+		return "", fmt.Errorf("nodeColor: node %v is not exposed but updated", n)
+	}
+	return graph.Palette[unexposedIndex], nil
+}
+
+// graphNode converts the subtree rooted at n, ports named after the children of 2-nodes and 3-nodes or numbered
+// while a batch splits larger nodes. If nodes is not nil, it collects the converted nodes.
+func graphNode(n *Node23, debug bool, nodes map[*Node23]*graph.Node) (*graph.Node, error) {
+	color, err := nodeColor(n)
+	if err != nil {
+		return nil, err
+	}
+	g := &graph.Node{Fields: []string{nodeLabel(n, debug)}, Fill: color}
+	if nodes != nil {
+		nodes[n] = g
+	}
+	for i, child := range n.children {
+		port := strconv.Itoa(i)
+		if n.childrenCount() <= 3 {
+			port = [][]string{{}, {"L"}, {"L", "R"}, {"L", "D", "R"}}[n.childrenCount()][i]
 		}
-		var color string
-		if n.exposed {
-			if n.updated {
-				color = palette[updatedIndex]
-			} else {
-				color = palette[exposedIndex]
-			}
-		} else {
-			ensure(!n.updated, fmt.Sprintf("saveDot: node %v is not exposed but updated", n))
-			color = palette[unexposedIndex]
+		to, err := graphNode(child, debug, nodes)
+		if err != nil {
+			return nil, err
 		}
-		s := fmt.Sprintf("%d [label=\"%s|{<C>%s|%s}|%s\" style=filled fillcolor=\"%s\"];\n", n.rawPointer(), left, nodeId, down, right, color)
-		if _, err := f.WriteString(s); err != nil {
-			log.Fatal(err)
+		g.Edges = append(g.Edges, graph.Edge{Port: port, To: to})
+	}
+	return g, nil
+}
+
+// Export writes the tree in format, see graph.Export.
+func (t *Tree23) Export(w io.Writer, format graph.Format) error {
+	root, err := NewGraph(t.root).root(false)
+	if err != nil {
+		return err
+	}
+	return graph.Export(w, root, format)
+}
+
+// BatchReport pictures the tree before and after a batch, see graph.WriteHTML.
+type BatchReport struct {
+	before *graph.Node
+	nodes  map[*Node23]*graph.Node
+}
+
+// NewBatchReport takes the picture of t before a batch, so the batch is free to change t in place.
+func NewBatchReport(t *Tree23) (*BatchReport, error) {
+	r := &BatchReport{nodes: make(map[*Node23]*graph.Node)}
+	if t.root != nil {
+		before, err := graphNode(t.root, false, r.nodes)
+		if err != nil {
+			return nil, err
 		}
+		r.before = before
 	}
-	for _, n := range g.node.walkNodesPostOrder() {
-		var treeLeft, treeDown, treeRight *Node23
-		switch n.childrenCount() {
-		case 1:
-			treeLeft = n.children[0]
-		case 2:
-			treeLeft = n.children[0]
-			treeRight = n.children[1]
-		case 3:
-			treeLeft = n.children[0]
-			treeDown = n.children[1]
-			treeRight = n.children[2]
+	return r, nil
+}
+
+// Report returns the report of the batch with stats which turned the tree into t. Nodes before the batch are
+// marked as deleted if missing in t, otherwise as they are marked in t.
+func (r *BatchReport) Report(title string, t *Tree23, stats *Stats) (graph.Report, error) {
+	report := graph.Report{Title: title, Before: r.before, Stats: stats.graphStats()}
+	if t.root == nil {
+		for _, g := range r.nodes {
+			g.Mark = graph.Deleted
 		}
-		if treeLeft != nil {
-			//if _, err := f.WriteString(fmt.Sprintln(n.rawPointer(), ":L -> ", treeLeft.rawPointer(), ":C;")); err != nil {
-			if _, err := f.WriteString(fmt.Sprintf("%d:L -> %d:C;\n", n.rawPointer(), treeLeft.rawPointer())); err != nil {
-				log.Fatal(err)
-			}
+		return report, nil
+	}
+	after := make(map[*Node23]*graph.Node)
+	root, err := graphNode(t.root, false, after)
+	if err != nil {
+		return graph.Report{}, err
+	}
+	report.After = root
+	for n, g := range after {
+		switch {
+		case n.created:
+			g.Mark = graph.Created
+		case n.updated:
+			g.Mark = graph.Updated
+		case n.exposed:
+			g.Mark = graph.Exposed
 		}
-		if treeDown != nil {
-			//if _, err := f.WriteString(fmt.Sprintln(n.rawPointer(), ":D -> ", treeDown.rawPointer(), ":C;")); err != nil {
-			if _, err := f.WriteString(fmt.Sprintf("%d:D -> %d:C;\n", n.rawPointer(), treeDown.rawPointer())); err != nil {
-				log.Fatal(err)
-			}
+	}
+	for n, g := range r.nodes {
+		if a, found := after[n]; !found || n.created {
+			g.Mark = graph.Deleted
+		} else {
+			g.Mark = a.Mark
+		}
+	}
+	return report, nil
+}
+
+func (s *Stats) graphStats() []graph.Stat {
+	return []graph.Stat{
+		{Name: "Exposed nodes", Value: uint64(s.ExposedCount)},
+		{Name: "Re-hashed nodes", Value: uint64(s.RehashedCount)},
+		{Name: "Created nodes", Value: uint64(s.CreatedCount)},
+		{Name: "Updated nodes", Value: uint64(s.UpdatedCount)},
+		{Name: "Deleted nodes", Value: uint64(s.DeletedCount)},
+		{Name: "Opening hashes", Value: uint64(s.OpeningHashes)},
+		{Name: "Closing hashes", Value: uint64(s.ClosingHashes)},
+	}
+}
+
+// Tracer records a snapshot of the tree at every event of its batches, see graph.Trace. Each snapshot converts
+// the whole tree, so it is meant for small trees. Once a snapshot fails, the tracer stops recording and Stop
+// returns the error.
+type Tracer struct {
+	tree  *Tree23
+	next  Observer
+	trace *graph.Trace
+	err   error
+}
+
+// NewTracer starts tracing the batches of t, still notifying its observer if any.
+func NewTracer(t *Tree23, operation string) *Tracer {
+	tracer := &Tracer{tree: t, next: t.observer, trace: graph.NewTrace(operation)}
+	tracer.snapshot("start", tracer.rootHeight(), graph.Unchanged)
+	t.SetObserver(tracer)
+	return tracer
+}
+
+// Stop restores the previous observer of the tree and returns the trace.
+func (tr *Tracer) Stop() (*graph.Trace, error) {
+	tr.tree.SetObserver(tr.next)
+	tr.snapshot("end", tr.rootHeight(), graph.Unchanged)
+	if tr.err != nil {
+		return nil, tr.err
+	}
+	return tr.trace, nil
+}
+
+// snapshot adds a frame picturing the tree, the nodes marked with mark and appended as detached trees if the
+// tree does not reach them yet.
+func (tr *Tracer) snapshot(event string, height int, mark graph.Mark, nodes ...*Node23) {
+	if tr.err != nil {
+		return
+	}
+	pictured := make(map[*Node23]*graph.Node)
+	var tree *graph.Node
+	if tr.tree.root != nil {
+		if tree, tr.err = graphNode(tr.tree.root, false, pictured); tr.err != nil {
+			return
+		}
+	}
+	trees := []graph.Edge{{Port: "tree", To: tree}}
+	for _, n := range nodes {
+		if n == nil {
+			continue
 		}
-		if treeRight != nil {
-			//if _, err := f.WriteString(fmt.Sprintln(n.rawPointer(), ":R -> ", treeRight.rawPointer(), ":C;")); err != nil {
-			if _, err := f.WriteString(fmt.Sprintf("%d:R -> %d:C;\n", n.rawPointer(), treeRight.rawPointer())); err != nil {
-				log.Fatal(err)
+		if _, found := pictured[n]; !found {
+			detached, err := graphNode(n, false, pictured)
+			if err != nil {
+				tr.err = err
+				return
 			}
+			trees = append(trees, graph.Edge{Port: "detached", To: detached})
 		}
+		pictured[n].Mark = mark
 	}
-	if _, err := f.WriteString("}\n"); err != nil {
-		log.Fatal(err)
+	tr.trace.AddAtHeight(event, height, trees...)
+}
+
+// rootHeight returns the height of the tree root above the leaves, 0 for an empty tree.
+func (tr *Tracer) rootHeight() int {
+	if tr.tree.root == nil {
+		return 0
 	}
+	return tr.tree.Height() - 1
 }
 
-func (g *Node23Graph) saveDotAndPicture(filename string, debug bool) error {
-	graphDir := "testdata/graph/"
-	_ = os.MkdirAll(graphDir, os.ModePerm)
-	filepath := graphDir + filename
-	_ = os.Remove(filepath + ".dot")
-	_ = os.Remove(filepath + ".png")
-	g.saveDot(filepath, debug)
-	dotExecutable, _ := exec.LookPath("dot")
-	cmdDot := &exec.Cmd{
-		Path:   dotExecutable,
-		Args:   []string{dotExecutable, "-Tpng", filepath + ".dot", "-o", filepath + ".png"},
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+func traceLabel(n *Node23) string {
+	if n == nil {
+		return "nil"
 	}
-	if err := cmdDot.Run(); err != nil {
-		return err
+	return nodeLabel(n, false)
+}
+
+func (tr *Tracer) NodeExposed(node *Node23, height int) {
+	tr.snapshot("exposed "+traceLabel(node), height, graph.Exposed, node)
+	if tr.next != nil {
+		tr.next.NodeExposed(node, height)
+	}
+}
+
+func (tr *Tracer) NodeCreated(node *Node23, height int) {
+	tr.snapshot("created "+traceLabel(node), height, graph.Created, node)
+	if tr.next != nil {
+		tr.next.NodeCreated(node, height)
+	}
+}
+
+func (tr *Tracer) NodeUpdated(node *Node23, height int) {
+	tr.snapshot("updated "+traceLabel(node), height, graph.Updated, node)
+	if tr.next != nil {
+		tr.next.NodeUpdated(node, height)
+	}
+}
+
+func (tr *Tracer) LeafSplit(leaf *Node23, newLeaves []*Node23, height int) {
+	tr.snapshot("split "+traceLabel(leaf), height, graph.Created, newLeaves...)
+	if tr.next != nil {
+		tr.next.LeafSplit(leaf, newLeaves, height)
+	}
+}
+
+func (tr *Tracer) NodesMerged(left, right *Node23, height int) {
+	tr.snapshot("merged "+traceLabel(right)+" into "+traceLabel(left), height, graph.Updated, left)
+	if tr.next != nil {
+		tr.next.NodesMerged(left, right, height)
+	}
+}
+
+func (tr *Tracer) Promote(root *Node23, height int) {
+	tr.snapshot("promoted "+traceLabel(root), height, graph.Created, root)
+	if tr.next != nil {
+		tr.next.Promote(root, height)
+	}
+}
+
+func (tr *Tracer) Demote(root *Node23, height int) {
+	tr.snapshot("demoted to "+traceLabel(root), height, graph.Updated, root)
+	if tr.next != nil {
+		tr.next.Demote(root, height)
+	}
+}
+
+func (tr *Tracer) NextKeyChanged(leaf *Node23, nextKey *Felt, height int) {
+	tr.snapshot("next key of "+traceLabel(leaf), height, graph.Updated, leaf)
+	if tr.next != nil {
+		tr.next.NextKeyChanged(leaf, nextKey, height)
 	}
-	return nil
 }
@@ -0,0 +1,160 @@
+package cairo_bptree
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canepat/bst/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport(t *testing.T) {
+	kvItems := K([]Felt{1, 2, 3, 4, 5, 6, 7})
+	for _, format := range []graph.Format{graph.DOT, graph.Mermaid, graph.JSON} {
+		first, second := bytes.Buffer{}, bytes.Buffer{}
+		require.NoError(t, NewTree23(kvItems.clone()).Export(&first, format))
+		require.NoError(t, NewTree23(kvItems.clone()).Export(&second, format))
+		assert.Equal(t, first.String(), second.String(), "format %s: different output for the same tree", format)
+	}
+
+	tree := NewTree23(kvItems.clone())
+	buffer := bytes.Buffer{}
+	require.NoError(t, tree.Export(&buffer, graph.JSON))
+	document := struct {
+		Nodes []struct {
+			ID     string
+			Fields []string
+		}
+	}{}
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &document))
+	assert.Equal(t, len(tree.root.walkNodesPostOrder()), len(document.Nodes))
+	assert.Equal(t, "M", document.Nodes[0].ID)
+	fields := make(map[string][]string)
+	for _, node := range document.Nodes {
+		fields[node.ID] = node.Fields
+	}
+	assert.Equal(t, []string{"k=[1 2] 3"}, fields["M"+strings.Repeat("L", tree.Height()-1)], "different first leaf")
+}
+
+func countMarks(root *graph.Node) map[graph.Mark]uint {
+	marks := make(map[graph.Mark]uint)
+	var visit func(g *graph.Node)
+	visit = func(g *graph.Node) {
+		marks[g.Mark]++
+		for _, edge := range g.Edges {
+			visit(edge.To)
+		}
+	}
+	if root != nil {
+		visit(root)
+	}
+	return marks
+}
+
+func TestExportUpdatedNotExposed(t *testing.T) {
+	tree := NewTree23(K([]Felt{1, 2, 3, 4, 5, 6, 7}))
+	tree.root.children[0].updated = true
+	buffer := bytes.Buffer{}
+	assert.Error(t, tree.Export(&buffer, graph.DOT))
+	assert.Error(t, tree.GraphAndPicture(t.TempDir(), "tree"))
+	_, err := NewBatchReport(tree)
+	assert.Error(t, err)
+	_, err = NewTracer(tree, "upsert").Stop()
+	assert.Error(t, err)
+}
+
+func TestGraphAndPicture(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, NewTree23(K([]Felt{1, 2, 3, 4, 5, 6, 7})).GraphAndPicture(dir, "tree"))
+	assert.FileExists(t, filepath.Join(dir, "tree.dot"))
+	assert.FileExists(t, filepath.Join(dir, "tree."+graph.PictureFormat().Extension()))
+}
+
+func TestBatchReport(t *testing.T) {
+	tree := NewTree23(K([]Felt{1, 2, 3, 4, 5, 6, 7}))
+	stats := &Stats{}
+	batchReport, err := NewBatchReport(tree)
+	require.NoError(t, err)
+	report, err := batchReport.Report("upsert", tree.UpsertWithStats(K([]Felt{8, 9, 10}), stats), stats)
+	require.NoError(t, err)
+	marks := countMarks(report.After)
+	assert.Equal(t, stats.RehashedCount, marks[graph.Exposed]+marks[graph.Created]+marks[graph.Updated])
+	assert.NotZero(t, marks[graph.Created])
+	assert.Zero(t, countMarks(report.Before)[graph.Created], "created node before the batch")
+	assert.Equal(t, graph.Stat{Name: "Created nodes", Value: uint64(stats.CreatedCount)}, report.Stats[2])
+
+	tree = NewTree23(K([]Felt{1, 2, 3, 4, 5, 6, 7}))
+	stats = &Stats{}
+	batchReport, err = NewBatchReport(tree)
+	require.NoError(t, err)
+	report, err = batchReport.Report("delete", tree.DeleteWithStats([]Felt{1, 2, 3, 4}, stats), stats)
+	require.NoError(t, err)
+	assert.NotZero(t, countMarks(report.Before)[graph.Deleted])
+	marks = countMarks(report.After)
+	assert.Equal(t, stats.RehashedCount, marks[graph.Created]+marks[graph.Updated])
+	assert.Zero(t, marks[graph.Deleted])
+
+	buffer := bytes.Buffer{}
+	require.NoError(t, graph.WriteHTML(&buffer, report))
+	assert.Contains(t, buffer.String(), `<span class="box deleted"`)
+}
+
+func TestTracer(t *testing.T) {
+	r := rand.New(rand.NewSource(47))
+	for i := 0; i < 100; i++ {
+		tree := NewTree23(randomKeyValues(r, r.Intn(64)))
+		observer := newRecordingObserver()
+		tree.SetObserver(observer)
+		tracer := NewTracer(tree, "batch")
+		if i%2 == 0 {
+			tree.Upsert(randomKeyValues(r, r.Intn(16)))
+		} else {
+			tree.Delete(randomKeys(r, r.Intn(32)))
+		}
+		trace, err := tracer.Stop()
+		require.NoError(t, err, "iteration %d", i)
+		assert.Equal(t, observer, tree.observer, "iteration %d: observer not restored", i)
+		events := 0
+		for _, recorded := range observer.events {
+			events += len(recorded)
+		}
+		require.Len(t, trace.Frames, events+2, "iteration %d: one frame per event plus start and end", i)
+		assert.Equal(t, "start", trace.Frames[0].Event)
+		assert.Equal(t, "end", trace.Frames[len(trace.Frames)-1].Event)
+		end := bytes.Buffer{}
+		require.NoError(t, tree.Export(&end, graph.JSON))
+		last := bytes.Buffer{}
+		require.NoError(t, graph.Export(&last, trace.Frames[len(trace.Frames)-1].Trees[0].To, graph.JSON))
+		assert.Equal(t, end.String(), last.String(), "iteration %d: last frame is not the tree", i)
+	}
+}
+
+func TestTracerMarks(t *testing.T) {
+	tree := NewTree23(K([]Felt{1, 2, 3, 4, 5, 6, 7}))
+	tracer := NewTracer(tree, "upsert")
+	tree.Upsert(K([]Felt{8, 9, 10, 11}))
+	trace, err := tracer.Stop()
+	require.NoError(t, err)
+	marks := make(map[graph.Mark]int)
+	detached := 0
+	for _, frame := range trace.Frames[1 : len(trace.Frames)-1] {
+		for _, tree := range frame.Trees {
+			if tree.Port == "detached" {
+				detached++
+			}
+		}
+		for mark, count := range countMarks(frame.Node(0)) {
+			if mark != graph.Unchanged {
+				marks[mark] += int(count)
+			}
+		}
+	}
+	assert.NotZero(t, marks[graph.Exposed])
+	assert.NotZero(t, marks[graph.Created])
+	assert.NotZero(t, detached, "created nodes are not reached by the tree yet")
+}
@@ -45,6 +45,8 @@ func (factory *KeyBinaryFactory) readUniqueKeyValues(reader *bufio.Reader) KeyVa
 		}
 		key_bytes_count := factory.keySize * (bytes_read / factory.keySize)
 		duplicated_keys := 0
+		// Allocate keys and values of the whole chunk at once, instead of one by one
+		felts := make([]Felt, 0, 2*(key_bytes_count/factory.keySize))
 		for i := 0; i < key_bytes_count; i += factory.keySize {
 			key := factory.readKey(buffer, i)
 			if _, duplicated := keyRegistry[key]; duplicated {
@@ -52,9 +54,9 @@ func (factory *KeyBinaryFactory) readUniqueKeyValues(reader *bufio.Reader) KeyVa
 				continue
 			}
 			keyRegistry[key] = true
-			value := key // Shortcut: value equal to key
-			kvPairs.keys = append(kvPairs.keys, &key)
-			kvPairs.values = append(kvPairs.values, &value)
+			felts = append(felts, key, key) // Shortcut: value equal to key
+			kvPairs.keys = append(kvPairs.keys, &felts[len(felts)-2])
+			kvPairs.values = append(kvPairs.values, &felts[len(felts)-1])
 		}
 	}
 	return kvPairs
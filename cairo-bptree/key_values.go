@@ -0,0 +1,77 @@
+package cairo_bptree
+
+import (
+	"fmt"
+	"sort"
+)
+
+// NewKeyValues builds a batch from keys and values at the same positions. Pairs are sorted by key and, when
+// a key is repeated, the last pair wins.
+func NewKeyValues(keys, values []Felt) (KeyValues, error) {
+	if len(keys) != len(values) {
+		return KeyValues{}, fmt.Errorf("different number of keys %d and values %d", len(keys), len(values))
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return keys[order[i]] < keys[order[j]] })
+	felts := make([]Felt, 0, 2*len(keys))
+	kvItems := KeyValues{make([]*Felt, 0, len(keys)), make([]*Felt, 0, len(values))}
+	for i, position := range order {
+		if i+1 < len(order) && keys[order[i+1]] == keys[position] {
+			continue // stable sort keeps the last write of the key at the end of its run
+		}
+		felts = append(felts, keys[position], values[position])
+		kvItems.keys = append(kvItems.keys, &felts[len(felts)-2])
+		kvItems.values = append(kvItems.values, &felts[len(felts)-1])
+	}
+	return kvItems, nil
+}
+
+// FromMap builds a batch from the pairs in m.
+func FromMap(m map[Felt]Felt) KeyValues {
+	keys, values := make([]Felt, 0, len(m)), make([]Felt, 0, len(m))
+	for key, value := range m {
+		keys, values = append(keys, key), append(values, value)
+	}
+	kvItems, _ := NewKeyValues(keys, values)
+	return kvItems
+}
+
+// KeyValuesBuilder collects pairs in any order to build a batch, last Put of a key wins.
+type KeyValuesBuilder struct {
+	keys   []Felt
+	values []Felt
+}
+
+func (b *KeyValuesBuilder) Put(key, value Felt) *KeyValuesBuilder {
+	b.keys, b.values = append(b.keys, key), append(b.values, value)
+	return b
+}
+
+func (b *KeyValuesBuilder) Build() KeyValues {
+	kvItems, _ := NewKeyValues(b.keys, b.values)
+	return kvItems
+}
+
+func (kv KeyValues) Keys() []Felt {
+	return deref(kv.keys)
+}
+
+func (kv KeyValues) Values() []Felt {
+	return deref(kv.values)
+}
+
+// sortedKeys returns a sorted copy of keys without duplicates.
+func sortedKeys(keys []Felt) []Felt {
+	sorted := append(make(Keys, 0, len(keys)), keys...)
+	sort.Sort(sorted)
+	unique := sorted[:0]
+	for i, key := range sorted {
+		if i == 0 || key != sorted[i-1] {
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,52 @@
+package cairo_bptree
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewKeyValues(t *testing.T) {
+	tests := []struct {
+		keys, values                 []Felt
+		expectedKeys, expectedValues []Felt
+	}{
+		{[]Felt{}, []Felt{}, []Felt{}, []Felt{}},
+		{[]Felt{3, 1, 2}, []Felt{30, 10, 20}, []Felt{1, 2, 3}, []Felt{10, 20, 30}},
+		{[]Felt{5, 1, 5, 1, 5}, []Felt{50, 10, 51, 11, 52}, []Felt{1, 5}, []Felt{11, 52}},
+		{[]Felt{7, 7}, []Felt{1, 0}, []Felt{7}, []Felt{0}},
+	}
+	for _, test := range tests {
+		kvItems, err := NewKeyValues(test.keys, test.values)
+		require.NoError(t, err)
+		assert.Equal(t, test.expectedKeys, kvItems.Keys(), "different keys for input %v", test.keys)
+		assert.Equal(t, test.expectedValues, kvItems.Values(), "different values for input %v", test.keys)
+	}
+	_, err := NewKeyValues([]Felt{1, 2}, []Felt{1})
+	assert.Error(t, err, "different cardinality accepted")
+}
+
+func TestKeyValuesBuilderAndFromMap(t *testing.T) {
+	built := (&KeyValuesBuilder{}).Put(9, 90).Put(4, 40).Put(9, 91).Build()
+	assert.Equal(t, []Felt{4, 9}, built.Keys())
+	assert.Equal(t, []Felt{40, 91}, built.Values())
+
+	fromMap := FromMap(map[Felt]Felt{9: 91, 4: 40})
+	assert.Equal(t, built, fromMap, "different batch from map")
+}
+
+func TestUpsertDeleteUnsorted(t *testing.T) {
+	tree, err := NewEmptyTree23().UpsertUnsorted([]Felt{8, 2, 6, 4, 2}, []Felt{80, 20, 60, 40, 21})
+	require.NoError(t, err)
+	expected := NewTree23((&KeyValuesBuilder{}).Put(2, 21).Put(4, 40).Put(6, 60).Put(8, 80).Build())
+	assert.Equal(t, expected.RootHash(), tree.RootHash(), "different root after unsorted upsert")
+
+	tree.DeleteUnsorted([]Felt{6, 2, 6})
+	assert.Equal(t, []Felt{4, 8}, tree.WalkKeysPostOrder())
+	valid, err := tree.IsValid()
+	assert.True(t, valid, "invalid tree: %v", err)
+
+	_, err = tree.UpsertUnsorted([]Felt{1}, []Felt{})
+	assert.Error(t, err, "different cardinality accepted")
+}
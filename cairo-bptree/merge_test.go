@@ -0,0 +1,88 @@
+package cairo_bptree
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addOrDrop sums the delta to the old value, dropping the key when the sum is a multiple of 5.
+func addOrDrop(oldValue *Felt, delta Felt) (Felt, bool) {
+	sum := delta
+	if oldValue != nil {
+		sum += *oldValue
+	}
+	return sum, sum%5 != 0
+}
+
+func TestMerge(t *testing.T) {
+	r := rand.New(rand.NewSource(33))
+	for i := 0; i < 300; i++ {
+		state := make(map[Felt]Felt)
+		for _, key := range r.Perm(256)[:r.Intn(128)] {
+			state[Felt(key)] = Felt(r.Intn(1000))
+		}
+		tree := NewTree23(FromMap(state))
+		if i%2 == 0 {
+			tree = NewCanonicalTree23(FromMap(state))
+		}
+		deltas, dropped := make(map[Felt]Felt), make(map[Felt]bool)
+		for _, key := range r.Perm(256)[:r.Intn(64)] {
+			deltas[Felt(key)] = Felt(r.Intn(1000))
+		}
+		for key, delta := range deltas {
+			oldValue, found := state[key]
+			var value Felt
+			var keep bool
+			if found {
+				value, keep = addOrDrop(&oldValue, delta)
+			} else {
+				value, keep = addOrDrop(nil, delta)
+			}
+			if keep {
+				state[key] = value
+			} else {
+				dropped[key] = true
+			}
+		}
+		final := make(map[Felt]Felt)
+		for key, value := range state {
+			if !dropped[key] {
+				final[key] = value
+			}
+		}
+		tree.Merge(FromMap(deltas), addOrDrop)
+		valid, err := tree.IsValid()
+		require.True(t, valid, "iteration %d: invalid tree: %v", i, err)
+		expected := NewCanonicalTree23(FromMap(final))
+		require.Equal(t, expected.KeyValues().Keys(), tree.KeyValues().Keys(), "iteration %d: different keys", i)
+		require.Equal(t, expected.KeyValues().Values(), tree.KeyValues().Values(), "iteration %d: different values", i)
+		require.Equal(t, expected.Len(), tree.Len(), "iteration %d: different length", i)
+		if tree.IsCanonical() {
+			require.Equal(t, expected.RootHash(), tree.RootHash(), "iteration %d: different root hash", i)
+		}
+	}
+}
+
+func TestMergeStats(t *testing.T) {
+	tree := NewTree23(KV([]Felt{1, 2, 3, 4}, []Felt{10, 20, 30, 40}))
+	stats := &Stats{}
+	tree.MergeWithStats(KV([]Felt{2, 3, 7}, []Felt{1, 20, 5}), addOrDrop, stats)
+	assert.Equal(t, []Felt{1, 2, 4}, tree.KeyValues().Keys())
+	assert.Equal(t, []Felt{10, 21, 40}, tree.KeyValues().Values())
+	assert.Equal(t, uint(3), stats.ExposedCount, "root and both leaves not opened once")
+	assert.Equal(t, uint(0), stats.DeletedCount, "no leaf left without keys")
+
+	stats = &Stats{}
+	tree.MergeWithStats(KV([]Felt{2, 4}, []Felt{4, 5}), addOrDrop, stats)
+	assert.Equal(t, []Felt{1}, tree.KeyValues().Keys())
+	assert.Equal(t, uint(1), stats.DeletedCount, "leaf of key 4 not deleted")
+	valid, err := tree.IsValid()
+	assert.True(t, valid, "invalid tree: %v", err)
+
+	empty := NewEmptyTree23().Merge(K([]Felt{5}), addOrDrop)
+	assert.Equal(t, 0, empty.Len())
+	assert.Equal(t, []byte{}, empty.RootHash(), "dropped deltas left a root")
+}
@@ -0,0 +1,73 @@
+package cairo_bptree
+
+import (
+	"time"
+
+	"github.com/canepat/bst/metrics"
+)
+
+// Metrics exports the batches applied to trees: sizes, Stats counters, latencies and the tree shape afterwards.
+type Metrics struct {
+	batches       *metrics.Counter
+	batchSize     *metrics.Histogram
+	latency       *metrics.Histogram
+	exposed       *metrics.Counter
+	rehashed      *metrics.Counter
+	created       *metrics.Counter
+	updated       *metrics.Counter
+	deleted       *metrics.Counter
+	openingHashes *metrics.Counter
+	closingHashes *metrics.Counter
+	height        *metrics.Gauge
+	size          *metrics.Gauge
+}
+
+// NewMetrics registers the tree metrics into r, labelled by operation e.g. upsert or delete.
+func NewMetrics(r *metrics.Registry) *Metrics {
+	return &Metrics{
+		batches:       r.NewCounter("bptree_batches_total", "Number of batches applied.", "operation"),
+		batchSize:     r.NewHistogram("bptree_batch_size", "Number of keys in the batches.", metrics.ExponentialBuckets(1, 10, 7), "operation"),
+		latency:       r.NewHistogram("bptree_operation_duration_seconds", "Time spent applying the batches.", metrics.ExponentialBuckets(0.00001, 10, 8), "operation"),
+		exposed:       r.NewCounter("bptree_exposed_nodes_total", "Number of existing nodes exposed.", "operation"),
+		rehashed:      r.NewCounter("bptree_rehashed_nodes_total", "Number of nodes re-hashed.", "operation"),
+		created:       r.NewCounter("bptree_created_nodes_total", "Number of nodes created.", "operation"),
+		updated:       r.NewCounter("bptree_updated_nodes_total", "Number of nodes updated.", "operation"),
+		deleted:       r.NewCounter("bptree_deleted_nodes_total", "Number of nodes deleted.", "operation"),
+		openingHashes: r.NewCounter("bptree_opening_hashes_total", "Number of hashes opening the batches.", "operation"),
+		closingHashes: r.NewCounter("bptree_closing_hashes_total", "Number of hashes closing the batches.", "operation"),
+		height:        r.NewGauge("bptree_tree_height", "Height of the tree after the last batch."),
+		size:          r.NewGauge("bptree_tree_keys", "Number of keys in the tree after the last batch."),
+	}
+}
+
+// Observe records a batch of batchSize keys applied to t by operation in elapsed time, with its stats.
+func (m *Metrics) Observe(operation string, t *Tree23, batchSize int, stats *Stats, elapsed time.Duration) {
+	m.batches.Inc(operation)
+	m.batchSize.Observe(float64(batchSize), operation)
+	m.latency.Observe(elapsed.Seconds(), operation)
+	m.exposed.Add(float64(stats.ExposedCount), operation)
+	m.rehashed.Add(float64(stats.RehashedCount), operation)
+	m.created.Add(float64(stats.CreatedCount), operation)
+	m.updated.Add(float64(stats.UpdatedCount), operation)
+	m.deleted.Add(float64(stats.DeletedCount), operation)
+	m.openingHashes.Add(float64(stats.OpeningHashes), operation)
+	m.closingHashes.Add(float64(stats.ClosingHashes), operation)
+	m.height.Set(float64(t.Height()))
+	m.size.Set(float64(t.Len()))
+}
+
+// UpsertWithMetrics works as UpsertWithStats and observes the batch into m.
+func (t *Tree23) UpsertWithMetrics(kvItems KeyValues, stats *Stats, m *Metrics) *Tree23 {
+	batchSize, start := kvItems.Len(), time.Now()
+	t.UpsertWithStats(kvItems, stats)
+	m.Observe("upsert", t, batchSize, stats, time.Since(start))
+	return t
+}
+
+// DeleteWithMetrics works as DeleteWithStats and observes the batch into m.
+func (t *Tree23) DeleteWithMetrics(keysToDelete []Felt, stats *Stats, m *Metrics) *Tree23 {
+	start := time.Now()
+	t.DeleteWithStats(keysToDelete, stats)
+	m.Observe("delete", t, len(keysToDelete), stats, time.Since(start))
+	return t
+}
@@ -0,0 +1,38 @@
+package cairo_bptree
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/canepat/bst/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	r := metrics.NewRegistry()
+	m := NewMetrics(r)
+	tree := NewTree23(K([]Felt{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}))
+
+	upsertStats, deleteStats := &Stats{}, &Stats{}
+	tree.UpsertWithMetrics(K([]Felt{13, 14, 15}), upsertStats, m)
+	tree.DeleteWithMetrics([]Felt{1, 2}, deleteStats, m)
+	tree.DeleteWithMetrics([]Felt{3}, &Stats{}, m)
+
+	text := strings.Builder{}
+	require.NoError(t, r.WriteText(&text))
+	lines := strings.Split(text.String(), "\n")
+	assert.Contains(t, lines, `bptree_batches_total{operation="delete"} 2`)
+	assert.Contains(t, lines, `bptree_batches_total{operation="upsert"} 1`)
+	assert.Contains(t, lines, `bptree_batch_size_sum{operation="delete"} 3`)
+	assert.Contains(t, lines, `bptree_batch_size_bucket{operation="upsert",le="1"} 0`)
+	assert.Contains(t, lines, `bptree_batch_size_bucket{operation="upsert",le="10"} 1`)
+	assert.Contains(t, lines, `bptree_operation_duration_seconds_count{operation="delete"} 2`)
+	assert.Contains(t, lines, fmt.Sprintf(`bptree_exposed_nodes_total{operation="upsert"} %d`, upsertStats.ExposedCount))
+	assert.Contains(t, lines, fmt.Sprintf(`bptree_created_nodes_total{operation="upsert"} %d`, upsertStats.CreatedCount))
+	assert.Contains(t, lines, fmt.Sprintf(`bptree_closing_hashes_total{operation="upsert"} %d`, upsertStats.ClosingHashes))
+	assert.Contains(t, lines, fmt.Sprintf("bptree_tree_height %d", tree.Height()))
+	assert.Contains(t, lines, "bptree_tree_keys 12")
+	assert.NotZero(t, deleteStats.RehashedCount)
+}
@@ -2,8 +2,8 @@ package cairo_bptree
 
 import (
 	"fmt"
+	"sort"
 	"strings"
-	"unsafe"
 )
 
 type Keys []Felt
@@ -48,6 +48,10 @@ func (kv KeyValues) Swap(i, j int) {
 	kv.values[i], kv.values[j] = kv.values[j], kv.values[i]
 }
 
+func (kv KeyValues) clone() KeyValues {
+	return KeyValues{append(make([]*Felt, 0, len(kv.keys)), kv.keys...), append(make([]*Felt, 0, len(kv.values)), kv.values...)}
+}
+
 func (kv KeyValues) String() string {
 	b := strings.Builder{}
 	for i, k := range kv.keys {
@@ -61,16 +65,44 @@ func (kv KeyValues) String() string {
 }
 
 type Node23 struct {
-	isLeaf   bool
-	children []*Node23
-	keys     []*Felt
-	values   []*Felt
-	exposed  bool
-	updated  bool
+	isLeaf    bool
+	children  []*Node23
+	keys      []Felt
+	values    []Felt
+	noNextKey bool // the next key, last of keys in leaves and pruned subtrees, is missing as in the last leaf
+	exposed   bool
+	updated   bool
+	created   bool
+	hash      []byte // only set for pruned subtrees rebuilt from a witness
+	size      int    // number of keys in subtree, next keys excluded
+	leaves    int    // number of non-empty leaves in subtree
+	// Inline storage backing children, keys and values up to the size of a valid node (2 keys plus next key
+	// in leaves), so that a node costs one allocation. Overflowing nodes during batches spill to the heap.
+	childArray [3]*Node23
+	keyArray   [3]Felt
+	valueArray [3]Felt
+}
+
+// IsLeaf reports whether n is a leaf, for observers: nodes must not be changed outside the tree.
+func (n *Node23) IsLeaf() bool {
+	return n.isLeaf
+}
+
+// KeyCount returns the number of keys in n, the next key of leaves excluded.
+func (n *Node23) KeyCount() int {
+	if (n.isLeaf || n.isPruned()) && n.keyCount() > 0 {
+		return n.keyCount() - 1
+	}
+	return n.keyCount()
+}
+
+// Keys returns a copy of the keys in n, the next key of leaves excluded: the separators for internal nodes.
+func (n *Node23) Keys() []Felt {
+	return append(make([]Felt, 0, n.KeyCount()), n.keys[:n.KeyCount()]...)
 }
 
 func (n *Node23) String() string {
-	s := fmt.Sprintf("{%p isLeaf=%t keys=%v-%v children=[", n, n.isLeaf, deref(n.keys), n.keys)
+	s := fmt.Sprintf("{%p isLeaf=%t keys=%v noNextKey=%t children=[", n, n.isLeaf, n.keys, n.noNextKey)
 	for i, child := range n.children {
 		s += fmt.Sprintf("%p", child)
 		if i != len(n.children)-1 {
@@ -81,29 +113,56 @@ func (n *Node23) String() string {
 	return s
 }
 
-func makeInternalNode(children []*Node23, keys []*Felt, stats *Stats) *Node23 {
+func (n *Node23) clone() *Node23 {
+	clone := *n
+	return clone.setSlices(n.children, n.keys, n.values)
+}
+
+// deepClone copies all the nodes in the subtree.
+func (n *Node23) deepClone() *Node23 {
+	if n == nil {
+		return nil
+	}
+	clone := n.clone()
+	for i, child := range clone.children {
+		clone.children[i] = child.deepClone()
+	}
+	return clone
+}
+
+func makeInternalNode(children []*Node23, keys []Felt, stats *Stats) *Node23 {
 	stats.CreatedCount++
-	n := &Node23{isLeaf: false, children: children, keys: keys, values: make([]*Felt, 0), exposed: true, updated: true}
+	n := stats.newNode()
+	*n = Node23{isLeaf: false, exposed: true, updated: true, created: true}
+	n.setSlices(children, keys, nil)
+	stats.nodeCreated(n)
 	return n
 }
 
-func makeLeafNode(keys, values []*Felt, stats *Stats) *Node23 {
+// makeLeafNode creates a leaf whose last key is the next key, missing if noNextKey.
+func makeLeafNode(keys, values []Felt, noNextKey bool, stats *Stats) *Node23 {
 	ensure(len(keys) > 0, "number of keys is zero")
 	ensure(len(keys) == len(values), "keys and values have different cardinality")
 	stats.CreatedCount++
-	n := &Node23{isLeaf: true, children: make([]*Node23, 0), keys: keys, values: values, exposed: true, updated: true}
+	n := stats.newNode()
+	*n = Node23{isLeaf: true, noNextKey: noNextKey, exposed: true, updated: true, created: true}
+	n.setSlices(nil, keys, values)
+	stats.nodeCreated(n)
 	return n
 }
 
 func makeEmptyLeafNode() *Node23 {
-	// At least nil next key is always present
-	return makeLeafNode(make([]*Felt, 1), make([]*Felt, 1), &Stats{}) // do not count it into stats
+	// At least missing next key is always present
+	return makeLeafNode(make([]Felt, 1), make([]Felt, 1), true, &Stats{}) // do not count it into stats
 }
 
-func promote(nodes []*Node23, intermediateKeys []*Felt, stats *Stats) *Node23 {
+func promote(nodes []*Node23, intermediateKeys []Felt, stats *Stats) *Node23 {
+	// Promoted nodes lie above the current level
+	stats.depth--
+	defer func() { stats.depth++ }()
 	if len(nodes) > 3 {
 		promotedNodes := make([]*Node23, 0)
-		promotedKeys := make([]*Felt, 0)
+		promotedKeys := make([]Felt, 0)
 		for len(nodes) > 3 {
 			promotedNodes = append(promotedNodes, makeInternalNode(nodes[:2], intermediateKeys[:1], stats))
 			nodes = nodes[2:]
@@ -114,6 +173,7 @@ func promote(nodes []*Node23, intermediateKeys []*Felt, stats *Stats) *Node23 {
 		return promote(promotedNodes, promotedKeys, stats)
 	} else {
 		promotedRoot := makeInternalNode(nodes, intermediateKeys, stats)
+		stats.promote(promotedRoot)
 		return promotedRoot
 	}
 }
@@ -121,6 +181,7 @@ func promote(nodes []*Node23, intermediateKeys []*Felt, stats *Stats) *Node23 {
 func (n *Node23) reset() {
 	n.exposed = false
 	n.updated = false
+	n.created = false
 	if !n.isLeaf {
 		for _, child := range n.children {
 			child.reset()
@@ -168,17 +229,16 @@ func (n *Node23) isValidInternal() (bool, error) {
 		for _, node := range subtree {
 			if !node.isLeaf {
 				if node != n && node.hasKey(key) {
-					return false, fmt.Errorf("internal key %d not unique", *key)
+					return false, fmt.Errorf("internal key %d not unique", key)
 				}
 				continue
 			}
-			leafNextKey := node.nextKey()
-			if leafNextKey != nil && *key == *leafNextKey {
+			if node.hasNextKey() && key == node.nextKey() {
 				hasNextKey = true
 			}
 		}
 		if !hasNextKey {
-			return false, fmt.Errorf("internal key %d not present in next keys", *key)
+			return false, fmt.Errorf("internal key %d not present in next keys", key)
 		}
 	}
 	// Check that leaves in subtree are chained together (next key -> first key)
@@ -191,7 +251,7 @@ func (n *Node23) isValidInternal() (bool, error) {
 			previous, next := subtree[i], subtree[i+1]
 			if previous.isLeaf && next.isLeaf {
 				// Previous node's next key must be equal to next node's first key
-				if previous.nextKey() != next.firstKey() {
+				if !previous.hasNextKey() || previous.nextKey() != next.firstKey() {
 					return false, fmt.Errorf("nodes %v and %v not chained by next key", previous, next)
 				}
 			}
@@ -209,6 +269,25 @@ func (n *Node23) isValidInternal() (bool, error) {
 	return true, nil
 }
 
+// updateSize recomputes the subtree key and leaf counts, descending just into the nodes touched since the last reset.
+func (n *Node23) updateSize() {
+	if n.isPruned() || !n.exposed && !n.updated {
+		return
+	}
+	n.size, n.leaves = 0, 0
+	if n.isLeaf {
+		if n.keyCount() > 1 {
+			n.size, n.leaves = n.keyCount()-1, 1
+		}
+		return
+	}
+	for _, child := range n.children {
+		child.updateSize()
+		n.size += child.size
+		n.leaves += child.leaves
+	}
+}
+
 func (n *Node23) keyCount() int {
 	return len(n.keys)
 }
@@ -221,12 +300,12 @@ func (n *Node23) valueCount() int {
 	return len(n.values)
 }
 
-func (n *Node23) firstKey() *Felt {
+func (n *Node23) firstKey() Felt {
 	ensure(len(n.keys) > 0, "firstKey: node has no key")
 	return n.keys[0]
 }
 
-func (n *Node23) firstValue() *Felt {
+func (n *Node23) firstValue() Felt {
 	ensure(len(n.values) > 0, "firstValue: node has no value")
 	return n.values[0]
 }
@@ -240,10 +319,10 @@ func (n *Node23) firstLeaf() *Node23 {
 	if n.isLeaf {
 		return n
 	}
-	firstLeaf := n.firstChild()
-	for !firstLeaf.isLeaf {
-		firstLeaf = firstLeaf.firstChild()
+	if n.isPruned() {
+		return n.prunedLeaf()
 	}
+	firstLeaf := n.firstChild().firstLeaf()
 	ensure(firstLeaf.isLeaf, "firstLeaf: last is not leaf")
 	return firstLeaf
 }
@@ -257,51 +336,136 @@ func (n *Node23) lastLeaf() *Node23 {
 	if n.isLeaf {
 		return n
 	}
-	lastLeaf := n.lastChild()
-	for !lastLeaf.isLeaf {
-		lastLeaf = lastLeaf.lastChild()
+	if n.isPruned() {
+		return n.prunedLeaf()
 	}
+	lastLeaf := n.lastChild().lastLeaf()
 	ensure(lastLeaf.isLeaf, "lastLeaf: last is not leaf")
 	return lastLeaf
 }
 
-func (n *Node23) nextKey() *Felt {
+func (n *Node23) isPruned() bool {
+	return n.hash != nil
+}
+
+func (n *Node23) prunedLeaf() *Node23 {
+	ensure(n.isPruned(), "prunedLeaf: node is not pruned")
+	// Pruned subtrees keep just first key and next key, enough to act as both first and last leaf
+	return &Node23{isLeaf: true, keys: n.keys, values: make([]Felt, len(n.keys)), noNextKey: n.noNextKey}
+}
+
+func (n *Node23) hasNextKey() bool {
+	return !n.noNextKey
+}
+
+// nextKey returns the next key, zero if missing.
+func (n *Node23) nextKey() Felt {
 	ensure(len(n.keys) > 0, "nextKey: node has no key")
 	return n.keys[len(n.keys)-1]
 }
 
-func (n *Node23) nextValue() *Felt {
-	ensure(len(n.values) > 0, "nextValue: node has no value")
-	return n.values[len(n.values)-1]
+// nextKeyOrNil returns a copy of the next key, nil if missing.
+func (n *Node23) nextKeyOrNil() *Felt {
+	if !n.hasNextKey() {
+		return nil
+	}
+	nextKey := n.nextKey()
+	return &nextKey
 }
 
-func (n *Node23) rawPointer() uintptr {
-	return uintptr(unsafe.Pointer(n))
+// nextKeyIs tells if the next key is key, nil meaning missing.
+func (n *Node23) nextKeyIs(key *Felt) bool {
+	if key == nil {
+		return !n.hasNextKey()
+	}
+	return n.hasNextKey() && n.nextKey() == *key
+}
+
+func (n *Node23) nextValue() Felt {
+	ensure(len(n.values) > 0, "nextValue: node has no value")
+	return n.values[len(n.values)-1]
 }
 
+// setNextKey sets the next key, nil meaning missing.
 func (n *Node23) setNextKey(nextKey *Felt, stats *Stats) {
 	ensure(len(n.keys) > 0, "setNextKey: node has no key")
-	n.keys[len(n.keys)-1] = nextKey
+	if nextKey == nil {
+		n.keys[len(n.keys)-1], n.noNextKey = 0, true
+	} else {
+		n.keys[len(n.keys)-1], n.noNextKey = *nextKey, false
+	}
+	// Next key can change in any leaf, which are all at the same depth
+	depth := stats.depth
+	stats.depth = stats.leafDepth
 	if !n.exposed {
 		n.exposed = true
 		stats.ExposedCount++
 		stats.OpeningHashes += n.howManyHashes()
+		stats.nodeExposed(n)
 	}
 	n.updated = true
 	stats.UpdatedCount++
+	stats.nodeUpdated(n)
+	stats.nextKeyChanged(n, nextKey)
+	stats.depth = depth
 }
 
 func (n *Node23) canonicalKeys() []Felt {
 	if n.isLeaf {
 		ensure(len(n.keys) > 0, "canonicalKeys: node has no key")
-		return deref(n.keys[:len(n.keys)-1])
+		return append(make([]Felt, 0, len(n.keys)-1), n.keys[:len(n.keys)-1]...)
 	} else {
-		return deref(n.keys[:])
+		return append(make([]Felt, 0, len(n.keys)), n.keys...)
+	}
+}
+
+// lastKey returns the greatest key in the subtree.
+func (n *Node23) lastKey() Felt {
+	lastLeaf := n.lastLeaf()
+	ensure(lastLeaf.keyCount() > 1, "lastKey: last leaf has no key")
+	return lastLeaf.keys[lastLeaf.keyCount()-2]
+}
+
+func (n *Node23) keysInRange(from, to Felt) []Felt {
+	ensure(n.isLeaf, "keysInRange: node is not leaf")
+	keys := make([]Felt, 0)
+	for _, key := range n.keys[:len(n.keys)-1] {
+		if key >= from && key <= to {
+			keys = append(keys, key)
+		}
 	}
+	return keys
 }
 
-func (n *Node23) hasKey(targetKey *Felt) bool {
-	var keys []*Felt
+// collectRange appends copies of the pairs between from and to in the subtree, child i holding the keys less
+// than keys[i] and not less than keys[i-1].
+func (n *Node23) collectRange(from, to Felt, kvItems *KeyValues) {
+	if n.isLeaf {
+		for i := 0; i < n.keyCount()-1; i++ {
+			if key, value := n.keys[i], n.values[i]; key >= from && key <= to {
+				kvItems.keys, kvItems.values = append(kvItems.keys, &key), append(kvItems.values, &value)
+			}
+		}
+		return
+	}
+	for i, child := range n.children {
+		if i > 0 && n.keys[i-1] > to {
+			break
+		}
+		if i < len(n.keys) && n.keys[i] <= from {
+			continue
+		}
+		child.collectRange(from, to, kvItems)
+	}
+}
+
+func (n *Node23) childIndex(key Felt) int {
+	ensure(!n.isLeaf, "childIndex: node is leaf")
+	return sort.Search(len(n.keys), func(i int) bool { return key < n.keys[i] })
+}
+
+func (n *Node23) hasKey(targetKey Felt) bool {
+	var keys []Felt
 	if n.isLeaf {
 		ensure(len(n.keys) > 0, "hasKey: node has no key")
 		keys = n.keys[:len(n.keys)-1]
@@ -309,7 +473,7 @@ func (n *Node23) hasKey(targetKey *Felt) bool {
 		keys = n.keys[:]
 	}
 	for _, key := range keys {
-		if *key == *targetKey {
+		if key == targetKey {
 			return true
 		}
 	}
@@ -317,6 +481,9 @@ func (n *Node23) hasKey(targetKey *Felt) bool {
 }
 
 func (n *Node23) isEmpty() bool {
+	if n.isPruned() {
+		return false
+	}
 	if n.isLeaf {
 		// At least next key is always present
 		return n.keyCount() == 1
@@ -325,6 +492,13 @@ func (n *Node23) isEmpty() bool {
 	}
 }
 
+func (n *Node23) updateSeparators() {
+	n.keys = make([]Felt, 0, n.childrenCount()-1)
+	for _, child := range n.children[:n.childrenCount()-1] {
+		n.keys = append(n.keys, child.lastLeaf().nextKey())
+	}
+}
+
 func (n *Node23) height() int {
 	if n.isLeaf {
 		return 1
@@ -384,15 +558,13 @@ func (n *Node23) howManyHashes() uint {
 		// last leaf: 1 or 2 keys + 1 or 2 values => 2 or 4 data => 1 or 3 hashes
 		switch n.keyCount() {
 		case 2:
-			nextKey := n.keys[1]
-			if nextKey == nil {
+			if !n.hasNextKey() {
 				return 1
 			} else {
 				return 2
 			}
 		case 3:
-			nextKey := n.keys[2]
-			if nextKey == nil {
+			if !n.hasNextKey() {
 				return 3
 			} else {
 				return 4
@@ -416,6 +588,9 @@ func (n *Node23) howManyHashes() uint {
 }
 
 func (n *Node23) hashNode() []byte {
+	if n.isPruned() {
+		return n.hash
+	}
 	if n.isLeaf {
 		return n.hashLeaf()
 	} else {
@@ -428,22 +603,22 @@ func (n *Node23) hashLeaf() []byte {
 	ensure(n.valueCount() == n.keyCount(), "hashLeaf: insufficient number of values")
 	switch n.keyCount() {
 	case 2:
-		k, nextKey, v := *n.keys[0], n.keys[1], *n.values[0]
+		k, nextKey, v := n.keys[0], n.keys[1], n.values[0]
 		h := hash2(k.Binary(), v.Binary())
-		if nextKey == nil {
+		if !n.hasNextKey() {
 			return h
 		} else {
-			return hash2(h, (*nextKey).Binary())
+			return hash2(h, nextKey.Binary())
 		}
 	case 3:
-		k1, k2, nextKey, v1, v2 := *n.keys[0], *n.keys[1], n.keys[2], *n.values[0], *n.values[1]
+		k1, k2, nextKey, v1, v2 := n.keys[0], n.keys[1], n.keys[2], n.values[0], n.values[1]
 		h1 := hash2(k1.Binary(), v1.Binary())
 		h2 := hash2(k2.Binary(), v2.Binary())
 		h12 := hash2(h1, h2)
-		if nextKey == nil {
+		if !n.hasNextKey() {
 			return h12
 		} else {
-			return hash2(h12, (*nextKey).Binary())
+			return hash2(h12, nextKey.Binary())
 		}
 	default:
 		ensure(false, fmt.Sprintf("hashLeaf: unexpected keyCount=%d\n", n.keyCount()))
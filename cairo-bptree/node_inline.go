@@ -0,0 +1,12 @@
+//go:build !separateslices
+// +build !separateslices
+
+package cairo_bptree
+
+// setSlices copies children, keys and values into the inline arrays of n and returns n.
+func (n *Node23) setSlices(children []*Node23, keys, values []Felt) *Node23 {
+	n.children = append(n.childArray[:0], children...)
+	n.keys = append(n.keyArray[:0], keys...)
+	n.values = append(n.valueArray[:0], values...)
+	return n
+}
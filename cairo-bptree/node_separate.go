@@ -0,0 +1,13 @@
+//go:build separateslices
+// +build separateslices
+
+package cairo_bptree
+
+// setSlices allocates children, keys and values apart from n as the former layout did, just to compare
+// the two layouts in benchmarks (go test -tags separateslices).
+func (n *Node23) setSlices(children []*Node23, keys, values []Felt) *Node23 {
+	n.children = append(make([]*Node23, 0, len(children)), children...)
+	n.keys = append(make([]Felt, 0, len(keys)), keys...)
+	n.values = append(make([]Felt, 0, len(values)), values...)
+	return n
+}
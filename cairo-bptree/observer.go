@@ -0,0 +1,83 @@
+package cairo_bptree
+
+// Observer is notified of the structural events happening while Tree23 applies a batch. Height is the level of
+// the event above the leaves, which are at height 0, as it was in the tree the batch started from: promoted roots
+// are above the old root, a demoted root is reported at the level of the root it replaces.
+type Observer interface {
+	NodeExposed(node *Node23, height int)
+	NodeCreated(node *Node23, height int)
+	NodeUpdated(node *Node23, height int)
+	LeafSplit(leaf *Node23, newLeaves []*Node23, height int)
+	NodesMerged(left, right *Node23, height int)
+	Promote(root *Node23, height int)
+	Demote(root *Node23, height int)
+	NextKeyChanged(leaf *Node23, nextKey *Felt, height int)
+}
+
+// NopObserver ignores any event: embed it to observe just some events.
+type NopObserver struct{}
+
+func (NopObserver) NodeExposed(node *Node23, height int)                    {}
+func (NopObserver) NodeCreated(node *Node23, height int)                    {}
+func (NopObserver) NodeUpdated(node *Node23, height int)                    {}
+func (NopObserver) LeafSplit(leaf *Node23, newLeaves []*Node23, height int) {}
+func (NopObserver) NodesMerged(left, right *Node23, height int)             {}
+func (NopObserver) Promote(root *Node23, height int)                        {}
+func (NopObserver) Demote(root *Node23, height int)                         {}
+func (NopObserver) NextKeyChanged(leaf *Node23, nextKey *Felt, height int)  {}
+
+// height returns the level above the leaves of the current recursion step.
+func (s *Stats) height() int {
+	return s.leafDepth - s.depth
+}
+
+func (s *Stats) nodeExposed(n *Node23) {
+	s.flagged = append(s.flagged, n)
+	if s.observer != nil {
+		s.observer.NodeExposed(n, s.height())
+	}
+}
+
+func (s *Stats) nodeCreated(n *Node23) {
+	s.flagged = append(s.flagged, n)
+	if s.observer != nil {
+		s.observer.NodeCreated(n, s.height())
+	}
+}
+
+func (s *Stats) nodeUpdated(n *Node23) {
+	s.flagged = append(s.flagged, n)
+	if s.observer != nil {
+		s.observer.NodeUpdated(n, s.height())
+	}
+}
+
+func (s *Stats) leafSplit(leaf *Node23, newLeaves []*Node23) {
+	if s.observer != nil {
+		s.observer.LeafSplit(leaf, newLeaves, s.height())
+	}
+}
+
+func (s *Stats) nodesMerged(left, right *Node23) {
+	if s.observer != nil {
+		s.observer.NodesMerged(left, right, s.height())
+	}
+}
+
+func (s *Stats) promote(root *Node23) {
+	if s.observer != nil {
+		s.observer.Promote(root, s.height())
+	}
+}
+
+func (s *Stats) demote(root *Node23) {
+	if s.observer != nil {
+		s.observer.Demote(root, s.height())
+	}
+}
+
+func (s *Stats) nextKeyChanged(leaf *Node23, nextKey *Felt) {
+	if s.observer != nil {
+		s.observer.NextKeyChanged(leaf, nextKey, s.height())
+	}
+}
@@ -0,0 +1,148 @@
+package cairo_bptree
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingObserver struct {
+	events     map[string][]int // heights by event name
+	leafEvents map[string][]int // heights by event name, just for leaves
+}
+
+func newRecordingObserver() *recordingObserver {
+	return &recordingObserver{events: make(map[string][]int), leafEvents: make(map[string][]int)}
+}
+
+func (o *recordingObserver) record(event string, node *Node23, height int) {
+	o.events[event] = append(o.events[event], height)
+	if node.isLeaf {
+		o.leafEvents[event] = append(o.leafEvents[event], height)
+	}
+}
+
+func (o *recordingObserver) NodeExposed(node *Node23, height int) { o.record("exposed", node, height) }
+func (o *recordingObserver) NodeCreated(node *Node23, height int) { o.record("created", node, height) }
+func (o *recordingObserver) NodeUpdated(node *Node23, height int) { o.record("updated", node, height) }
+func (o *recordingObserver) LeafSplit(leaf *Node23, newLeaves []*Node23, height int) {
+	o.record("split", leaf, height)
+}
+func (o *recordingObserver) NodesMerged(left, right *Node23, height int) {
+	o.record("merged", left, height)
+}
+func (o *recordingObserver) Promote(root *Node23, height int) { o.record("promote", root, height) }
+func (o *recordingObserver) Demote(root *Node23, height int)  { o.record("demote", root, height) }
+func (o *recordingObserver) NextKeyChanged(leaf *Node23, nextKey *Felt, height int) {
+	o.record("nextKey", leaf, height)
+}
+
+func TestObserverMatchesStats(t *testing.T) {
+	r := rand.New(rand.NewSource(29))
+	for i := 0; i < 200; i++ {
+		tree := NewTree23(randomKeyValues(r, r.Intn(256)))
+		observer := newRecordingObserver()
+		tree.SetObserver(observer)
+		stats := &Stats{}
+		if i%2 == 0 {
+			tree.UpsertWithStats(randomKeyValues(r, r.Intn(32)), stats)
+		} else {
+			tree.DeleteWithStats(randomKeys(r, r.Intn(64)), stats)
+		}
+		assert.Equal(t, int(stats.ExposedCount), len(observer.events["exposed"]), "iteration %d: exposed", i)
+		assert.Equal(t, int(stats.CreatedCount), len(observer.events["created"]), "iteration %d: created", i)
+		assert.Equal(t, int(stats.UpdatedCount), len(observer.events["updated"]), "iteration %d: updated", i)
+		assert.Nil(t, stats.observer, "observer still attached to stats")
+	}
+}
+
+func TestObserverUpsertEvents(t *testing.T) {
+	tree := NewTree23(K([]Felt{10, 20}))
+	observer := newRecordingObserver()
+	tree.SetObserver(observer)
+	tree.Upsert(K([]Felt{1, 2, 3}))
+	assert.Equal(t, []int{0}, observer.events["split"], "split leaf is the root")
+	assert.Equal(t, []int{1}, observer.events["promote"], "promoted root above old root")
+	assert.Contains(t, observer.events["created"], 1, "no node created above old root")
+
+	tree = NewTree23(K([]Felt{1, 2, 3, 10, 20}))
+	observer = newRecordingObserver()
+	tree.SetObserver(observer)
+	height := tree.Height()
+	tree.Upsert(K([]Felt{15}))
+	for _, exposedHeight := range observer.events["exposed"] {
+		assert.True(t, exposedHeight >= 0 && exposedHeight < height, "exposed height %d out of tree height %d", exposedHeight, height)
+	}
+	assert.NotEmpty(t, observer.leafEvents["exposed"], "no leaf exposed")
+	for _, leafHeight := range observer.leafEvents["exposed"] {
+		assert.Equal(t, 0, leafHeight, "leaf exposed out of leaf level")
+	}
+}
+
+func TestObserverDeleteEvents(t *testing.T) {
+	keys := []Felt{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	tree := NewTree23(K(keys))
+	observer := newRecordingObserver()
+	tree.SetObserver(observer)
+	tree.Delete([]Felt{3})
+	assert.Equal(t, []int{0}, observer.events["nextKey"], "next key not changed in leaf level")
+
+	tree = NewTree23(K(keys))
+	observer = newRecordingObserver()
+	tree.SetObserver(observer)
+	height := tree.Height()
+	tree.Delete([]Felt{1, 2})
+	assert.Equal(t, []int{height - 2}, observer.events["merged"], "merge not below root")
+
+	tree = NewTree23(K(keys))
+	observer = newRecordingObserver()
+	tree.SetObserver(observer)
+	tree.Delete([]Felt{1, 2, 3, 4, 5, 6, 7, 8})
+	assert.NotEmpty(t, observer.events["demote"], "no demote event")
+
+	tree.SetObserver(nil)
+	observer.events = make(map[string][]int)
+	tree.Delete([]Felt{9})
+	assert.Empty(t, observer.events, "events notified after observer removed")
+}
+
+func TestNopObserver(t *testing.T) {
+	type splitCounter struct {
+		NopObserver
+	}
+	tree := NewTree23(K([]Felt{1, 2, 3}))
+	tree.SetObserver(splitCounter{})
+	tree.Upsert(K([]Felt{4, 5, 6}))
+	valid, err := tree.IsValid()
+	assert.True(t, valid, "invalid tree: %v", err)
+}
+
+type splitObserver struct {
+	NopObserver
+	leafKeys, newLeafKeys [][]Felt
+}
+
+func (o *splitObserver) LeafSplit(leaf *Node23, newLeaves []*Node23, height int) {
+	o.leafKeys = append(o.leafKeys, leaf.Keys())
+	for _, newLeaf := range newLeaves {
+		o.newLeafKeys = append(o.newLeafKeys, newLeaf.Keys())
+	}
+}
+
+func TestObserverNodeAccessors(t *testing.T) {
+	tree := NewTree23(K([]Felt{10, 20}))
+	observer := &splitObserver{}
+	tree.SetObserver(observer)
+	tree.Upsert(K([]Felt{1, 2}))
+	assert.Equal(t, [][]Felt{{1, 2, 10, 20}}, observer.leafKeys, "split leaf keys")
+	assert.Equal(t, [][]Felt{{1, 2}, {10, 20}}, observer.newLeafKeys, "new leaves keys")
+
+	assert.True(t, tree.root.firstChild().IsLeaf())
+	assert.Equal(t, 2, tree.root.firstChild().KeyCount(), "next key counted")
+	assert.False(t, tree.root.IsLeaf())
+	assert.Equal(t, []Felt{10}, tree.root.Keys(), "root separators")
+	keys := tree.root.Keys()
+	keys[0] = 11
+	assert.Equal(t, []Felt{10}, tree.root.Keys(), "keys not copied")
+}
@@ -0,0 +1,189 @@
+package cairo_bptree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+const snapshotMagic = "BPT1"
+
+const (
+	emptyTag byte = iota
+	leafTag
+	internalTag
+)
+
+// Save writes the tree layout, not just its pairs, so that the loaded tree has the same root hash.
+func (t *Tree23) Save(w io.Writer) error {
+	return writeSnapshot(w, t, 0)
+}
+
+// Load reads a tree written by Save.
+func Load(r io.Reader) (*Tree23, error) {
+	tree, _, err := readSnapshot(r)
+	return tree, err
+}
+
+// writeSnapshot writes magic, sequence number of the last batch applied, canonical flag and nodes in pre-order,
+// followed by the CRC32 of all of them.
+func writeSnapshot(w io.Writer, t *Tree23, sequence uint64) error {
+	buffer := bytes.Buffer{}
+	buffer.WriteString(snapshotMagic)
+	binary.Write(&buffer, binary.BigEndian, sequence)
+	if t.canonical {
+		buffer.WriteByte(1)
+	} else {
+		buffer.WriteByte(0)
+	}
+	if t.root == nil {
+		buffer.WriteByte(emptyTag)
+	} else {
+		writeNode(&buffer, t.root)
+	}
+	binary.Write(&buffer, binary.BigEndian, crc32.ChecksumIEEE(buffer.Bytes()))
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
+
+// writeNode writes leaves as their pairs, next key excluded, and internal nodes as their children: next keys
+// and separators are rebuilt from the leaf order.
+func writeNode(buffer *bytes.Buffer, n *Node23) {
+	ensure(!n.isPruned(), "writeNode: cannot save pruned node")
+	if n.isLeaf {
+		buffer.WriteByte(leafTag)
+		buffer.WriteByte(byte(n.keyCount() - 1))
+		for i, key := range n.keys[:n.keyCount()-1] {
+			binary.Write(buffer, binary.BigEndian, uint64(key))
+			binary.Write(buffer, binary.BigEndian, uint64(n.values[i]))
+		}
+		return
+	}
+	buffer.WriteByte(internalTag)
+	buffer.WriteByte(byte(n.childrenCount()))
+	for _, child := range n.children {
+		writeNode(buffer, child)
+	}
+}
+
+func readSnapshot(r io.Reader) (tree *Tree23, sequence uint64, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < len(snapshotMagic)+8+1+1+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, 0, fmt.Errorf("snapshot: invalid header")
+	}
+	payload, checksum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, 0, fmt.Errorf("snapshot: invalid checksum")
+	}
+	reader := bufio.NewReader(bytes.NewReader(payload[len(snapshotMagic):]))
+	if err := binary.Read(reader, binary.BigEndian, &sequence); err != nil {
+		return nil, 0, err
+	}
+	canonical, err := reader.ReadByte()
+	if err != nil {
+		return nil, 0, err
+	}
+	tree = &Tree23{canonical: canonical == 1}
+	leaves, leafDepth := make([]*Node23, 0), -1
+	if tree.root, err = readNode(reader, &leaves, 0, &leafDepth); err != nil {
+		return nil, 0, err
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		return nil, 0, fmt.Errorf("snapshot: trailing bytes")
+	}
+	if err := linkLeaves(tree.root, leaves); err != nil {
+		return nil, 0, err
+	}
+	return tree, sequence, nil
+}
+
+// readNode reads a subtree appending its leaves to leaves, whose next keys are still missing, checking that
+// they all lie at leafDepth.
+func readNode(reader *bufio.Reader, leaves *[]*Node23, depth int, leafDepth *int) (*Node23, error) {
+	if depth > 64 {
+		return nil, fmt.Errorf("snapshot: tree too deep")
+	}
+	tag, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if tag == emptyTag && depth == 0 {
+		return nil, nil
+	}
+	count, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case leafTag:
+		if count < 1 || count > 2 {
+			return nil, fmt.Errorf("snapshot: invalid %d keys in leaf", count)
+		}
+		if *leafDepth >= 0 && *leafDepth != depth {
+			return nil, fmt.Errorf("snapshot: leaves at depth %d and %d", *leafDepth, depth)
+		}
+		*leafDepth = depth
+		keys, values := make([]Felt, count+1), make([]Felt, count+1)
+		for i := 0; i < int(count); i++ {
+			var pair [2]Felt
+			if err := binary.Read(reader, binary.BigEndian, pair[:]); err != nil {
+				return nil, err
+			}
+			keys[i], values[i] = pair[0], pair[1]
+		}
+		leaf := (&Node23{isLeaf: true, noNextKey: true, size: int(count), leaves: 1}).setSlices(nil, keys, values)
+		*leaves = append(*leaves, leaf)
+		return leaf, nil
+	case internalTag:
+		if count < 2 || count > 3 {
+			return nil, fmt.Errorf("snapshot: invalid %d children in internal node", count)
+		}
+		n := (&Node23{}).setSlices(nil, nil, nil)
+		for i := 0; i < int(count); i++ {
+			child, err := readNode(reader, leaves, depth+1, leafDepth)
+			if err != nil {
+				return nil, err
+			}
+			n.children = append(n.children, child)
+			n.size += child.size
+			n.leaves += child.leaves
+		}
+		return n, nil
+	default:
+		return nil, fmt.Errorf("snapshot: invalid node tag %d", tag)
+	}
+}
+
+// linkLeaves points each leaf to the first key and value of the following one, then sets the separators.
+func linkLeaves(root *Node23, leaves []*Node23) error {
+	var previousKey Felt
+	for i, leaf := range leaves {
+		for j, key := range leaf.keys[:leaf.keyCount()-1] {
+			if (i > 0 || j > 0) && key <= previousKey {
+				return fmt.Errorf("snapshot: key %d not greater than previous key %d", key, previousKey)
+			}
+			previousKey = key
+		}
+		if i < len(leaves)-1 {
+			next := leaves[i+1]
+			leaf.keys[leaf.keyCount()-1], leaf.values[leaf.valueCount()-1] = next.firstKey(), next.firstValue()
+			leaf.noNextKey = false
+		}
+	}
+	if root != nil {
+		root.walkPostOrder(func(n *Node23) interface{} {
+			if !n.isLeaf {
+				n.updateSeparators()
+			}
+			return nil
+		})
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package cairo_bptree
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveLoad(t *testing.T) {
+	r := rand.New(rand.NewSource(41))
+	for i := 0; i < 200; i++ {
+		tree := NewTree23(randomKeyValues(r, r.Intn(256)))
+		if i%2 == 0 {
+			tree.DeleteWithStats(randomKeys(r, r.Intn(64)), &Stats{})
+		}
+		if i%5 == 0 {
+			tree = NewCanonicalTree23(tree.KeyValues())
+		}
+		buffer := bytes.Buffer{}
+		require.NoError(t, tree.Save(&buffer), "iteration %d", i)
+		loaded, err := Load(&buffer)
+		require.NoError(t, err, "iteration %d", i)
+		valid, err := loaded.IsValid()
+		require.True(t, valid, "iteration %d: invalid tree: %v", i, err)
+		require.Equal(t, tree.IsCanonical(), loaded.IsCanonical(), "iteration %d: different canonical flag", i)
+		require.Equal(t, tree.WalkKeysPostOrder(), loaded.WalkKeysPostOrder(), "iteration %d: different keys", i)
+		require.Equal(t, tree.RootHash(), loaded.RootHash(), "iteration %d: different root hash", i)
+		require.Equal(t, tree.Len(), loaded.Len(), "iteration %d: different length", i)
+	}
+}
+
+func TestLoadCorrupted(t *testing.T) {
+	buffer := bytes.Buffer{}
+	require.NoError(t, NewTree23(K([]Felt{1, 2, 3, 4, 5})).Save(&buffer))
+	data := buffer.Bytes()
+	for i := range data {
+		corrupted := append([]byte{}, data...)
+		corrupted[i] ^= 0x01
+		_, err := Load(bytes.NewReader(corrupted))
+		assert.Error(t, err, "corrupted byte %d not detected", i)
+	}
+	_, err := Load(bytes.NewReader(data[:len(data)-1]))
+	assert.Error(t, err, "truncated snapshot not detected")
+}
@@ -0,0 +1,82 @@
+package cairo_bptree
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LevelProfile describes the nodes lying at one level of the tree.
+type LevelProfile struct {
+	TwoNodes     int // internal nodes having 2 children
+	ThreeNodes   int // internal nodes having 3 children
+	OneKeyLeaves int // leaves holding 1 key, next key excluded
+	TwoKeyLeaves int // leaves holding 2 keys, next key excluded
+	Exposed      int
+	Created      int
+	Updated      int
+	FillFactor   float64 // children or keys held over the maximum the nodes can hold
+}
+
+// Profile describes the shape of the tree level by level, root level first. Exposed, created and updated counts
+// include just the nodes flagged by the last batch.
+type Profile struct {
+	Height     int
+	FillFactor float64
+	Levels     []LevelProfile
+}
+
+func (t *Tree23) Profile() Profile {
+	profile := Profile{Height: t.Height(), Levels: make([]LevelProfile, 0, t.Height())}
+	used, capacity := 0, 0
+	for level := []*Node23{t.root}; t.root != nil && len(level) > 0; {
+		levelProfile, levelUsed, levelCapacity := LevelProfile{}, 0, 0
+		nextLevel := make([]*Node23, 0)
+		for _, n := range level {
+			if n.isLeaf {
+				switch n.keyCount() - 1 {
+				case 1:
+					levelProfile.OneKeyLeaves++
+				case 2:
+					levelProfile.TwoKeyLeaves++
+				}
+				levelUsed, levelCapacity = levelUsed+n.keyCount()-1, levelCapacity+2
+			} else {
+				switch n.childrenCount() {
+				case 2:
+					levelProfile.TwoNodes++
+				case 3:
+					levelProfile.ThreeNodes++
+				}
+				levelUsed, levelCapacity = levelUsed+n.childrenCount(), levelCapacity+3
+				nextLevel = append(nextLevel, n.children...)
+			}
+			if n.exposed {
+				levelProfile.Exposed++
+			}
+			if n.created {
+				levelProfile.Created++
+			}
+			if n.updated {
+				levelProfile.Updated++
+			}
+		}
+		levelProfile.FillFactor = float64(levelUsed) / float64(levelCapacity)
+		profile.Levels = append(profile.Levels, levelProfile)
+		used, capacity = used+levelUsed, capacity+levelCapacity
+		level = nextLevel
+	}
+	if capacity > 0 {
+		profile.FillFactor = float64(used) / float64(capacity)
+	}
+	return profile
+}
+
+func (p Profile) String() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "height=%d fillFactor=%.3f", p.Height, p.FillFactor)
+	for i, level := range p.Levels {
+		fmt.Fprintf(&b, "\nlevel=%d 2-nodes=%d 3-nodes=%d 1-key-leaves=%d 2-key-leaves=%d exposed=%d created=%d updated=%d fillFactor=%.3f",
+			i, level.TwoNodes, level.ThreeNodes, level.OneKeyLeaves, level.TwoKeyLeaves, level.Exposed, level.Created, level.Updated, level.FillFactor)
+	}
+	return b.String()
+}
@@ -0,0 +1,71 @@
+package cairo_bptree
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfile(t *testing.T) {
+	profile := NewEmptyTree23().Profile()
+	assert.Equal(t, 0, profile.Height)
+	assert.Empty(t, profile.Levels)
+
+	profile = NewTree23(K([]Felt{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12})).Profile()
+	assert.Equal(t, 3, profile.Height)
+	assert.Equal(t, []LevelProfile{
+		{ThreeNodes: 1, FillFactor: 1},
+		{TwoNodes: 3, FillFactor: 2.0 / 3},
+		{TwoKeyLeaves: 6, FillFactor: 1},
+	}, profile.Levels)
+	assert.InDelta(t, 21.0/24, profile.FillFactor, 1e-9)
+}
+
+func TestProfileFlags(t *testing.T) {
+	r := rand.New(rand.NewSource(39))
+	for i := 0; i < 200; i++ {
+		tree, stats := NewTree23(randomKeyValues(r, r.Intn(256))), &Stats{}
+		if i%2 == 0 {
+			tree.UpsertWithStats(randomKeyValues(r, r.Intn(32)), stats)
+		} else {
+			tree.DeleteWithStats(randomKeys(r, r.Intn(64)), stats)
+		}
+		profile := tree.Profile()
+		require.Equal(t, tree.Height(), len(profile.Levels), "iteration %d: different number of levels", i)
+		exposed, updated, leaves, keys := 0, 0, 0, 0
+		for _, level := range profile.Levels {
+			exposed, updated = exposed+level.Exposed, updated+level.Updated
+			leaves, keys = leaves+level.OneKeyLeaves+level.TwoKeyLeaves, keys+level.OneKeyLeaves+2*level.TwoKeyLeaves
+			assert.LessOrEqual(t, level.Created, level.Exposed, "iteration %d: created node not exposed", i)
+		}
+		if i%2 == 0 {
+			assert.Equal(t, int(stats.RehashedCount), exposed, "iteration %d: different exposed count", i)
+		} else {
+			assert.Equal(t, int(stats.RehashedCount), updated, "iteration %d: different updated count", i)
+		}
+		assert.Equal(t, tree.Len(), keys, "iteration %d: different number of keys", i)
+		if tree.root != nil {
+			assert.Equal(t, tree.root.leaves, leaves, "iteration %d: different number of leaves", i)
+		}
+	}
+}
+
+func TestProfileLastBatch(t *testing.T) {
+	keys := []Felt{0, 2, 4, 6, 8, 10, 12, 14, 16, 18, 20, 22, 24, 26, 28, 30, 32, 34, 36, 38, 40}
+	values := append([]Felt{100}, keys[1:]...)
+	fresh, reused := NewTree23(KV(keys, values)), NewTree23(K(keys))
+	reused.Upsert(KV([]Felt{0}, []Felt{100}))
+	require.Equal(t, fresh.RootHash(), reused.RootHash())
+	stats := &Stats{}
+	fresh.UpsertWithStats(KV([]Felt{40}, []Felt{400}), &Stats{})
+	reused.UpsertWithStats(KV([]Felt{40}, []Felt{400}), stats)
+	assert.Equal(t, fresh.Profile(), reused.Profile(), "flags of previous batches counted")
+	assert.NotZero(t, stats.ExposedCount)
+
+	profile := reused.Profile()
+	reused.EstimateUpsert(K([]Felt{3, 41}))
+	reused.EstimateDelete([]Felt{2, 40})
+	assert.Equal(t, profile, reused.Profile(), "profile changed by estimate")
+}
@@ -0,0 +1,80 @@
+package cairo_bptree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Batch is a state transition: upserts are applied first, then deletes. Both must be sorted by key.
+type Batch struct {
+	Upserts KeyValues
+	Deletes []Felt
+}
+
+// NewBatch builds a batch from pairs and deletes given in any order, see NewKeyValues.
+func NewBatch(keys, values, deletes []Felt) (Batch, error) {
+	upserts, err := NewKeyValues(keys, values)
+	if err != nil {
+		return Batch{}, err
+	}
+	return Batch{Upserts: upserts, Deletes: sortedKeys(deletes)}, nil
+}
+
+func (t *Tree23) Apply(batch Batch) *Tree23 {
+	return t.ApplyWithStats(batch, &Stats{}, &Stats{})
+}
+
+func (t *Tree23) ApplyWithStats(batch Batch, upsertStats, deleteStats *Stats) *Tree23 {
+	if batch.Upserts.Len() > 0 {
+		t.UpsertWithStats(batch.Upserts, upsertStats)
+	}
+	if len(batch.Deletes) > 0 {
+		t.keepFlags(func() { t.DeleteWithStats(batch.Deletes, deleteStats) })
+	}
+	return t
+}
+
+// MultiProof returns the proof covering every key in batch, to be checked by ApplyWithProof. It fails on
+// canonical trees.
+func (t *Tree23) MultiProof(batch Batch) (*MultiProof, error) {
+	if err := t.checkNotCanonical("proof"); err != nil {
+		return nil, err
+	}
+	return newMultiProof(t.root, t.touchedByBatch(batch)), nil
+}
+
+// touchedByBatch returns the nodes read or modified applying batch. Deletes run on the upserted tree, so
+// their touched nodes are collected on a clone after upserts: the shared subtrees are the ones to open.
+func (t *Tree23) touchedByBatch(batch Batch) map[*Node23]bool {
+	if batch.Upserts.Len() == 0 {
+		return touchedNodes(t.root, batch.Deletes)
+	}
+	touched := touchedNodes(t.root, deref(batch.Upserts.keys))
+	if len(batch.Deletes) > 0 {
+		upserted := &Tree23{root: cloneTouched(t.root, touched)}
+		upserted.UpsertWithStats(batch.Upserts.clone(), &Stats{})
+		for n := range touchedNodes(upserted.root, batch.Deletes) {
+			touched[n] = true
+		}
+	}
+	return touched
+}
+
+// ApplyWithProof computes the root after batch starting from oldRoot, using just the proof instead of the full tree.
+func ApplyWithProof(oldRoot []byte, proof *MultiProof, batch Batch) (newRoot []byte, err error) {
+	root, err := proof.tree()
+	if err != nil {
+		return nil, err
+	}
+	t := &Tree23{root: root}
+	if proofRoot := t.RootHash(); !bytes.Equal(proofRoot, oldRoot) {
+		return nil, fmt.Errorf("proof root mismatch: expected %x got %x", oldRoot, proofRoot)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			newRoot, err = nil, fmt.Errorf("proof insufficient for batch: %v", r)
+		}
+	}()
+	t.Apply(Batch{batch.Upserts.clone(), batch.Deletes})
+	return t.RootHash(), nil
+}
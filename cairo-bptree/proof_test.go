@@ -0,0 +1,65 @@
+package cairo_bptree
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyWithProof(t *testing.T) {
+	r := rand.New(rand.NewSource(27))
+	for i := 0; i < 500; i++ {
+		tree := NewTree23(randomKeyValues(r, r.Intn(256)))
+		batch := Batch{randomKeyValues(r, r.Intn(32)), randomKeys(r, r.Intn(32))}
+		oldRoot := tree.RootHash()
+		proof, err := tree.MultiProof(batch)
+		require.NoError(t, err)
+		tree.Apply(Batch{batch.Upserts.clone(), batch.Deletes})
+		newRoot, err := ApplyWithProof(oldRoot, proof, batch)
+		require.NoError(t, err, "iteration %d batch %v", i, batch)
+		assert.Equal(t, tree.RootHash(), newRoot, "different new root")
+	}
+}
+
+func TestMultiProofDeduplicated(t *testing.T) {
+	tree := NewTree23(K([]Felt{0, 2, 4, 6, 8, 10, 12, 14, 16, 18, 20, 22, 24, 26, 28, 30, 32, 34, 36, 38, 40}))
+	single, err := tree.MultiProof(Batch{Upserts: K([]Felt{1})})
+	require.NoError(t, err)
+	double, err := tree.MultiProof(Batch{Upserts: K([]Felt{1, 3})})
+	require.NoError(t, err)
+	assert.Equal(t, len(single.Nodes), len(double.Nodes), "shared path opened twice")
+}
+
+func TestApplyWithProofWrongRoot(t *testing.T) {
+	tree := NewTree23(K([]Felt{1, 3, 5, 7, 9}))
+	batch := Batch{Upserts: K([]Felt{4})}
+	proof, err := tree.MultiProof(batch)
+	require.NoError(t, err)
+	_, err = ApplyWithProof(NewTree23(K([]Felt{1, 3})).RootHash(), proof, batch)
+	assert.Error(t, err, "proof accepted for wrong old root")
+}
+
+func TestApplyWithProofTamperedSeparator(t *testing.T) {
+	tree := NewTree23(K([]Felt{0, 2, 4, 6, 8, 10, 12, 14, 16, 18, 20, 22, 24, 26, 28, 30, 32, 34, 36, 38, 40}))
+	batch := Batch{Upserts: K([]Felt{1, 13}), Deletes: []Felt{30}}
+	proof, err := tree.MultiProof(batch)
+	require.NoError(t, err)
+	root := &proof.Nodes[proof.Root]
+	require.Equal(t, WitnessInternal, root.Kind)
+	root.Keys = append([]Felt{}, root.Keys...)
+	root.Keys[0]--
+	_, err = ApplyWithProof(tree.RootHash(), proof, batch)
+	assert.Error(t, err, "proof accepted with tampered separator")
+}
+
+func TestNewBatch(t *testing.T) {
+	batch, err := NewBatch([]Felt{5, 1, 5}, []Felt{50, 10, 51}, []Felt{9, 3, 9, 7})
+	require.NoError(t, err)
+	assert.Equal(t, []Felt{1, 5}, batch.Upserts.Keys())
+	assert.Equal(t, []Felt{10, 51}, batch.Upserts.Values())
+	assert.Equal(t, []Felt{3, 7, 9}, batch.Deletes)
+	_, err = NewBatch([]Felt{1}, []Felt{}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,75 @@
+package cairo_bptree
+
+import (
+	"bufio"
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func randomBytes(r *rand.Rand, size int) []byte {
+	b := make([]byte, size)
+	r.Read(b)
+	return b
+}
+
+func randomKeyValues(r *rand.Rand, size int) KeyValues {
+	return NewKeyBinaryFactory(1).NewUniqueKeyValues(bufio.NewReader(bytes.NewReader(randomBytes(r, size))))
+}
+
+func randomKeys(r *rand.Rand, size int) []Felt {
+	return NewKeyBinaryFactory(1).NewUniqueKeys(bufio.NewReader(bytes.NewReader(randomBytes(r, size))))
+}
+
+// randomTreeItems returns the pairs to build a random tree on, up to 255 keys.
+func randomTreeItems(r *rand.Rand) KeyValues {
+	return randomKeyValues(r, r.Intn(256))
+}
+
+// repeatRandom runs check the given number of iterations, all drawing from one source seeded with seed.
+func repeatRandom(seed int64, iterations int, check func(r *rand.Rand, i int)) {
+	r := rand.New(rand.NewSource(seed))
+	for i := 0; i < iterations; i++ {
+		check(r, i)
+	}
+}
+
+// applyRandomBatch upserts or deletes random keys in tree, tracking in state which keys are present.
+func applyRandomBatch(r *rand.Rand, tree *Tree23, state map[Felt]bool) {
+	if r.Intn(2) == 0 {
+		upserts := randomKeys(r, r.Intn(32))
+		for _, key := range upserts {
+			state[key] = true
+		}
+		tree.Upsert(K(upserts))
+	} else {
+		deletes := randomKeys(r, r.Intn(64))
+		for _, key := range deletes {
+			state[key] = false // builtin delete is shadowed in this package
+		}
+		tree.Delete(deletes)
+	}
+}
+
+// presentKeys returns the sorted keys present in state.
+func presentKeys(state map[Felt]bool) []Felt {
+	keys := make([]Felt, 0, len(state))
+	for key, present := range state {
+		if present {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// requireValidKeys checks that tree is a valid 2-3 tree holding exactly keys.
+func requireValidKeys(t *testing.T, tree *Tree23, keys []Felt, msgAndArgs ...interface{}) {
+	valid, err := tree.IsValid()
+	require.True(t, valid, "invalid tree: %v", err)
+	require.Equal(t, keys, tree.WalkKeysPostOrder(), msgAndArgs...)
+	require.Equal(t, len(keys), tree.Len(), msgAndArgs...)
+}
@@ -0,0 +1,66 @@
+package cairo_bptree
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requireOrderStatistics checks Len, Rank, Select, CountRange and Range against the sorted keys.
+func requireOrderStatistics(t *testing.T, tree *Tree23, keys []Felt, r *rand.Rand) {
+	require.Equal(t, len(keys), tree.Len(), "different length")
+	for i, key := range keys {
+		require.Equal(t, i, tree.Rank(key), "different rank of key %d", key)
+		selected, found := tree.Select(i)
+		require.True(t, found, "key with rank %d not found", i)
+		require.Equal(t, key, selected, "different key with rank %d", i)
+	}
+	_, found := tree.Select(len(keys))
+	assert.False(t, found, "key found out of range")
+	for i := 0; i < 10; i++ {
+		from, to := Felt(r.Intn(300)), Felt(r.Intn(300))
+		expected := make([]Felt, 0)
+		for _, key := range keys {
+			if key >= from && key <= to {
+				expected = append(expected, key)
+			}
+		}
+		require.Equal(t, len(expected), tree.CountRange(from, to), "different count in [%d, %d]", from, to)
+		kvItems := tree.Range(from, to)
+		require.Equal(t, expected, kvItems.Keys(), "different keys in [%d, %d]", from, to)
+		require.Equal(t, expected, kvItems.Values(), "different values in [%d, %d]", from, to)
+	}
+}
+
+func TestOrderStatistics(t *testing.T) {
+	repeatRandom(30, 200, func(r *rand.Rand, i int) {
+		kvItems := randomTreeItems(r)
+		state := make(map[Felt]bool)
+		for _, key := range kvItems.Keys() {
+			state[key] = true
+		}
+		tree := NewTree23(kvItems)
+		requireOrderStatistics(t, tree, presentKeys(state), r)
+		for j := 0; j < 5; j++ {
+			applyRandomBatch(r, tree, state)
+			requireValidKeys(t, tree, presentKeys(state), "iteration %d step %d: different keys", i, j)
+			requireOrderStatistics(t, tree, presentKeys(state), r)
+		}
+	})
+}
+
+func TestOrderStatisticsEmptyTree(t *testing.T) {
+	tree := NewEmptyTree23()
+	assert.Equal(t, 0, tree.Len())
+	assert.Equal(t, 0, tree.Rank(10))
+	assert.Equal(t, 0, tree.CountRange(0, 10))
+	assert.Equal(t, 0, tree.Range(0, 10).Len())
+	_, found := tree.Select(0)
+	assert.False(t, found)
+
+	tree = NewTree23(K([]Felt{1, 2, 3}))
+	tree.Delete([]Felt{1, 2, 3})
+	assert.Equal(t, 0, tree.Len())
+}
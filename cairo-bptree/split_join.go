@@ -0,0 +1,158 @@
+package cairo_bptree
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Split moves the keys lower than key into left and the other ones into right in O(log n), consuming the tree.
+// Canonical trees are repacked afterwards, which costs O(n).
+func (t *Tree23) Split(key Felt) (left, right *Tree23) {
+	left = &Tree23{canonical: t.canonical, observer: t.observer, arena: t.arena}
+	right = &Tree23{canonical: t.canonical, observer: t.observer, arena: t.arena}
+	if t.root == nil {
+		return left, right
+	}
+	stats := &Stats{arena: t.arena}
+	left.root, _, right.root, _ = split(t.root, t.root.height(), key, stats)
+	if left.root != nil {
+		// Just the last leaf of left can still point to a key moved into right
+		if lastLeaf := left.root.lastLeaf(); lastLeaf.hasNextKey() {
+			lastLeaf.setNextKey(nil, stats)
+		}
+	}
+	if t.canonical {
+		left.repack()
+		right.repack()
+	}
+	return left, right
+}
+
+// Join concatenates left and right in O(log n), consuming both: all keys in left must be lower than those in right,
+// otherwise an error is returned and both trees are left unchanged. Canonical trees are repacked afterwards, which costs O(n).
+func Join(left, right *Tree23) (*Tree23, error) {
+	if left.root != nil && right.root != nil && left.root.lastKey() >= right.root.firstLeaf().firstKey() {
+		return nil, fmt.Errorf("left last key %d not lower than right first key %d", left.root.lastKey(), right.root.firstLeaf().firstKey())
+	}
+	return joinTrees(left, right), nil
+}
+
+// joinTrees works as Join on trees already known to be ordered.
+func joinTrees(left, right *Tree23) *Tree23 {
+	if left.root == nil {
+		return right
+	}
+	if right.root == nil {
+		return left
+	}
+	boundary := right.root.firstLeaf().firstKey()
+	stats := &Stats{arena: left.arena}
+	left.root.lastLeaf().setNextKey(&boundary, stats)
+	root, _ := join(left.root, left.root.height(), right.root, right.root.height(), boundary, stats)
+	tree := &Tree23{root: root, canonical: left.canonical, observer: left.observer, arena: left.arena}
+	if tree.canonical {
+		tree.repack()
+	}
+	return tree
+}
+
+// split partitions the subtree n of the given height into the keys lower than key and the other ones. The leaf
+// chain is left untouched but for the new leaves, hence the last leaf of left can still point into right.
+func split(n *Node23, height int, key Felt, stats *Stats) (left *Node23, leftHeight int, right *Node23, rightHeight int) {
+	if n.isLeaf {
+		index := sort.Search(n.keyCount()-1, func(i int) bool { return n.keys[i] >= key })
+		if index > 0 {
+			keys := append(append(make([]Felt, 0, index+1), n.keys[:index]...), 0)
+			values := append(make([]Felt, 0, index+1), n.values[:index+1]...)
+			left = makeLeafNode(keys, values, true, stats)
+			left.size, left.leaves = index, 1
+		}
+		if index < n.keyCount()-1 {
+			keys := append(make([]Felt, 0, n.keyCount()-index), n.keys[index:]...)
+			values := append(make([]Felt, 0, n.valueCount()-index), n.values[index:]...)
+			right = makeLeafNode(keys, values, n.noNextKey, stats)
+			right.size, right.leaves = len(keys)-1, 1
+		}
+		return left, 1, right, 1
+	}
+
+	// Split the child containing key, then join back its siblings on both sides using their separators as boundaries
+	i := n.childIndex(key)
+	left, leftHeight, right, rightHeight = split(n.children[i], height-1, key, stats)
+	switch i {
+	case 1:
+		left, leftHeight = join(n.children[0], height-1, left, leftHeight, n.keys[0], stats)
+	case 2:
+		left, leftHeight = join(makeSizedNode(n.children[:2], n.keys[:1], stats), height, left, leftHeight, n.keys[1], stats)
+	}
+	switch n.childrenCount() - i - 1 {
+	case 1:
+		right, rightHeight = join(right, rightHeight, n.children[i+1], height-1, n.keys[i], stats)
+	case 2:
+		right, rightHeight = join(right, rightHeight, makeSizedNode(n.children[i+1:], n.keys[i+1:], stats), height, n.keys[i], stats)
+	}
+	return left, leftHeight, right, rightHeight
+}
+
+// join concatenates the subtrees left and right, whose leaves are already chained across boundary, the first
+// key of right. Its cost is proportional to the height difference.
+func join(left *Node23, leftHeight int, right *Node23, rightHeight int, boundary Felt, stats *Stats) (*Node23, int) {
+	if left == nil {
+		return right, rightHeight
+	}
+	if right == nil {
+		return left, leftHeight
+	}
+	nodes, separator := joinNodes(left, leftHeight, right, rightHeight, boundary, stats)
+	height := leftHeight
+	if rightHeight > height {
+		height = rightHeight
+	}
+	if len(nodes) == 1 {
+		return nodes[0], height
+	}
+	return makeSizedNode(nodes, []Felt{separator}, stats), height + 1
+}
+
+// joinNodes hangs the shorter subtree along the facing spine of the taller one, splitting the nodes that overflow.
+// It returns one or two nodes as high as the taller subtree and the separator between them.
+func joinNodes(left *Node23, leftHeight int, right *Node23, rightHeight int, boundary Felt, stats *Stats) ([]*Node23, Felt) {
+	switch {
+	case leftHeight > rightHeight:
+		nodes, separator := joinNodes(left.lastChild(), leftHeight-1, right, rightHeight, boundary, stats)
+		children := append(append(make([]*Node23, 0, 4), left.children[:left.childrenCount()-1]...), nodes...)
+		keys := append(make([]Felt, 0, 3), left.keys...)
+		if len(nodes) > 1 {
+			keys = append(keys, separator)
+		}
+		return makeJoinedNodes(children, keys, stats)
+	case leftHeight < rightHeight:
+		nodes, separator := joinNodes(left, leftHeight, right.firstChild(), rightHeight-1, boundary, stats)
+		children := append(append(make([]*Node23, 0, 4), nodes...), right.children[1:]...)
+		keys := make([]Felt, 0, 3)
+		if len(nodes) > 1 {
+			keys = append(keys, separator)
+		}
+		keys = append(keys, right.keys...)
+		return makeJoinedNodes(children, keys, stats)
+	default:
+		return []*Node23{left, right}, boundary
+	}
+}
+
+func makeJoinedNodes(children []*Node23, keys []Felt, stats *Stats) ([]*Node23, Felt) {
+	if len(children) <= 3 {
+		return []*Node23{makeSizedNode(children, keys, stats)}, 0
+	}
+	return []*Node23{makeSizedNode(children[:2], keys[:1], stats), makeSizedNode(children[2:], keys[2:], stats)}, keys[1]
+}
+
+// makeSizedNode creates an internal node on copies of children and keys, computing its key and leaf counts from the children.
+func makeSizedNode(children []*Node23, keys []Felt, stats *Stats) *Node23 {
+	n := makeInternalNode(append(make([]*Node23, 0, len(children)), children...), append(make([]Felt, 0, len(keys)), keys...), stats)
+	for _, child := range children {
+		n.size += child.size
+		n.leaves += child.leaves
+	}
+	return n
+}
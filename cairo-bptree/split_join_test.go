@@ -0,0 +1,98 @@
+package cairo_bptree
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitJoin(t *testing.T) {
+	repeatRandom(36, 1000, func(r *rand.Rand, i int) {
+		kvItems := randomTreeItems(r)
+		key := Felt(r.Intn(256))
+		leftKeys, rightKeys := make([]Felt, 0), make([]Felt, 0)
+		for _, k := range kvItems.Keys() {
+			if k < key {
+				leftKeys = append(leftKeys, k)
+			} else {
+				rightKeys = append(rightKeys, k)
+			}
+		}
+		rootHash := NewTree23(kvItems.clone()).RootHash()
+		left, right := NewTree23(kvItems.clone()).Split(key)
+		requireValidKeys(t, left, leftKeys, "iteration %d key %d: different left keys", i, key)
+		requireValidKeys(t, right, rightKeys, "iteration %d key %d: different right keys", i, key)
+
+		joined, err := Join(left, right)
+		require.NoError(t, err)
+		requireValidKeys(t, joined, kvItems.Keys(), "iteration %d key %d: different joined keys", i, key)
+		if len(leftKeys) == 0 || len(rightKeys) == 0 {
+			assert.Equal(t, rootHash, joined.RootHash(), "iteration %d key %d: tree changed by empty split", i, key)
+		}
+	})
+}
+
+func TestJoinBuiltTrees(t *testing.T) {
+	repeatRandom(37, 500, func(r *rand.Rand, i int) {
+		keys := make([]Felt, 0)
+		for key := Felt(0); key < 300; key++ {
+			if r.Intn(3) == 0 {
+				keys = append(keys, key)
+			}
+		}
+		boundary := r.Intn(len(keys) + 1)
+		joined, err := Join(NewTree23(K(keys[:boundary])), NewTree23(K(keys[boundary:])))
+		require.NoError(t, err)
+		requireValidKeys(t, joined, keys, "iteration %d boundary %d: different keys", i, boundary)
+
+		joined.Upsert(K([]Felt{300, 301}))
+		joined.Delete(keys[:len(keys)/2])
+		requireValidKeys(t, joined, append(append([]Felt{}, keys[len(keys)/2:]...), 300, 301), "iteration %d: different keys after batch", i)
+	})
+}
+
+func TestShardAndStitch(t *testing.T) {
+	r := rand.New(rand.NewSource(38))
+	kvItems, changes := randomKeyValues(r, 200), randomKeyValues(r, 64)
+	expected := NewCanonicalTree23(kvItems.clone()).Upsert(changes.clone())
+
+	// Split into shards, upsert each shard its changes and join them back
+	left, rest := NewCanonicalTree23(kvItems.clone()).Split(85)
+	middle, right := rest.Split(170)
+	for _, shard := range []struct {
+		tree     *Tree23
+		from, to Felt
+	}{{left, 0, 84}, {middle, 85, 169}, {right, 170, 255}} {
+		shardChanges := KeyValues{make([]*Felt, 0), make([]*Felt, 0)}
+		for j, key := range changes.keys {
+			if *key >= shard.from && *key <= shard.to {
+				shardChanges.keys = append(shardChanges.keys, key)
+				shardChanges.values = append(shardChanges.values, changes.values[j])
+			}
+		}
+		shard.tree.Upsert(shardChanges)
+	}
+	stitched, err := Join(left, middle)
+	require.NoError(t, err)
+	stitched, err = Join(stitched, right)
+	require.NoError(t, err)
+	requireValidKeys(t, stitched, expected.WalkKeysPostOrder(), "different stitched keys")
+	assert.True(t, stitched.IsCanonical())
+	assert.Equal(t, expected.RootHash(), stitched.RootHash(), "different stitched root hash")
+}
+
+func TestJoinOverlapping(t *testing.T) {
+	left, right := NewTree23(K([]Felt{1, 5})), NewTree23(K([]Felt{3, 7}))
+	leftHash, rightHash := left.RootHash(), right.RootHash()
+	_, err := Join(left, right)
+	assert.Error(t, err)
+	assert.Equal(t, leftHash, left.RootHash(), "left changed by failed join")
+	assert.Equal(t, rightHash, right.RootHash(), "right changed by failed join")
+	_, err = Join(NewTree23(K([]Felt{1, 3})), NewTree23(K([]Felt{3, 7})))
+	assert.Error(t, err, "joined trees sharing a key")
+	joined, err := Join(NewEmptyTree23(), NewTree23(K([]Felt{3, 7})))
+	require.NoError(t, err)
+	assert.Equal(t, 2, joined.Len())
+}
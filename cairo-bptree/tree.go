@@ -1,9 +1,16 @@
 package cairo_bptree
 
 import (
+	"encoding/hex"
 	"fmt"
+	"sync/atomic"
 )
 
+// batchVersion is the last version stamped on a tree by a batch
+var batchVersion uint64
+
+// Stats counts the nodes opened and closed by a batch. On canonical trees, RehashedCount and ClosingHashes count
+// the whole tree rebuilt by the repack after the batch, while the other counters describe the batch itself.
 type Stats struct {
 	ExposedCount  uint
 	RehashedCount uint
@@ -12,10 +19,21 @@ type Stats struct {
 	DeletedCount  uint
 	OpeningHashes uint
 	ClosingHashes uint
+	UndoLog       *UndoLog // if set, the batch records in it how to roll back
+	observer      Observer // set by Tree23 during a batch
+	depth         int
+	leafDepth     int
+	arena         *nodeArena // set by Tree23 during a batch
+	flagged       []*Node23  // nodes flagged exposed, created or updated during the batch
 }
 
 type Tree23 struct {
-	root *Node23
+	root      *Node23
+	canonical bool
+	observer  Observer
+	arena     *nodeArena
+	version   uint64    // unique to the last batch applied
+	flagged   []*Node23 // nodes flagged by the last batch, whose flags the next batch clears
 }
 
 func NewEmptyTree23() *Tree23 {
@@ -28,8 +46,34 @@ func NewTree23(kvItems KeyValues) *Tree23 {
 	return tree
 }
 
+// NewTree23WithArena builds a tree allocating its nodes in slabs, now and in any later batch.
+func NewTree23WithArena(kvItems KeyValues) *Tree23 {
+	tree := &Tree23{arena: &nodeArena{}}
+	tree.Upsert(kvItems)
+	tree.reset()
+	return tree
+}
+
+// NewCanonicalTree23 builds a tree whose layout, hence root hash, depends just on the key set and not on
+// the history of batches: the tree is repacked after each batch as if built from scratch. Witnesses and
+// proofs would describe the batch before repacking, so they are refused on canonical trees.
+func NewCanonicalTree23(kvItems KeyValues) *Tree23 {
+	tree := NewTree23(kvItems)
+	tree.canonical = true
+	return tree
+}
+
+func (t *Tree23) IsCanonical() bool {
+	return t.canonical
+}
+
+// SetObserver registers the observer notified during the next batches, nil to stop notifications.
+func (t *Tree23) SetObserver(observer Observer) {
+	t.observer = observer
+}
+
 func (t *Tree23) String() string {
-	return fmt.Sprintf("root={keys=%v #children=%d} size=%d", deref(t.root.keys), t.root.childrenCount(), t.Size())
+	return fmt.Sprintf("root={keys=%v #children=%d} size=%d", t.root.keys, t.root.childrenCount(), t.Size())
 }
 
 func (t *Tree23) Size() int {
@@ -38,6 +82,92 @@ func (t *Tree23) Size() int {
 	return count
 }
 
+// Get returns the value of key, if present.
+func (t *Tree23) Get(key Felt) (value Felt, found bool) {
+	n := t.root
+	if n == nil {
+		return 0, false
+	}
+	for !n.isLeaf {
+		n = n.children[n.childIndex(key)]
+	}
+	for i, k := range n.keys[:len(n.keys)-1] {
+		if k == key {
+			return n.values[i], true
+		}
+	}
+	return 0, false
+}
+
+// Len returns the number of keys in the tree.
+func (t *Tree23) Len() int {
+	if t.root == nil {
+		return 0
+	}
+	return t.root.size
+}
+
+// Rank returns the number of keys less than key.
+func (t *Tree23) Rank(key Felt) int {
+	return t.countLess(key, false)
+}
+
+// Select returns the key having rank i, i.e. the i-th smallest key starting from zero.
+func (t *Tree23) Select(i int) (key Felt, found bool) {
+	if i < 0 || i >= t.Len() {
+		return 0, false
+	}
+	n := t.root
+	for !n.isLeaf {
+		for _, child := range n.children {
+			if i < child.size {
+				n = child
+				break
+			}
+			i -= child.size
+		}
+	}
+	return n.keys[i], true
+}
+
+// CountRange returns the number of keys between from and to, both included.
+func (t *Tree23) CountRange(from, to Felt) int {
+	if from > to {
+		return 0
+	}
+	return t.countLess(to, true) - t.countLess(from, false)
+}
+
+// Range returns the pairs between from and to, both included, visiting only the subtrees overlapping them.
+func (t *Tree23) Range(from, to Felt) KeyValues {
+	kvItems := KeyValues{make([]*Felt, 0), make([]*Felt, 0)}
+	if t.root != nil && from <= to {
+		t.root.collectRange(from, to, &kvItems)
+	}
+	return kvItems
+}
+
+func (t *Tree23) countLess(key Felt, orEqual bool) int {
+	count := 0
+	n := t.root
+	if n == nil {
+		return count
+	}
+	for !n.isLeaf {
+		i := n.childIndex(key)
+		for _, child := range n.children[:i] {
+			count += child.size
+		}
+		n = n.children[i]
+	}
+	for _, k := range n.keys[:n.size] {
+		if k < key || orEqual && k == key {
+			count++
+		}
+	}
+	return count
+}
+
 func (t *Tree23) RootHash() []byte {
 	if t.root == nil {
 		return []byte{}
@@ -50,25 +180,25 @@ func (t *Tree23) IsValid() (bool, error) {
 		return true, nil
 	}
 	// Last leaf must have sentinel next key
-	if lastLeaf := t.root.lastLeaf(); lastLeaf.keyCount() > 0 && lastLeaf.nextKey() != nil {
+	if lastLeaf := t.root.lastLeaf(); lastLeaf.keyCount() > 0 && lastLeaf.hasNextKey() {
 		return false, fmt.Errorf("no sentinel next key in last leaf %d", &lastLeaf)
 	}
 	return t.root.isValid()
 }
 
-func (t *Tree23) Graph(filename string, debug bool) {
+func (t *Tree23) Graph(filename string, debug bool) error {
 	graph := NewGraph(t.root)
-	graph.saveDot(filename, debug)
+	return graph.saveDot(filename, debug)
 }
 
-func (t *Tree23) GraphAndPicture(filename string) error {
+func (t *Tree23) GraphAndPicture(dir, name string) error {
 	graph := NewGraph(t.root)
-	return graph.saveDotAndPicture(filename, false)
+	return graph.saveDotAndPicture(dir, name, false)
 }
 
-func (t *Tree23) GraphAndPictureDebug(filename string) error {
+func (t *Tree23) GraphAndPictureDebug(dir, name string) error {
 	graph := NewGraph(t.root)
-	return graph.saveDotAndPicture(filename, true)
+	return graph.saveDotAndPicture(dir, name, true)
 }
 
 func (t *Tree23) Height() int {
@@ -93,14 +223,13 @@ func (t *Tree23) WalkPostOrder(w Walker) []interface{} {
 }
 
 func (t *Tree23) WalkKeysPostOrder() []Felt {
-	key_pointers := make([]*Felt, 0)
+	keys := make([]Felt, 0)
 	t.WalkPostOrder(func(n *Node23) interface{} {
 		if n.isLeaf && n.keyCount() > 0 {
-			key_pointers = append(key_pointers, n.keys[:len(n.keys)-1]...)
+			keys = append(keys, n.keys[:len(n.keys)-1]...)
 		}
 		return nil
 	})
-	keys := deref(key_pointers)
 	return keys
 }
 
@@ -109,6 +238,10 @@ func (t *Tree23) Upsert(kvItems KeyValues) *Tree23 {
 }
 
 func (t *Tree23) UpsertWithStats(kvItems KeyValues, stats *Stats) *Tree23 {
+	defer t.attach(stats)()
+	if stats.UndoLog != nil {
+		stats.UndoLog.record(t, kvItems.Keys())
+	}
 	promoted, _, intermediateKeys := upsert(t.root, kvItems, stats)
 	ensure(len(promoted) > 0, "nodes length is zero")
 	if len(promoted) == 1 {
@@ -116,21 +249,201 @@ func (t *Tree23) UpsertWithStats(kvItems KeyValues, stats *Stats) *Tree23 {
 	} else {
 		t.root = promote(promoted, intermediateKeys, stats)
 	}
-	stats.RehashedCount, stats.ClosingHashes = t.countUpsertRehashedNodes()
+	return t.completeUpsert(stats)
+}
+
+func (t *Tree23) completeUpsert(stats *Stats) *Tree23 {
+	if t.root != nil {
+		t.root.updateSize()
+	}
+	if t.canonical {
+		t.repack()
+		stats.RehashedCount, stats.ClosingHashes = t.countRepackedNodes()
+	} else {
+		stats.RehashedCount, stats.ClosingHashes = t.countUpsertRehashedNodes()
+	}
+	t.version = atomic.AddUint64(&batchVersion, 1)
+	if stats.UndoLog != nil {
+		stats.UndoLog.complete(t)
+	}
 	return t
 }
 
+// UpsertWithWitness works as UpsertWithStats and also returns the opening witness of the batch. It fails on
+// canonical trees, leaving them unchanged.
+func (t *Tree23) UpsertWithWitness(kvItems KeyValues, stats *Stats) (*Tree23, *Witness, error) {
+	if err := t.checkNotCanonical("witness"); err != nil {
+		return t, nil, err
+	}
+	witness := newWitness("upsert", t.root, deref(kvItems.keys))
+	t.UpsertWithStats(kvItems, stats)
+	witness.NewRoot = hex.EncodeToString(t.RootHash())
+	return t, witness, nil
+}
+
+// MergeFunc computes the new value of a key from its current value, nil if missing, and the batch delta.
+// Returning false deletes the key.
+type MergeFunc func(oldValue *Felt, delta Felt) (Felt, bool)
+
+// Merge applies deltas with fn in a single traversal, which adds, updates and drops keys: on the way up, nodes
+// overflowing with added keys are split as upsert does and nodes underflowing with dropped keys are merged with
+// their siblings as delete does.
+func (t *Tree23) Merge(deltas KeyValues, fn MergeFunc) *Tree23 {
+	return t.MergeWithStats(deltas, fn, &Stats{})
+}
+
+func (t *Tree23) MergeWithStats(deltas KeyValues, fn MergeFunc, stats *Stats) *Tree23 {
+	return t.mergeWithStats(deltas, func(_ Felt, oldValue *Felt, delta Felt) (Felt, bool) { return fn(oldValue, delta) }, stats)
+}
+
+func (t *Tree23) mergeWithStats(deltas KeyValues, fn keyMergeFunc, stats *Stats) *Tree23 {
+	defer t.attach(stats)()
+	if stats.UndoLog != nil {
+		stats.UndoLog.record(t, deltas.Keys())
+	}
+	nodes, _ := merge(t.root, deltas, fn, stats)
+	switch len(nodes) {
+	case 0:
+		t.root = nil
+	case 1:
+		t.root, _ = demote(nodes[0], nil, []Felt{}, stats)
+	default:
+		separators := make([]Felt, 0, len(nodes)-1)
+		for _, node := range nodes[:len(nodes)-1] {
+			separators = append(separators, node.lastLeaf().nextKey())
+		}
+		t.root = promote(nodes, separators, stats)
+	}
+	return t.completeUpsert(stats)
+}
+
+// UpsertUnsorted works as Upsert on pairs given in any order, see NewKeyValues.
+func (t *Tree23) UpsertUnsorted(keys, values []Felt) (*Tree23, error) {
+	kvItems, err := NewKeyValues(keys, values)
+	if err != nil {
+		return t, err
+	}
+	return t.Upsert(kvItems), nil
+}
+
+func (t *Tree23) DeleteUnsorted(keysToDelete []Felt) *Tree23 {
+	return t.Delete(sortedKeys(keysToDelete))
+}
+
 func (t *Tree23) Delete(keyToDelete []Felt) *Tree23 {
 	return t.DeleteWithStats(keyToDelete, &Stats{})
 }
 
 func (t *Tree23) DeleteWithStats(keysToDelete []Felt, stats *Stats) *Tree23 {
+	defer t.attach(stats)()
+	if stats.UndoLog != nil {
+		stats.UndoLog.record(t, keysToDelete)
+	}
 	newRoot, nextKey, intermediateKeys := delete(t.root, keysToDelete, stats)
+	return t.completeDelete(newRoot, nextKey, intermediateKeys, stats)
+}
+
+// DeleteRange deletes the keys between from and to, both included.
+func (t *Tree23) DeleteRange(from, to Felt) *Tree23 {
+	return t.DeleteRangeWithStats(from, to, &Stats{})
+}
+
+// DeleteRangeWithStats works as DeleteRange: subtrees fully inside the range are dropped without visiting
+// their leaves, so they are not counted as exposed. DeletedCount still includes their leaves.
+func (t *Tree23) DeleteRangeWithStats(from, to Felt, stats *Stats) *Tree23 {
+	if t.root == nil || from > to || t.CountRange(from, to) == 0 {
+		if stats.UndoLog != nil {
+			stats.UndoLog.record(t, nil)
+			stats.UndoLog.complete(t)
+		}
+		return t
+	}
+	defer t.attach(stats)()
+	if stats.UndoLog != nil {
+		// Recording visits all the keys in range, covered subtrees included
+		stats.UndoLog.record(t, t.Range(from, to).Keys())
+	}
+	newRoot, nextKey, intermediateKeys := deleteRange(t.root, from, to, stats)
+	return t.completeDelete(newRoot, nextKey, intermediateKeys, stats)
+}
+
+func (t *Tree23) completeDelete(newRoot *Node23, nextKey *Felt, intermediateKeys []Felt, stats *Stats) *Tree23 {
 	t.root, _ = demote(newRoot, nextKey, intermediateKeys, stats)
-	stats.RehashedCount, stats.ClosingHashes = t.countDeleteRehashedNodes()
+	if t.root != nil {
+		t.root.updateSize()
+	}
+	if t.canonical {
+		t.repack()
+		stats.RehashedCount, stats.ClosingHashes = t.countRepackedNodes()
+	} else {
+		stats.RehashedCount, stats.ClosingHashes = t.countDeleteRehashedNodes()
+	}
+	t.version = atomic.AddUint64(&batchVersion, 1)
+	if stats.UndoLog != nil {
+		stats.UndoLog.complete(t)
+	}
 	return t
 }
 
+// DeleteWithWitness works as DeleteWithStats and also returns the opening witness of the batch. It fails on
+// canonical trees, leaving them unchanged.
+func (t *Tree23) DeleteWithWitness(keysToDelete []Felt, stats *Stats) (*Tree23, *Witness, error) {
+	if err := t.checkNotCanonical("witness"); err != nil {
+		return t, nil, err
+	}
+	witness := newWitness("delete", t.root, keysToDelete)
+	t.DeleteWithStats(keysToDelete, stats)
+	witness.NewRoot = hex.EncodeToString(t.RootHash())
+	return t, witness, nil
+}
+
+// checkNotCanonical fails on canonical trees, whose repack after a batch breaks any witness or proof of it.
+func (t *Tree23) checkNotCanonical(what string) error {
+	if t.canonical {
+		return fmt.Errorf("no %s on canonical tree", what)
+	}
+	return nil
+}
+
+// KeyValues returns copies of the key-value pairs in the leaves, sorted by key.
+func (t *Tree23) KeyValues() KeyValues {
+	felts := make([]Felt, 0, 2*t.Len())
+	kvItems := KeyValues{make([]*Felt, 0, t.Len()), make([]*Felt, 0, t.Len())}
+	t.WalkPostOrder(func(n *Node23) interface{} {
+		if n.isLeaf && n.keyCount() > 0 {
+			for i := 0; i < n.keyCount()-1; i++ {
+				felts = append(felts, n.keys[i], n.values[i])
+				kvItems.keys = append(kvItems.keys, &felts[len(felts)-2])
+				kvItems.values = append(kvItems.values, &felts[len(felts)-1])
+			}
+		}
+		return nil
+	})
+	return kvItems
+}
+
+// repack rebuilds the tree bottom-up from its sorted pairs, the canonical layout of the key set.
+func (t *Tree23) repack() {
+	tree := &Tree23{arena: t.arena}
+	tree.Upsert(t.KeyValues())
+	tree.reset()
+	t.root = tree.root
+}
+
+// attach sets the tree observer and arena into stats for the duration of a batch, after clearing the flags
+// of the previous batch. The nodes the batch flags are kept to be cleared by the next one.
+func (t *Tree23) attach(stats *Stats) func() {
+	t.clearFlags()
+	stats.arena = t.arena
+	if t.observer != nil {
+		stats.observer, stats.depth, stats.leafDepth = t.observer, 0, t.Height()-1
+	}
+	return func() {
+		stats.observer, stats.arena = nil, nil
+		t.flagged, stats.flagged = stats.flagged, nil
+	}
+}
+
 func (t *Tree23) countUpsertRehashedNodes() (rehashedCount uint, closingHashes uint) {
 	t.WalkPostOrder(func(n *Node23) interface{} {
 		if n.exposed {
@@ -153,9 +466,37 @@ func (t *Tree23) countDeleteRehashedNodes() (rehashedCount uint, closingHashes u
 	return rehashedCount, closingHashes
 }
 
+// countRepackedNodes counts all the nodes, since repack rebuilds the whole tree.
+func (t *Tree23) countRepackedNodes() (rehashedCount uint, closingHashes uint) {
+	t.WalkPostOrder(func(n *Node23) interface{} {
+		rehashedCount++
+		closingHashes += n.howManyHashes()
+		return nil
+	})
+	return rehashedCount, closingHashes
+}
+
 func (t *Tree23) reset() {
+	t.flagged = nil
 	if t.root == nil {
 		return
 	}
 	t.root.reset()
 }
+
+// keepFlags runs the second phase of a batch, e.g. the deletes after the upserts, without clearing the flags
+// set by the first one.
+func (t *Tree23) keepFlags(phase func()) {
+	flagged := t.flagged
+	t.flagged = nil
+	phase()
+	t.flagged = append(flagged, t.flagged...)
+}
+
+// clearFlags clears the flags set by the last batch, so that flags and stats describe just the next one.
+func (t *Tree23) clearFlags() {
+	for _, n := range t.flagged {
+		n.exposed, n.updated, n.created = false, false, false
+	}
+	t.flagged = nil
+}
@@ -297,6 +297,13 @@ func TestUpsertUpdate(t *testing.T) {
 	}
 }
 
+func TestUpsertUpdatesValues(t *testing.T) {
+	tree := NewTree23(KV([]Felt{1, 2, 3, 4, 5}, []Felt{1, 2, 3, 4, 5}))
+	tree.Upsert(KV([]Felt{1, 3, 4, 5}, []Felt{10, 30, 40, 50}))
+	assert.Equal(t, []Felt{10, 2, 30, 40, 50}, tree.KeyValues().Values(), "existing values not updated")
+	assert.Equal(t, NewTree23(KV([]Felt{1, 2, 3, 4, 5}, []Felt{10, 2, 30, 40, 50})).RootHash(), tree.RootHash())
+}
+
 func TestUpsertIdempotent(t *testing.T) {
 	for _, data := range isTree23TestTable {
 		tree := NewTree23(data.initialItems)
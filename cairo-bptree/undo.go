@@ -0,0 +1,84 @@
+package cairo_bptree
+
+import (
+	"fmt"
+	"sort"
+)
+
+// UndoEntry is the value of a key before a batch, Present false if the key was missing.
+type UndoEntry struct {
+	Key     Felt
+	Value   Felt
+	Present bool
+}
+
+// UndoLog records the keys touched by a batch as they were before it, together with the previous root. Batches
+// recording an undo log copy the nodes they would change in place, so the previous tree is left intact.
+type UndoLog struct {
+	// Entries are informational only, e.g. to audit or replicate a batch: Rollback restores the previous root,
+	// which already holds these values, and does not read them.
+	Entries    []UndoEntry
+	root       *Node23 // root before the batch
+	version    uint64
+	newRoot    *Node23 // root after the batch
+	newVersion uint64
+	recorded   map[Felt]bool
+}
+
+// Rollback restores the tree as it was before the batch that recorded undo, which must be the last batch applied
+// to it. Batches must be rolled back in reverse order, each one having recorded its undo log.
+func (t *Tree23) Rollback(undo *UndoLog) error {
+	if undo.recorded == nil {
+		return fmt.Errorf("rollback: empty undo log")
+	}
+	if t.root != undo.newRoot || t.version != undo.newVersion {
+		return fmt.Errorf("rollback: tree changed after the batch recorded in undo log")
+	}
+	t.root, t.version = undo.root, undo.version
+	return nil
+}
+
+// record saves the current value of keys and copies the nodes a batch on them can change. A log can span
+// more batches in a row, e.g. the upsert and delete of a merge: the first one sets the root to restore.
+func (undo *UndoLog) record(t *Tree23, keys []Felt) {
+	if undo.recorded == nil {
+		undo.root, undo.version, undo.recorded = t.root, t.version, make(map[Felt]bool)
+	} else {
+		ensure(t.root == undo.newRoot && t.version == undo.newVersion, "record: undo log recorded on a different tree")
+	}
+	for _, key := range keys {
+		if undo.recorded[key] {
+			continue
+		}
+		undo.recorded[key] = true
+		value, present := t.Get(key)
+		undo.Entries = append(undo.Entries, UndoEntry{Key: key, Value: value, Present: present})
+	}
+	sort.Slice(undo.Entries, func(i, j int) bool { return undo.Entries[i].Key < undo.Entries[j].Key })
+	t.root = copyPaths(t.root, keys, false)
+}
+
+func (undo *UndoLog) complete(t *Tree23) {
+	undo.newRoot, undo.newVersion = t.root, t.version
+}
+
+// copyPaths copies the nodes on the paths to keys and, below them, the nodes on the path to the last leaf of
+// each child, whose next key can change. Since clone points the slices of each copy at its own arrays, batches
+// writing into them leave the arrays of the previous tree untouched.
+func copyPaths(n *Node23, keys []Felt, lastLeaf bool) *Node23 {
+	if n == nil || len(keys) == 0 && !lastLeaf {
+		return n
+	}
+	n = n.clone()
+	if n.isLeaf || n.isPruned() {
+		return n
+	}
+	keySubsets := make([][]Felt, n.childrenCount())
+	if len(keys) > 0 {
+		keySubsets = splitKeys(n, keys)
+	}
+	for i, child := range n.children {
+		n.children[i] = copyPaths(child, keySubsets[i], len(keys) > 0 || lastLeaf && i == n.childrenCount()-1)
+	}
+	return n
+}
@@ -0,0 +1,60 @@
+package cairo_bptree
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollback(t *testing.T) {
+	repeatRandom(40, 300, func(r *rand.Rand, i int) {
+		tree := NewTree23(randomTreeItems(r))
+		if i%4 == 0 {
+			tree = NewCanonicalTree23(tree.KeyValues())
+		}
+		rootHashes, keys, undoLogs := make([][]byte, 0), make([][]Felt, 0), make([]*UndoLog, 0)
+		for j := 0; j < 5; j++ {
+			rootHashes, keys = append(rootHashes, tree.RootHash()), append(keys, tree.WalkKeysPostOrder())
+			stats := &Stats{UndoLog: &UndoLog{}}
+			switch r.Intn(4) {
+			case 0:
+				tree.UpsertWithStats(randomKeyValues(r, r.Intn(32)), stats)
+			case 1:
+				tree.DeleteWithStats(randomKeys(r, r.Intn(64)), stats)
+			case 2:
+				from := Felt(r.Intn(256))
+				tree.DeleteRangeWithStats(from, from+Felt(r.Intn(32)), stats)
+			case 3:
+				tree.MergeWithStats(randomKeyValues(r, r.Intn(32)), addOrDrop, stats)
+			}
+			undoLogs = append(undoLogs, stats.UndoLog)
+		}
+		for j := len(undoLogs) - 1; j >= 0; j-- {
+			require.NoError(t, tree.Rollback(undoLogs[j]), "iteration %d batch %d", i, j)
+			requireValidKeys(t, tree, keys[j], "iteration %d batch %d: different keys", i, j)
+			require.Equal(t, rootHashes[j], tree.RootHash(), "iteration %d batch %d: different root hash", i, j)
+		}
+	})
+}
+
+func TestUndoLogEntries(t *testing.T) {
+	tree := NewTree23(KV([]Felt{1, 3, 5}, []Felt{10, 30, 50}))
+	stats := &Stats{UndoLog: &UndoLog{}}
+	tree.UpsertWithStats(KV([]Felt{2, 3}, []Felt{20, 31}), stats)
+	assert.Equal(t, []UndoEntry{{Key: 2}, {Key: 3, Value: 30, Present: true}}, stats.UndoLog.Entries)
+
+	stats = &Stats{UndoLog: &UndoLog{}}
+	tree.DeleteWithStats([]Felt{3, 4}, stats)
+	assert.Equal(t, []UndoEntry{{Key: 3, Value: 31, Present: true}, {Key: 4}}, stats.UndoLog.Entries)
+}
+
+func TestRollbackAfterOtherBatch(t *testing.T) {
+	tree := NewTree23(K([]Felt{1, 3, 5}))
+	stats := &Stats{UndoLog: &UndoLog{}}
+	tree.UpsertWithStats(K([]Felt{2}), stats)
+	tree.Upsert(K([]Felt{4}))
+	assert.Error(t, tree.Rollback(stats.UndoLog), "rollback allowed after another batch")
+	assert.Error(t, tree.Rollback(&UndoLog{}), "rollback allowed for empty undo log")
+}
@@ -0,0 +1,45 @@
+package cairo_bptree
+
+import "math"
+
+// ResolveFunc computes the value of a key present in both trees of a union from its values in a and b.
+type ResolveFunc func(key Felt, aValue, bValue Felt) Felt
+
+// Union merges a and b, consuming both, calling resolve for the keys present in both. The smaller tree is
+// merged just into the key range it spans in the larger one, resolving conflicts during the same traversal:
+// the subtrees of the larger tree outside that range are reused as they are and, if the ranges do not overlap
+// at all, the smaller tree is joined whole.
+func Union(a, b *Tree23, resolve ResolveFunc) *Tree23 {
+	if a.root == nil {
+		return b
+	}
+	if b.root == nil {
+		return a
+	}
+	small, large, smallIsA := b, a, false
+	if a.Len() < b.Len() {
+		small, large, smallIsA = a, b, true
+	}
+
+	first, last := small.root.firstLeaf().firstKey(), small.root.lastKey()
+	prefix, middle := large.Split(first)
+	suffix := &Tree23{canonical: large.canonical, observer: large.observer, arena: large.arena}
+	if last < math.MaxUint64 {
+		middle, suffix = middle.Split(last + 1)
+	}
+	if middle.root == nil {
+		return joinTrees(joinTrees(prefix, small), suffix)
+	}
+
+	middle.mergeWithStats(small.KeyValues(), func(key Felt, largeValue *Felt, smallValue Felt) (Felt, bool) {
+		switch {
+		case largeValue == nil:
+			return smallValue, true
+		case smallIsA:
+			return resolve(key, smallValue, *largeValue), true
+		default:
+			return resolve(key, *largeValue, smallValue), true
+		}
+	}, &Stats{})
+	return joinTrees(joinTrees(prefix, middle), suffix)
+}
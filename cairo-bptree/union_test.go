@@ -0,0 +1,83 @@
+package cairo_bptree
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnion(t *testing.T) {
+	repeatRandom(37, 1000, func(r *rand.Rand, i int) {
+		aItems, bItems := randomTreeItems(r), randomKeyValues(r, r.Intn(64))
+		if i%2 == 0 {
+			aItems, bItems = bItems, aItems
+		}
+		expected := make(map[Felt]Felt)
+		for j, key := range aItems.keys {
+			expected[*key] = *aItems.values[j]
+		}
+		conflicts := 0
+		for j, key := range bItems.keys {
+			if aValue, found := expected[*key]; found {
+				conflicts++
+				expected[*key] = aValue ^ *bItems.values[j]
+			} else {
+				expected[*key] = *bItems.values[j]
+			}
+		}
+
+		resolved := 0
+		union := Union(NewTree23(aItems.clone()), NewTree23(bItems.clone()), func(key Felt, aValue, bValue Felt) Felt {
+			resolved++
+			return aValue ^ bValue
+		})
+		valid, err := union.IsValid()
+		require.True(t, valid, "iteration %d: invalid tree: %v", i, err)
+		require.Equal(t, len(expected), union.Len(), "iteration %d: different length", i)
+		for key, value := range expected {
+			unionValue, found := union.Get(key)
+			require.True(t, found, "iteration %d: key %d not found", i, key)
+			require.Equal(t, value, unionValue, "iteration %d: different value of key %d", i, key)
+		}
+		assert.Equal(t, conflicts, resolved, "iteration %d: different number of resolved keys", i)
+	})
+}
+
+func TestUnionReusesDisjointTrees(t *testing.T) {
+	a, b := NewTree23(K([]Felt{1, 2, 3, 4, 5, 6, 7, 8, 9})), NewTree23(K([]Felt{20, 21, 22, 23}))
+	aRoot, bRoot := a.root, b.root
+	union := Union(a, b, func(key Felt, aValue, bValue Felt) Felt {
+		assert.Fail(t, "no key to resolve")
+		return aValue
+	})
+	requireValidKeys(t, union, []Felt{1, 2, 3, 4, 5, 6, 7, 8, 9, 20, 21, 22, 23})
+	reused := map[*Node23]bool{}
+	union.WalkPostOrder(func(n *Node23) interface{} { reused[n] = true; return nil })
+	assert.True(t, reused[bRoot], "smaller tree not reused")
+	assert.True(t, reused[aRoot.children[0]], "larger tree not reused")
+
+	a, b = NewTree23(K([]Felt{1, 2, 3, 10, 11, 12, 13, 14, 15, 16, 17, 18})), NewTree23(K([]Felt{12, 13}))
+	aFirstLeaf := a.root.firstLeaf()
+	union = Union(a, b, func(key Felt, aValue, bValue Felt) Felt { return aValue })
+	requireValidKeys(t, union, []Felt{1, 2, 3, 10, 11, 12, 13, 14, 15, 16, 17, 18})
+	reused = map[*Node23]bool{}
+	union.WalkPostOrder(func(n *Node23) interface{} { reused[n] = true; return nil })
+	assert.True(t, reused[aFirstLeaf], "subtree outside overlapping range not reused")
+}
+
+func TestUnionEmpty(t *testing.T) {
+	tree := NewTree23(K([]Felt{1, 2}))
+	assert.Equal(t, tree, Union(tree, NewEmptyTree23(), nil))
+	assert.Equal(t, tree, Union(NewEmptyTree23(), tree, nil))
+}
+
+func TestUnionResolveOrder(t *testing.T) {
+	concat := func(key Felt, aValue, bValue Felt) Felt { return aValue*1000 + bValue }
+	small, large := KV([]Felt{1, 5}, []Felt{10, 50}), KV([]Felt{1, 2, 3, 5}, []Felt{100, 20, 30, 500})
+	union := Union(NewTree23(small.clone()), NewTree23(large.clone()), concat)
+	assert.Equal(t, []Felt{10100, 20, 30, 50500}, union.KeyValues().Values(), "smaller tree as a")
+	union = Union(NewTree23(large.clone()), NewTree23(small.clone()), concat)
+	assert.Equal(t, []Felt{100010, 20, 30, 500050}, union.KeyValues().Values(), "smaller tree as b")
+}
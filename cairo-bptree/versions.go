@@ -0,0 +1,128 @@
+package cairo_bptree
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// VersionedTree keeps a version of the tree for each batch applied. Batches copy the nodes they change, so
+// versions share all the others: each node counts the references from roots and parent nodes, and is freed by
+// Prune when no retained version reaches it anymore.
+type VersionedTree struct {
+	tree     *Tree23
+	head     uint64
+	versions map[uint64]*Node23
+	refs     map[*Node23]int
+}
+
+// PruneStats reports what Prune reclaimed.
+type PruneStats struct {
+	Versions int
+	Nodes    int
+	Bytes    uint64 // nodes and their slices, keys and values excluded
+}
+
+// NewVersionedTree takes over tree, whose current state becomes version 0.
+func NewVersionedTree(tree *Tree23) *VersionedTree {
+	v := &VersionedTree{tree: tree, versions: make(map[uint64]*Node23), refs: make(map[*Node23]int)}
+	v.versions[0] = tree.root
+	v.reference(tree.root)
+	return v
+}
+
+func (v *VersionedTree) Head() uint64 {
+	return v.head
+}
+
+// Apply applies batch to the head version and returns the new head version.
+func (v *VersionedTree) Apply(batch Batch) uint64 {
+	undo := &UndoLog{}
+	v.tree.ApplyWithStats(batch, &Stats{UndoLog: undo}, &Stats{UndoLog: undo})
+	v.head++
+	v.versions[v.head] = v.tree.root
+	v.reference(v.tree.root)
+	return v.head
+}
+
+// Version returns the tree at version, which must not be changed.
+func (v *VersionedTree) Version(version uint64) (*Tree23, error) {
+	root, found := v.versions[version]
+	if !found {
+		return nil, fmt.Errorf("version %d not found", version)
+	}
+	if version == v.head {
+		return v.tree, nil
+	}
+	return &Tree23{root: root, canonical: v.tree.canonical}, nil
+}
+
+// Versions returns the number of versions retained.
+func (v *VersionedTree) Versions() int {
+	return len(v.versions)
+}
+
+// LiveNodes returns the number of nodes reachable from the versions retained.
+func (v *VersionedTree) LiveNodes() int {
+	return len(v.refs)
+}
+
+// Prune drops all the versions but keep and the head, freeing the nodes only they reach.
+func (v *VersionedTree) Prune(keep []uint64) PruneStats {
+	retained := map[uint64]bool{v.head: true}
+	for _, version := range keep {
+		retained[version] = true
+	}
+	stats, versions := PruneStats{}, make(map[uint64]*Node23, len(retained))
+	for version, root := range v.versions {
+		if retained[version] {
+			versions[version] = root
+			continue
+		}
+		stats.Versions++
+		v.release(root, &stats)
+	}
+	v.versions = versions
+	refs := make(map[*Node23]int, len(v.refs)-stats.Nodes)
+	for n, count := range v.refs {
+		if count > 0 {
+			refs[n] = count
+		}
+	}
+	v.refs = refs
+	return stats
+}
+
+// reference adds a reference to n, counting the references to its children the first time.
+func (v *VersionedTree) reference(n *Node23) {
+	if n == nil {
+		return
+	}
+	if v.refs[n] == 0 {
+		for _, child := range n.children {
+			v.reference(child)
+		}
+	}
+	v.refs[n]++
+}
+
+// release drops a reference to n, freeing it and releasing its children when it was the last one.
+func (v *VersionedTree) release(n *Node23, stats *PruneStats) {
+	if n == nil {
+		return
+	}
+	ensure(v.refs[n] > 0, "release: node not referenced")
+	v.refs[n]--
+	if v.refs[n] > 0 {
+		return
+	}
+	stats.Nodes++
+	stats.Bytes += nodeBytes(n)
+	for _, child := range n.children {
+		v.release(child, stats)
+	}
+}
+
+func nodeBytes(n *Node23) uint64 {
+	pointerSize, feltSize := uint64(unsafe.Sizeof(n)), uint64(unsafe.Sizeof(Felt(0)))
+	return uint64(unsafe.Sizeof(*n)) + pointerSize*uint64(cap(n.children)) + feltSize*uint64(cap(n.keys)+cap(n.values)) + uint64(len(n.hash))
+}
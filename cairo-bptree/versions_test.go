@@ -0,0 +1,80 @@
+package cairo_bptree
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionedTreePrune(t *testing.T) {
+	r := rand.New(rand.NewSource(43))
+	for i := 0; i < 50; i++ {
+		tree := NewTree23(randomKeyValues(r, r.Intn(256)))
+		versioned, rootHashes, keys, retained := NewVersionedTree(tree), map[uint64][]byte{}, map[uint64][]Felt{}, map[uint64]bool{}
+		rootHashes[0], keys[0], retained[0] = tree.RootHash(), tree.WalkKeysPostOrder(), true
+		for j := 0; j < 4; j++ {
+			for k := 0; k < 5; k++ {
+				batch := Batch{Upserts: randomKeyValues(r, r.Intn(32))}
+				if k%2 == 1 {
+					batch.Deletes = randomKeys(r, r.Intn(64))
+				}
+				version := versioned.Apply(batch)
+				head, _ := versioned.Version(version)
+				rootHashes[version], keys[version], retained[version] = head.RootHash(), head.WalkKeysPostOrder(), true
+			}
+			keep := make([]uint64, 0)
+			for version := range rootHashes {
+				if retained[version] && r.Intn(3) != 0 {
+					keep = append(keep, version)
+				}
+				retained[version] = false
+			}
+			for _, version := range append(keep, versioned.Head()) {
+				retained[version] = true
+			}
+			liveNodes, versions := versioned.LiveNodes(), versioned.Versions()
+			stats := versioned.Prune(keep)
+			assert.Equal(t, liveNodes-stats.Nodes, versioned.LiveNodes(), "iteration %d: different live nodes", i)
+			assert.Equal(t, versions-stats.Versions, versioned.Versions(), "iteration %d: different versions", i)
+			assert.Equal(t, stats.Nodes > 0, stats.Bytes > 0, "iteration %d: bytes reclaimed not reported", i)
+			reachable := make(map[*Node23]bool)
+			for version := range rootHashes {
+				tree, err := versioned.Version(version)
+				if !retained[version] {
+					require.Error(t, err, "iteration %d version %d: pruned version found", i, version)
+					continue
+				}
+				require.NoError(t, err, "iteration %d version %d", i, version)
+				require.Equal(t, rootHashes[version], tree.RootHash(), "iteration %d version %d: different root hash", i, version)
+				require.Equal(t, keys[version], tree.WalkKeysPostOrder(), "iteration %d version %d: different keys", i, version)
+				if tree.root != nil {
+					tree.root.walkPostOrder(func(n *Node23) interface{} {
+						reachable[n] = true
+						return nil
+					})
+				}
+			}
+			assert.Equal(t, len(reachable), versioned.LiveNodes(), "iteration %d: different reachable nodes", i)
+		}
+	}
+}
+
+func TestVersionedTreePruneAll(t *testing.T) {
+	versioned := NewVersionedTree(NewTree23(K([]Felt{1, 2, 3, 4, 5, 6})))
+	rootHash := versioned.tree.RootHash()
+	versioned.Apply(Batch{Upserts: K([]Felt{7})})
+	versioned.Apply(Batch{Deletes: []Felt{1}})
+	stats := versioned.Prune(nil)
+	assert.Equal(t, 2, stats.Versions)
+	assert.Equal(t, 1, versioned.Versions())
+	_, err := versioned.Version(0)
+	assert.Error(t, err, "pruned version found")
+	assert.Positive(t, stats.Nodes)
+	assert.NotEqual(t, rootHash, versioned.tree.RootHash())
+
+	versioned = NewVersionedTree(NewTree23(K([]Felt{1, 2, 3})))
+	versioned.Apply(Batch{})
+	assert.Equal(t, PruneStats{Versions: 1}, versioned.Prune(nil), "shared root freed")
+}
@@ -0,0 +1,322 @@
+package cairo_bptree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	snapshotFileName = "snapshot"
+	walFileName      = "wal"
+)
+
+// File is the subset of *os.File used by PersistentTree.
+type File interface {
+	io.ReadWriteCloser
+	io.Seeker
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FileSystem opens the files of a PersistentTree, tests replace it to inject faults.
+type FileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(oldName, newName string) error
+	SyncDir(name string) error
+}
+
+type osFileSystem struct{}
+
+func (osFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFileSystem) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+// SyncDir flushes the entries of directory name, so that files created or renamed in it survive a crash.
+func (osFileSystem) SyncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// SyncPolicy tells when the write-ahead log is flushed to stable storage.
+type SyncPolicy int
+
+const (
+	SyncAlways SyncPolicy = iota // after every batch, an acknowledged batch survives a crash
+	SyncEvery                    // after PersistOptions.SyncEvery batches
+	SyncNever                    // left to the operating system
+)
+
+type PersistOptions struct {
+	Sync      SyncPolicy
+	SyncEvery int
+	FS        FileSystem // os file system if nil
+}
+
+// PersistentTree is a Tree23 saved in a directory as a snapshot plus the write-ahead log of the batches applied
+// after it. Each log record holds the batch and the root hash expected after applying it.
+type PersistentTree struct {
+	tree     *Tree23
+	dir      string
+	options  PersistOptions
+	wal      File
+	sequence uint64 // sequence number of the last batch applied
+	unsynced int    // records written since the last sync
+	err      error  // first I/O error, the log cannot be trusted after it
+}
+
+// OpenPersistentTree loads the snapshot in dir, then replays the batches logged after it. A torn record at the
+// end of the log is the write of a batch never acknowledged, so it is discarded along with anything after it.
+func OpenPersistentTree(dir string, options PersistOptions) (*PersistentTree, error) {
+	if options.FS == nil {
+		options.FS = osFileSystem{}
+	}
+	if options.Sync == SyncEvery && options.SyncEvery < 1 {
+		return nil, fmt.Errorf("wal: invalid sync every %d batches", options.SyncEvery)
+	}
+	p := &PersistentTree{tree: NewEmptyTree23(), dir: dir, options: options}
+	snapshot, err := options.FS.OpenFile(p.path(snapshotFileName), os.O_RDONLY, 0)
+	if err == nil {
+		p.tree, p.sequence, err = readSnapshot(snapshot)
+		snapshot.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if p.wal, err = options.FS.OpenFile(p.path(walFileName), os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return nil, err
+	}
+	// The log may have just been created: its entry must be durable before any batch is acknowledged
+	if err := options.FS.SyncDir(dir); err != nil {
+		p.wal.Close()
+		return nil, err
+	}
+	if err := p.replay(); err != nil {
+		p.wal.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *PersistentTree) path(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+func (p *PersistentTree) replay() error {
+	data, err := ioutil.ReadAll(p.wal)
+	if err != nil {
+		return err
+	}
+	offset := 0
+	for offset < len(data) {
+		sequence, batch, rootHash, length, ok := decodeRecord(data[offset:])
+		if !ok {
+			break
+		}
+		offset += length
+		if sequence <= p.sequence {
+			continue // already in the snapshot, the log was not truncated before a crash
+		}
+		if sequence != p.sequence+1 {
+			return fmt.Errorf("wal: missing batches between %d and %d", p.sequence, sequence)
+		}
+		p.tree.Apply(batch)
+		if !bytes.Equal(p.tree.RootHash(), rootHash) {
+			return fmt.Errorf("wal: root hash mismatch after batch %d", sequence)
+		}
+		p.sequence = sequence
+	}
+	if offset < len(data) {
+		if err := p.wal.Truncate(int64(offset)); err != nil {
+			return err
+		}
+		if err := p.wal.Sync(); err != nil {
+			return err
+		}
+	}
+	_, err = p.wal.Seek(int64(offset), io.SeekStart)
+	return err
+}
+
+func (p *PersistentTree) Tree() *Tree23 {
+	return p.tree
+}
+
+// Apply applies batch and logs it. If logging fails the tree is rolled back and the error is returned by any
+// later call: the log may hold a partial record, which is discarded on the next open.
+func (p *PersistentTree) Apply(batch Batch) error {
+	if p.err != nil {
+		return p.err
+	}
+	// The batch is encoded first, the tree takes over its slices
+	payload := encodeBatch(p.sequence+1, batch)
+	undo := &UndoLog{}
+	p.tree.ApplyWithStats(batch, &Stats{UndoLog: undo}, &Stats{UndoLog: undo})
+	if err := p.log(payload); err != nil {
+		if undo.recorded != nil {
+			ensure(p.tree.Rollback(undo) == nil, "Apply: cannot roll back batch")
+		}
+		p.err = err
+		return err
+	}
+	p.sequence++
+	return nil
+}
+
+func (p *PersistentTree) log(payload *bytes.Buffer) error {
+	if _, err := p.wal.Write(encodeRecord(payload, p.tree.RootHash())); err != nil {
+		return err
+	}
+	p.unsynced++
+	if p.options.Sync == SyncAlways || p.options.Sync == SyncEvery && p.unsynced >= p.options.SyncEvery {
+		return p.sync()
+	}
+	return nil
+}
+
+func (p *PersistentTree) sync() error {
+	if err := p.wal.Sync(); err != nil {
+		return err
+	}
+	p.unsynced = 0
+	return nil
+}
+
+// Checkpoint saves a snapshot of the tree, then empties the log.
+func (p *PersistentTree) Checkpoint() error {
+	if p.err != nil {
+		return p.err
+	}
+	p.err = p.checkpoint()
+	return p.err
+}
+
+func (p *PersistentTree) checkpoint() error {
+	snapshot, err := p.options.FS.OpenFile(p.path(snapshotFileName+".tmp"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := writeSnapshot(snapshot, p.tree, p.sequence); err != nil {
+		snapshot.Close()
+		return err
+	}
+	if err := snapshot.Sync(); err != nil {
+		snapshot.Close()
+		return err
+	}
+	if err := snapshot.Close(); err != nil {
+		return err
+	}
+	if err := p.options.FS.Rename(p.path(snapshotFileName+".tmp"), p.path(snapshotFileName)); err != nil {
+		return err
+	}
+	if err := p.options.FS.SyncDir(p.dir); err != nil {
+		return err
+	}
+	// Records left by a crash from here on are skipped on replay, being already in the snapshot
+	if err := p.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := p.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return p.sync()
+}
+
+// Close syncs the log, whatever the sync policy.
+func (p *PersistentTree) Close() error {
+	if p.err == nil && p.unsynced > 0 {
+		p.err = p.sync()
+	}
+	if err := p.wal.Close(); err != nil && p.err == nil {
+		return err
+	}
+	return p.err
+}
+
+// encodeBatch starts the payload of a record: sequence number, upserted pairs and deleted keys.
+func encodeBatch(sequence uint64, batch Batch) *bytes.Buffer {
+	payload := &bytes.Buffer{}
+	binary.Write(payload, binary.BigEndian, sequence)
+	binary.Write(payload, binary.BigEndian, uint32(batch.Upserts.Len()))
+	for i, key := range batch.Upserts.keys {
+		binary.Write(payload, binary.BigEndian, uint64(*key))
+		binary.Write(payload, binary.BigEndian, uint64(*batch.Upserts.values[i]))
+	}
+	binary.Write(payload, binary.BigEndian, uint32(len(batch.Deletes)))
+	for _, key := range batch.Deletes {
+		binary.Write(payload, binary.BigEndian, uint64(key))
+	}
+	return payload
+}
+
+// encodeRecord ends payload with the root hash and prepends its length and CRC32.
+func encodeRecord(payload *bytes.Buffer, rootHash []byte) []byte {
+	payload.WriteByte(byte(len(rootHash)))
+	payload.Write(rootHash)
+	record := make([]byte, 8, 8+payload.Len())
+	binary.BigEndian.PutUint32(record[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	return append(record, payload.Bytes()...)
+}
+
+// decodeRecord decodes the record at the start of data, ok is false if it is torn or corrupted.
+func decodeRecord(data []byte) (sequence uint64, batch Batch, rootHash []byte, length int, ok bool) {
+	if len(data) < 8 {
+		return
+	}
+	payloadLength := int(binary.BigEndian.Uint32(data[0:4]))
+	if payloadLength > len(data)-8 {
+		return
+	}
+	payload := data[8 : 8+payloadLength]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[4:8]) {
+		return
+	}
+	reader := bytes.NewReader(payload)
+	var upsertCount, deleteCount uint32
+	if binary.Read(reader, binary.BigEndian, &sequence) != nil || binary.Read(reader, binary.BigEndian, &upsertCount) != nil {
+		return
+	}
+	if uint64(upsertCount)*16 > uint64(reader.Len()) {
+		return
+	}
+	pairs := make([]Felt, 2*upsertCount)
+	if binary.Read(reader, binary.BigEndian, pairs) != nil || binary.Read(reader, binary.BigEndian, &deleteCount) != nil {
+		return
+	}
+	if uint64(deleteCount)*8 > uint64(reader.Len()) {
+		return
+	}
+	batch.Deletes = make([]Felt, deleteCount)
+	if binary.Read(reader, binary.BigEndian, batch.Deletes) != nil {
+		return
+	}
+	hashLength, err := reader.ReadByte()
+	if err != nil || int(hashLength) != reader.Len() {
+		return
+	}
+	rootHash = make([]byte, hashLength)
+	reader.Read(rootHash)
+	batch.Upserts = KeyValues{make([]*Felt, upsertCount), make([]*Felt, upsertCount)}
+	for i := 0; i < int(upsertCount); i++ {
+		batch.Upserts.keys[i], batch.Upserts.values[i] = &pairs[2*i], &pairs[2*i+1]
+	}
+	return sequence, batch, rootHash, 8 + payloadLength, true
+}
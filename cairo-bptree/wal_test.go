@@ -0,0 +1,286 @@
+package cairo_bptree
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errCrash = errors.New("crash")
+
+// faultFS is an in-memory file system crashing at its crashAt-th write point: Write, Sync, Truncate, Rename or
+// SyncDir. A crashing Write writes half of its bytes, every operation fails after the crash.
+type faultFS struct {
+	files   map[string]*faultFile // nil if removed
+	entries map[string]*faultFile // files as named at the last SyncDir
+	crashAt int
+	points  int
+	crashed bool
+}
+
+// faultFile holds the data seen by the process and the data synced to stable storage.
+type faultFile struct {
+	data    []byte
+	durable []byte
+}
+
+type faultHandle struct {
+	fs     *faultFS
+	file   *faultFile
+	offset int64
+}
+
+func newFaultFS(crashAt int) *faultFS {
+	return &faultFS{files: make(map[string]*faultFile), entries: make(map[string]*faultFile), crashAt: crashAt}
+}
+
+// writePoint counts a write point, crash is true if the operation must fail.
+func (fs *faultFS) writePoint() (crashNow bool, err error) {
+	if fs.crashed {
+		return false, errCrash
+	}
+	fs.points++
+	if fs.points == fs.crashAt {
+		fs.crashed = true
+		return true, errCrash
+	}
+	return false, nil
+}
+
+// image returns the files after the crash, as left by the process or, if durable, by a power loss.
+func (fs *faultFS) image(durable bool) *faultFS {
+	image, files := newFaultFS(0), fs.files
+	if durable {
+		files = fs.entries
+	}
+	for name, file := range files {
+		if file == nil {
+			continue
+		}
+		data := file.data
+		if durable {
+			data = file.durable
+		}
+		image.files[name] = &faultFile{data: append([]byte{}, data...), durable: append([]byte{}, data...)}
+		image.entries[name] = image.files[name]
+	}
+	return image
+}
+
+func (fs *faultFS) OpenFile(name string, flag int, _ os.FileMode) (File, error) {
+	if fs.crashed {
+		return nil, errCrash
+	}
+	file := fs.files[name]
+	if file == nil {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		file = &faultFile{}
+		fs.files[name] = file
+	}
+	if flag&os.O_TRUNC != 0 {
+		file.data = nil
+	}
+	return &faultHandle{fs: fs, file: file}, nil
+}
+
+func (fs *faultFS) Rename(oldName, newName string) error {
+	if _, err := fs.writePoint(); err != nil {
+		return err
+	}
+	fs.files[newName], fs.files[oldName] = fs.files[oldName], nil
+	return nil
+}
+
+func (fs *faultFS) SyncDir(string) error {
+	if _, err := fs.writePoint(); err != nil {
+		return err
+	}
+	fs.entries = make(map[string]*faultFile)
+	for name, file := range fs.files {
+		fs.entries[name] = file
+	}
+	return nil
+}
+
+func (h *faultHandle) Read(b []byte) (int, error) {
+	if h.fs.crashed {
+		return 0, errCrash
+	}
+	if h.offset >= int64(len(h.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, h.file.data[h.offset:])
+	h.offset += int64(n)
+	return n, nil
+}
+
+func (h *faultHandle) Write(b []byte) (int, error) {
+	crashNow, err := h.fs.writePoint()
+	if crashNow {
+		b = b[:len(b)/2]
+	} else if err != nil {
+		return 0, err
+	}
+	for len(h.file.data) < int(h.offset)+len(b) {
+		h.file.data = append(h.file.data, 0)
+	}
+	copy(h.file.data[h.offset:], b)
+	h.offset += int64(len(b))
+	return len(b), err
+}
+
+func (h *faultHandle) Seek(offset int64, whence int) (int64, error) {
+	ensure(whence == io.SeekStart, "Seek: unsupported whence")
+	h.offset = offset
+	return offset, nil
+}
+
+func (h *faultHandle) Sync() error {
+	if _, err := h.fs.writePoint(); err != nil {
+		return err
+	}
+	h.file.durable = append([]byte{}, h.file.data...)
+	return nil
+}
+
+func (h *faultHandle) Truncate(size int64) error {
+	if _, err := h.fs.writePoint(); err != nil {
+		return err
+	}
+	ensure(size <= int64(len(h.file.data)), "Truncate: cannot extend file")
+	h.file.data = h.file.data[:size]
+	return nil
+}
+
+func (h *faultHandle) Close() error {
+	return nil
+}
+
+func walBatches(r *rand.Rand, count int) []Batch {
+	batches := make([]Batch, count)
+	for i := range batches {
+		batches[i] = Batch{Upserts: randomKeyValues(r, r.Intn(24))}
+		if i%3 == 2 {
+			batches[i].Deletes = randomKeys(r, r.Intn(48))
+		}
+	}
+	return batches
+}
+
+// applyBatches applies batches from start on, with a checkpoint every 4 batches, returning how many succeeded.
+func applyBatches(p *PersistentTree, batches []Batch, start int) (int, error) {
+	for i := start; i < len(batches); i++ {
+		if err := p.Apply(Batch{Upserts: batches[i].Upserts.clone(), Deletes: batches[i].Deletes}); err != nil {
+			return i, err
+		}
+		if (i+1)%4 == 0 {
+			if err := p.Checkpoint(); err != nil {
+				return i + 1, err
+			}
+		}
+	}
+	return len(batches), p.Close()
+}
+
+func TestCrashAtEveryWritePoint(t *testing.T) {
+	batches := walBatches(rand.New(rand.NewSource(41)), 14)
+	tree, rootHashes := NewEmptyTree23(), make([][]byte, 0)
+	for _, batch := range batches {
+		rootHashes = append(rootHashes, tree.RootHash())
+		tree.Apply(Batch{Upserts: batch.Upserts.clone(), Deletes: batch.Deletes})
+	}
+	rootHashes = append(rootHashes, tree.RootHash())
+	for _, options := range []PersistOptions{{Sync: SyncAlways}, {Sync: SyncEvery, SyncEvery: 3}, {Sync: SyncNever}} {
+		fs := newFaultFS(0)
+		p, err := OpenPersistentTree("db", PersistOptions{Sync: options.Sync, SyncEvery: options.SyncEvery, FS: fs})
+		require.NoError(t, err)
+		_, err = applyBatches(p, batches, 0)
+		require.NoError(t, err)
+		writePoints := fs.points
+		for crashAt := 1; crashAt <= writePoints; crashAt++ {
+			fs := newFaultFS(crashAt)
+			acked := 0
+			p, err := OpenPersistentTree("db", PersistOptions{Sync: options.Sync, SyncEvery: options.SyncEvery, FS: fs})
+			if err == nil {
+				acked, err = applyBatches(p, batches, 0)
+			}
+			require.Equal(t, errCrash, err, "policy %d crash at %d: no crash", options.Sync, crashAt)
+			for _, durable := range []bool{false, true} {
+				image := fs.image(durable)
+				p, err := OpenPersistentTree("db", PersistOptions{Sync: options.Sync, SyncEvery: options.SyncEvery, FS: image})
+				require.NoError(t, err, "policy %d crash at %d durable %t", options.Sync, crashAt, durable)
+				recovered := -1
+				for j := len(rootHashes) - 1; j >= 0 && recovered < 0; j-- {
+					if bytes.Equal(rootHashes[j], p.Tree().RootHash()) {
+						recovered = j
+					}
+				}
+				require.GreaterOrEqual(t, recovered, 0, "policy %d crash at %d durable %t: unknown root hash", options.Sync, crashAt, durable)
+				require.LessOrEqual(t, recovered, acked+1, "policy %d crash at %d durable %t: batch applied after crash", options.Sync, crashAt, durable)
+				if !durable || options.Sync == SyncAlways {
+					require.GreaterOrEqual(t, recovered, acked, "policy %d crash at %d durable %t: acknowledged batch lost", options.Sync, crashAt, durable)
+				}
+				// The recovered tree goes on from where the log stopped
+				_, err = applyBatches(p, batches, recovered)
+				require.NoError(t, err, "policy %d crash at %d durable %t", options.Sync, crashAt, durable)
+				p, err = OpenPersistentTree("db", PersistOptions{Sync: options.Sync, SyncEvery: options.SyncEvery, FS: image})
+				require.NoError(t, err, "policy %d crash at %d durable %t", options.Sync, crashAt, durable)
+				require.Equal(t, rootHashes[len(batches)], p.Tree().RootHash(), "policy %d crash at %d durable %t: different final root hash", options.Sync, crashAt, durable)
+			}
+		}
+	}
+}
+
+func TestFailedApplyRollsBack(t *testing.T) {
+	fs := newFaultFS(4)
+	p, err := OpenPersistentTree("db", PersistOptions{Sync: SyncAlways, FS: fs})
+	require.NoError(t, err)
+	require.NoError(t, p.Apply(Batch{Upserts: K([]Felt{1, 2, 3})}))
+	rootHash := p.Tree().RootHash()
+	assert.Equal(t, errCrash, p.Apply(Batch{Upserts: K([]Felt{4}), Deletes: []Felt{1}}))
+	assert.Equal(t, rootHash, p.Tree().RootHash(), "failed batch not rolled back")
+	assert.Equal(t, []Felt{1, 2, 3}, p.Tree().WalkKeysPostOrder())
+	assert.Equal(t, errCrash, p.Apply(Batch{Upserts: K([]Felt{5})}), "apply allowed after failure")
+}
+
+func TestTornTailDiscarded(t *testing.T) {
+	dir := t.TempDir()
+	p, err := OpenPersistentTree(dir, PersistOptions{Sync: SyncAlways})
+	require.NoError(t, err)
+	require.NoError(t, p.Apply(Batch{Upserts: K([]Felt{1, 2, 3})}))
+	require.NoError(t, p.Checkpoint())
+	require.NoError(t, p.Apply(Batch{Upserts: K([]Felt{4, 5}), Deletes: []Felt{2}}))
+	rootHash := p.Tree().RootHash()
+	require.NoError(t, p.Apply(Batch{Upserts: K([]Felt{6})}))
+	require.NoError(t, p.Close())
+
+	walPath := filepath.Join(dir, walFileName)
+	info, err := os.Stat(walPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(walPath, info.Size()-3))
+	tornSize := info.Size() - int64(len(encodeRecord(encodeBatch(3, Batch{Upserts: K([]Felt{6})}), rootHash)))
+
+	p, err = OpenPersistentTree(dir, PersistOptions{Sync: SyncAlways})
+	require.NoError(t, err)
+	assert.Equal(t, rootHash, p.Tree().RootHash(), "torn record not discarded")
+	assert.Equal(t, []Felt{1, 3, 4, 5}, p.Tree().WalkKeysPostOrder())
+	info, err = os.Stat(walPath)
+	require.NoError(t, err)
+	assert.Equal(t, tornSize, info.Size(), "torn record not truncated")
+
+	require.NoError(t, p.Apply(Batch{Upserts: K([]Felt{7})}))
+	require.NoError(t, p.Close())
+	p, err = OpenPersistentTree(dir, PersistOptions{Sync: SyncAlways})
+	require.NoError(t, err)
+	assert.Equal(t, []Felt{1, 3, 4, 5, 7}, p.Tree().WalkKeysPostOrder())
+	require.NoError(t, p.Close())
+}
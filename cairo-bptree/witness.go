@@ -0,0 +1,266 @@
+package cairo_bptree
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const (
+	WitnessLeaf     = "leaf"
+	WitnessInternal = "internal"
+	WitnessPruned   = "pruned"
+)
+
+// WitnessNode is one node of the pre-state sub-tree opened by a batch. Nodes reference their
+// children by index into MultiProof.Nodes, pruned nodes carry just their hash and boundary keys.
+type WitnessNode struct {
+	Kind     string `json:"kind"`
+	Keys     []Felt `json:"keys,omitempty"`
+	Values   []Felt `json:"values,omitempty"`
+	NextKey  *Felt  `json:"nextKey"`
+	FirstKey *Felt  `json:"firstKey,omitempty"`
+	Children []int  `json:"children,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// MultiProof opens a set of keys at once: the touched sub-tree laid out in pre-order, where shared
+// path nodes and sibling hashes appear just once.
+type MultiProof struct {
+	Root  int           `json:"root"`
+	Nodes []WitnessNode `json:"nodes"`
+}
+
+// Witness is the opening witness of a batch: the multiproof of the batch keys in pre-state plus both roots.
+type Witness struct {
+	Operation string `json:"operation"`
+	OldRoot   string `json:"oldRoot"`
+	NewRoot   string `json:"newRoot"`
+	MultiProof
+}
+
+func newMultiProof(root *Node23, touched map[*Node23]bool) *MultiProof {
+	p := &MultiProof{Root: -1, Nodes: make([]WitnessNode, 0)}
+	if root != nil {
+		p.Root = p.addNode(root, touched)
+	}
+	return p
+}
+
+func newWitness(operation string, root *Node23, keys []Felt) *Witness {
+	w := &Witness{Operation: operation, MultiProof: *newMultiProof(root, touchedNodes(root, keys))}
+	if root != nil {
+		w.OldRoot = hex.EncodeToString(root.hashNode())
+	}
+	return w
+}
+
+func (p *MultiProof) addNode(n *Node23, touched map[*Node23]bool) int {
+	id := len(p.Nodes)
+	p.Nodes = append(p.Nodes, WitnessNode{})
+	if n.isLeaf {
+		// Leaves are small enough to be always included, even when untouched
+		p.Nodes[id] = WitnessNode{
+			Kind:    WitnessLeaf,
+			Keys:    n.canonicalKeys(),
+			Values:  append(make([]Felt, 0, len(n.values)-1), n.values[:len(n.values)-1]...),
+			NextKey: n.nextKeyOrNil(),
+		}
+	} else if touched[n] {
+		children := make([]int, 0, n.childrenCount())
+		for _, child := range n.children {
+			children = append(children, p.addNode(child, touched))
+		}
+		p.Nodes[id] = WitnessNode{Kind: WitnessInternal, Keys: n.canonicalKeys(), Children: children}
+	} else {
+		firstKey := n.firstLeaf().firstKey()
+		p.Nodes[id] = WitnessNode{
+			Kind:     WitnessPruned,
+			FirstKey: &firstKey,
+			NextKey:  n.lastLeaf().nextKeyOrNil(),
+			Hash:     hex.EncodeToString(n.hashNode()),
+		}
+	}
+	return id
+}
+
+// touchedNodes collects the nodes that a batch on keys can read or modify: the search path of each key
+// plus the facing spines of the path siblings, which next-key updates and merges may reach.
+func touchedNodes(root *Node23, keys []Felt) map[*Node23]bool {
+	touched := make(map[*Node23]bool)
+	if root == nil {
+		return touched
+	}
+	for _, key := range keys {
+		n := root
+		for !n.isLeaf {
+			touched[n] = true
+			i := n.childIndex(key)
+			if i > 0 {
+				markSpine(n.children[i-1], touched, (*Node23).lastChild)
+			}
+			if i < n.childrenCount()-1 {
+				markSpine(n.children[i+1], touched, (*Node23).firstChild)
+			}
+			n = n.children[i]
+		}
+		touched[n] = true
+	}
+	return touched
+}
+
+func markSpine(n *Node23, touched map[*Node23]bool, next func(*Node23) *Node23) {
+	touched[n] = true
+	for !n.isLeaf {
+		n = next(n)
+		touched[n] = true
+	}
+}
+
+// cloneTouched copies the touched nodes and the leaves below them, sharing any other subtree with n.
+// A batch on the keys which touched derives from can then run on the clone leaving n unchanged.
+func cloneTouched(n *Node23, touched map[*Node23]bool) *Node23 {
+	if n == nil || (!n.isLeaf && !touched[n]) {
+		return n
+	}
+	clone := n.clone()
+	for i, child := range n.children {
+		clone.children[i] = cloneTouched(child, touched)
+	}
+	return clone
+}
+
+func (w *Witness) WriteJSON(writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(w)
+}
+
+func ReadWitness(reader io.Reader) (*Witness, error) {
+	w := &Witness{}
+	if err := json.NewDecoder(reader).Decode(w); err != nil {
+		return nil, fmt.Errorf("cannot decode witness: %v", err)
+	}
+	return w, nil
+}
+
+// tree rebuilds the pre-state sub-tree.
+func (p *MultiProof) tree() (*Node23, error) {
+	if p.Root < 0 {
+		return nil, nil
+	}
+	// Separators and pruned boundary keys are not hashed: each separator must be both the next key of its
+	// left subtree and the first key of its right one, so that keys are routed to their authenticated leaves
+	visited := make([]bool, len(p.Nodes))
+	var build func(id int) (n *Node23, firstKey, nextKey *Felt, err error)
+	build = func(id int) (*Node23, *Felt, *Felt, error) {
+		if id < 0 || id >= len(p.Nodes) || visited[id] {
+			return nil, nil, nil, fmt.Errorf("invalid witness node reference %d", id)
+		}
+		visited[id] = true
+		wn := p.Nodes[id]
+		switch wn.Kind {
+		case WitnessLeaf:
+			if len(wn.Keys) == 0 || len(wn.Keys) > 2 || len(wn.Keys) != len(wn.Values) {
+				return nil, nil, nil, fmt.Errorf("invalid leaf %d: #keys=%d #values=%d", id, len(wn.Keys), len(wn.Values))
+			}
+			for i := range wn.Keys {
+				if (i > 0 && wn.Keys[i-1] >= wn.Keys[i]) || (wn.NextKey != nil && wn.Keys[i] >= *wn.NextKey) {
+					return nil, nil, nil, fmt.Errorf("invalid leaf %d: keys %v next key %s not increasing", id, wn.Keys, pointerValue(wn.NextKey))
+				}
+			}
+			keys := append(append(make([]Felt, 0, len(wn.Keys)+1), wn.Keys...), valueOrZero(wn.NextKey))
+			values := append(append(make([]Felt, 0, len(wn.Values)+1), wn.Values...), 0)
+			n := (&Node23{isLeaf: true, noNextKey: wn.NextKey == nil}).setSlices(nil, keys, values)
+			return n, &wn.Keys[0], wn.NextKey, nil
+		case WitnessInternal:
+			if len(wn.Children) < 2 || len(wn.Children) > 3 || len(wn.Keys) != len(wn.Children)-1 {
+				return nil, nil, nil, fmt.Errorf("invalid internal %d: #keys=%d #children=%d", id, len(wn.Keys), len(wn.Children))
+			}
+			children := make([]*Node23, 0, len(wn.Children))
+			var firstKey, nextKey *Felt
+			for i, childId := range wn.Children {
+				child, childFirstKey, childNextKey, err := build(childId)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				if i == 0 {
+					firstKey = childFirstKey
+				} else if *childFirstKey != wn.Keys[i-1] {
+					return nil, nil, nil, fmt.Errorf("invalid internal %d: key %d is not first key %d of child %d", id, wn.Keys[i-1], *childFirstKey, childId)
+				}
+				if i < len(wn.Keys) && (childNextKey == nil || *childNextKey != wn.Keys[i]) {
+					return nil, nil, nil, fmt.Errorf("invalid internal %d: key %d is not next key %s of child %d", id, wn.Keys[i], pointerValue(childNextKey), childId)
+				}
+				children, nextKey = append(children, child), childNextKey
+			}
+			return (&Node23{isLeaf: false}).setSlices(children, wn.Keys, nil), firstKey, nextKey, nil
+		case WitnessPruned:
+			hash, err := hex.DecodeString(wn.Hash)
+			if err != nil || len(hash) == 0 || wn.FirstKey == nil || (wn.NextKey != nil && *wn.FirstKey >= *wn.NextKey) {
+				return nil, nil, nil, fmt.Errorf("invalid pruned %d: hash=%s firstKey=%s nextKey=%s", id, wn.Hash, pointerValue(wn.FirstKey), pointerValue(wn.NextKey))
+			}
+			keys := []Felt{*wn.FirstKey, valueOrZero(wn.NextKey)}
+			n := (&Node23{isLeaf: false, noNextKey: wn.NextKey == nil, hash: hash}).setSlices(nil, keys, nil)
+			return n, wn.FirstKey, wn.NextKey, nil
+		default:
+			return nil, nil, nil, fmt.Errorf("invalid kind %s of node %d", wn.Kind, id)
+		}
+	}
+	root, _, nextKey, err := build(p.Root)
+	if err != nil {
+		return nil, err
+	}
+	if nextKey != nil {
+		return nil, fmt.Errorf("invalid root %d: last next key %d", p.Root, *nextKey)
+	}
+	return root, nil
+}
+
+func VerifyUpsertWitness(w *Witness, kvItems KeyValues) (oldRoot, newRoot []byte, err error) {
+	return w.verify("upsert", func(t *Tree23) { t.UpsertWithStats(kvItems.clone(), &Stats{}) })
+}
+
+func VerifyDeleteWitness(w *Witness, keysToDelete []Felt) (oldRoot, newRoot []byte, err error) {
+	return w.verify("delete", func(t *Tree23) { t.DeleteWithStats(keysToDelete, &Stats{}) })
+}
+
+// verify recomputes old and new root applying the batch to the witness sub-tree with the same bulk rules.
+func (w *Witness) verify(operation string, apply func(*Tree23)) (oldRoot, newRoot []byte, err error) {
+	if w.Operation != operation {
+		return nil, nil, fmt.Errorf("witness operation %s is not %s", w.Operation, operation)
+	}
+	root, err := w.tree()
+	if err != nil {
+		return nil, nil, err
+	}
+	t := &Tree23{root: root}
+	oldRoot = t.RootHash()
+	if err := checkRoot("old", w.OldRoot, oldRoot); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			oldRoot, newRoot, err = nil, nil, fmt.Errorf("witness insufficient for batch: %v", r)
+		}
+	}()
+	apply(t)
+	newRoot = t.RootHash()
+	if err := checkRoot("new", w.NewRoot, newRoot); err != nil {
+		return nil, nil, err
+	}
+	return oldRoot, newRoot, nil
+}
+
+func checkRoot(name, expected string, actual []byte) error {
+	expectedRoot, err := hex.DecodeString(expected)
+	if err != nil {
+		return fmt.Errorf("invalid %s root %s: %v", name, expected, err)
+	}
+	if !bytes.Equal(expectedRoot, actual) {
+		return fmt.Errorf("%s root mismatch: expected %x got %x", name, expectedRoot, actual)
+	}
+	return nil
+}
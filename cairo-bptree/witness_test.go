@@ -0,0 +1,113 @@
+package cairo_bptree
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpsertWitness(t *testing.T) {
+	r := rand.New(rand.NewSource(26))
+	for i := 0; i < 500; i++ {
+		tree := NewTree23(randomKeyValues(r, r.Intn(256)))
+		batch := randomKeyValues(r, r.Intn(32))
+		_, witness, err := tree.UpsertWithWitness(batch.clone(), &Stats{})
+		require.NoError(t, err)
+		oldRoot, newRoot, err := VerifyUpsertWitness(witness, batch)
+		require.NoError(t, err, "iteration %d batch %v", i, batch)
+		assert.Equal(t, witness.OldRoot, hex.EncodeToString(oldRoot), "different old root")
+		assert.Equal(t, tree.RootHash(), newRoot, "different new root")
+	}
+}
+
+func TestDeleteWitness(t *testing.T) {
+	r := rand.New(rand.NewSource(26))
+	for i := 0; i < 500; i++ {
+		tree := NewTree23(randomKeyValues(r, r.Intn(256)))
+		keysToDelete := randomKeys(r, r.Intn(64))
+		_, witness, err := tree.DeleteWithWitness(keysToDelete, &Stats{})
+		require.NoError(t, err)
+		_, newRoot, err := VerifyDeleteWitness(witness, keysToDelete)
+		require.NoError(t, err, "iteration %d keys %v", i, keysToDelete)
+		assert.Equal(t, tree.RootHash(), newRoot, "different new root")
+	}
+}
+
+func TestWitnessIsPartial(t *testing.T) {
+	tree := NewTree23(K([]Felt{0, 2, 4, 6, 8, 10, 12, 14, 16, 18, 20, 22, 24, 26, 28, 30, 32, 34, 36, 38, 40}))
+	_, witness, err := tree.UpsertWithWitness(K([]Felt{1}), &Stats{})
+	require.NoError(t, err)
+	pruned := 0
+	for _, node := range witness.Nodes {
+		if node.Kind == WitnessPruned {
+			pruned++
+		}
+	}
+	assert.Greater(t, pruned, 0, "no pruned sibling in witness")
+	assert.Less(t, len(witness.Nodes), tree.Size(), "witness not smaller than tree")
+}
+
+func TestWitnessJSON(t *testing.T) {
+	tree := NewTree23(K([]Felt{1, 3, 5, 7, 9, 11, 13}))
+	batch := K([]Felt{4, 8, 15})
+	_, witness, err := tree.UpsertWithWitness(batch.clone(), &Stats{})
+	require.NoError(t, err)
+	buffer := &bytes.Buffer{}
+	require.NoError(t, witness.WriteJSON(buffer))
+	decoded, err := ReadWitness(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, witness, decoded, "different witness after JSON round trip")
+	_, newRoot, err := VerifyUpsertWitness(decoded, batch)
+	require.NoError(t, err)
+	assert.Equal(t, tree.RootHash(), newRoot, "different new root")
+}
+
+func TestWitnessTampered(t *testing.T) {
+	tree := NewTree23(K([]Felt{1, 3, 5, 7, 9, 11, 13}))
+	batch := K([]Felt{4})
+	_, witness, err := tree.UpsertWithWitness(batch.clone(), &Stats{})
+	require.NoError(t, err)
+	for i := range witness.Nodes {
+		if witness.Nodes[i].Kind == WitnessLeaf {
+			witness.Nodes[i].Values[0]++
+			break
+		}
+	}
+	_, _, err = VerifyUpsertWitness(witness, batch)
+	assert.Error(t, err, "tampered witness verified")
+	_, _, err = VerifyDeleteWitness(witness, []Felt{4})
+	assert.Error(t, err, "witness verified for wrong operation")
+}
+
+func TestWitnessTamperedKeys(t *testing.T) {
+	tree := NewTree23(K([]Felt{0, 2, 4, 6, 8, 10, 12, 14, 16, 18, 20, 22, 24, 26, 28, 30, 32, 34, 36, 38, 40}))
+	batch := K([]Felt{1, 21})
+	_, witness, err := tree.UpsertWithWitness(batch.clone(), &Stats{})
+	require.NoError(t, err)
+	tampered := 0
+	for i, node := range witness.Nodes {
+		tamperedWitness := *witness
+		tamperedWitness.Nodes = append([]WitnessNode{}, witness.Nodes...)
+		switch node.Kind {
+		case WitnessInternal:
+			keys := append([]Felt{}, node.Keys...)
+			keys[0]++
+			tamperedWitness.Nodes[i].Keys = keys
+		case WitnessPruned:
+			firstKey := *node.FirstKey + 1
+			tamperedWitness.Nodes[i].FirstKey = &firstKey
+		default:
+			continue
+		}
+		tampered++
+		_, _, err := VerifyUpsertWitness(&tamperedWitness, batch)
+		assert.Error(t, err, "witness verified with tampered node %d", i)
+	}
+	assert.Greater(t, tampered, 1, "no internal or pruned node tampered")
+	_, _, err = VerifyUpsertWitness(witness, batch)
+	assert.NoError(t, err)
+}
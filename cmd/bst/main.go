@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// command is a bst subcommand, parsing its own flags from args.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"repl":  {"explore an AVL, cairo-avl or B+tree interactively", runRepl},
+	"serve": {"serve a Tree23 and optionally a cairo-avl tree over a local JSON-RPC API", runServe},
+	"trace": {"replay a trace recorded by cairo-avl or cairo-bptree as graph frames or animated SVG", runTrace},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [arguments]\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].usage)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, found := commands[os.Args[1]]
+	if !found {
+		log.Errorf("unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		log.Fatalf("%s: %v\n", os.Args[1], err)
+	}
+}
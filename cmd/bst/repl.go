@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/canepat/bst/graph"
+)
+
+const DEFAULT_REPL_TREE string = "bptree"
+const DEFAULT_REPL_GRAPH_DIR string = "testdata/repl"
+const DEFAULT_REPL_GRAPH_FORMAT string = "svg"
+
+const replHelp = `commands:
+  put k v      insert or update key k with value v
+  del k        delete key k
+  get k        print the value of key k
+  range a b    print the pairs with keys between a and b, both included
+  root         print the root
+  stats        print size, height and counters of the last operation
+  graph [name] save the tree graph
+  undo         undo the last put, del or load
+  save file    save the tree into file
+  load file    load the tree from file
+  help         print this help
+  quit         exit`
+
+// repl executes the commands on a tree, printing validity checks after each mutating command.
+type repl struct {
+	tree        replTree
+	out         io.Writer
+	undo        []func() error
+	graphDir    string
+	graphFormat graph.Format
+	graphs      int
+}
+
+func runRepl(args []string) error {
+	flags := flag.NewFlagSet("repl", flag.ExitOnError)
+	kind := flags.String("tree", DEFAULT_REPL_TREE, "the tree variant: "+strings.Join(treeKinds, ", "))
+	loadFileName := flags.String("load", "", "the file name of the tree to load (empty tree if empty)")
+	graphDir := flags.String("graphDir", DEFAULT_REPL_GRAPH_DIR, "the directory where tree graphs are saved")
+	graphFormat := flags.String("graphFormat", DEFAULT_REPL_GRAPH_FORMAT, "the tree graph format: dot, mermaid, json, svg or png (needs Graphviz dot)")
+	flags.Parse(args)
+
+	tree, err := newReplTree(*kind)
+	if err != nil {
+		return err
+	}
+	format, err := graph.ParseFormat(*graphFormat)
+	if err != nil {
+		return err
+	}
+	r := &repl{tree: tree, out: os.Stdout, graphDir: *graphDir, graphFormat: format}
+	if *loadFileName != "" {
+		if err := r.execute("load " + *loadFileName); err != nil {
+			return err
+		}
+	}
+	return r.run(os.Stdin, true)
+}
+
+// run executes the commands read from in until quit or the end of input, printing errors and going on.
+func (r *repl) run(in io.Reader, prompt bool) error {
+	scanner := bufio.NewScanner(in)
+	for {
+		if prompt {
+			fmt.Fprint(r.out, "bst> ")
+		}
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "quit" || line == "exit" {
+			return nil
+		}
+		if err := r.execute(line); err != nil {
+			fmt.Fprintf(r.out, "error: %v\n", err)
+		}
+	}
+}
+
+func parseUints(args []string, names ...string) ([]uint64, error) {
+	if len(args) != len(names) {
+		return nil, fmt.Errorf("expected %d arguments: %s", len(names), strings.Join(names, " "))
+	}
+	values := make([]uint64, len(args))
+	for i, arg := range args {
+		value, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", names[i], arg, err)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// execute executes a command line, turning a panic of the tree into an error so that the session goes on.
+func (r *repl) execute(line string) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%s: %v", line, p)
+		}
+	}()
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	command, args := fields[0], fields[1:]
+	switch command {
+	case "put":
+		values, err := parseUints(args, "k", "v")
+		if err != nil {
+			return err
+		}
+		r.mutated(r.tree.put(values[0], values[1]))
+	case "del":
+		values, err := parseUints(args, "k")
+		if err != nil {
+			return err
+		}
+		r.mutated(r.tree.del(values[0]))
+	case "get":
+		values, err := parseUints(args, "k")
+		if err != nil {
+			return err
+		}
+		if value, found := r.tree.get(values[0]); found {
+			fmt.Fprintf(r.out, "%d\n", value)
+		} else {
+			fmt.Fprintf(r.out, "key %d not found\n", values[0])
+		}
+	case "range":
+		values, err := parseUints(args, "a", "b")
+		if err != nil {
+			return err
+		}
+		pairs := r.tree.rangeOf(values[0], values[1])
+		for _, pair := range pairs {
+			fmt.Fprintf(r.out, "%d %d\n", pair[0], pair[1])
+		}
+		fmt.Fprintf(r.out, "%d pairs\n", len(pairs))
+	case "root":
+		fmt.Fprintln(r.out, r.tree.root())
+	case "stats":
+		fmt.Fprintln(r.out, r.tree.stats())
+	case "graph":
+		if len(args) > 1 {
+			return fmt.Errorf("expected at most 1 argument: name")
+		}
+		r.graphs++
+		name := fmt.Sprintf("tree_%d", r.graphs)
+		if len(args) == 1 {
+			name = args[0]
+		}
+		filename, err := graph.SaveTree(r.graphDir, name, r.tree, r.graphFormat)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(r.out, "graph saved: %s\n", filename)
+	case "undo":
+		if len(args) != 0 {
+			return fmt.Errorf("expected no arguments")
+		}
+		if len(r.undo) == 0 {
+			return fmt.Errorf("nothing to undo")
+		}
+		undo := r.undo[len(r.undo)-1]
+		r.undo = r.undo[:len(r.undo)-1]
+		if err := undo(); err != nil {
+			return err
+		}
+		r.check()
+	case "save":
+		if len(args) != 1 {
+			return fmt.Errorf("expected 1 argument: file")
+		}
+		file, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		if err := r.tree.save(file); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintf(r.out, "tree saved: %s\n", args[0])
+	case "load":
+		if len(args) != 1 {
+			return fmt.Errorf("expected 1 argument: file")
+		}
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		undo, err := r.tree.load(file)
+		if err != nil {
+			return fmt.Errorf("cannot load %s: %v", args[0], err)
+		}
+		fmt.Fprintf(r.out, "tree loaded: %s\n", args[0])
+		r.mutated(undo)
+	case "help":
+		fmt.Fprintln(r.out, replHelp)
+	default:
+		return fmt.Errorf("unknown command %q, type help for the list", command)
+	}
+	return nil
+}
+
+// mutated pushes undo of the last mutating command and checks the tree.
+func (r *repl) mutated(undo func() error) {
+	r.undo = append(r.undo, undo)
+	r.check()
+}
+
+func (r *repl) check() {
+	if err := r.tree.validate(); err != nil {
+		fmt.Fprintf(r.out, "INVALID: %v\n", err)
+		return
+	}
+	fmt.Fprintln(r.out, "valid")
+}
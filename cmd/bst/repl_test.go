@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canepat/bst/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepl(t *testing.T) {
+	for _, kind := range treeKinds {
+		tree, err := newReplTree(kind)
+		require.NoError(t, err)
+		dir := t.TempDir()
+		out := bytes.Buffer{}
+		r := &repl{tree: tree, out: &out, graphDir: dir, graphFormat: graph.JSON}
+		script := []string{
+			"put 5 50", "put 3 30", "put 8 80", "put 1 10", "put 5 55", "get 5", "get 9", "range 2 8",
+			"del 3", "undo", "range 0 100",
+			"save " + filepath.Join(dir, "tree"), "del 1", "del 8", "load " + filepath.Join(dir, "tree"), "range 0 100",
+			"undo", "range 0 100", "undo", "undo", "undo", "range 0 100", "graph", "undo x", "bogus", "quit", "get 5",
+		}
+		require.NoError(t, r.run(strings.NewReader(strings.Join(script, "\n")), false))
+		expected := []string{
+			"valid", "valid", "valid", "valid", "valid", "55", "key 9 not found", "3 30", "5 55", "8 80", "3 pairs",
+			"valid", "valid", "1 10", "3 30", "5 55", "8 80", "4 pairs",
+			"tree saved: " + filepath.Join(dir, "tree"), "valid", "valid", "tree loaded: " + filepath.Join(dir, "tree"), "valid", "1 10", "3 30", "5 55", "8 80", "4 pairs",
+			"valid", "3 30", "5 55", "2 pairs", "valid", "valid", "valid", "1 10", "3 30", "5 50", "8 80", "4 pairs",
+			"graph saved: " + filepath.Join(dir, "tree_1.json"), "error: expected no arguments", `error: unknown command "bogus", type help for the list`,
+		}
+		assert.Equal(t, strings.Join(expected, "\n")+"\n", out.String(), "tree %s", kind)
+	}
+}
+
+func TestReplErrors(t *testing.T) {
+	tree, err := newReplTree("bptree")
+	require.NoError(t, err)
+	out := bytes.Buffer{}
+	r := &repl{tree: tree, out: &out}
+	assert.EqualError(t, r.execute("undo"), "nothing to undo")
+	assert.EqualError(t, r.execute("put 1"), "expected 2 arguments: k v")
+	assert.Error(t, r.execute("get -1"))
+	assert.Error(t, r.execute("load "+filepath.Join(t.TempDir(), "missing")))
+	_, err = newReplTree("rbtree")
+	assert.Error(t, err)
+}
+
+func TestReplDeleteMissingKey(t *testing.T) {
+	script := []string{
+		"put 44 447", "put 35 754", "put 15 798", "put 34 354", "put 5 376", "put 37 296", "put 30 900", "put 29 446",
+		"del 21", "range 0 100", "undo", "range 0 100",
+	}
+	pairs := []string{"5 376", "15 798", "29 446", "30 900", "34 354", "35 754", "37 296", "44 447", "8 pairs"}
+	for _, kind := range treeKinds {
+		tree, err := newReplTree(kind)
+		require.NoError(t, err)
+		out := bytes.Buffer{}
+		r := &repl{tree: tree, out: &out}
+		require.NoError(t, r.run(strings.NewReader(strings.Join(script, "\n")), false))
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		require.Len(t, lines, 9+len(pairs)+1+len(pairs), "tree %s:\n%s", kind, out.String())
+		assert.Equal(t, pairs, lines[9:9+len(pairs)], "tree %s", kind)
+		assert.Equal(t, pairs, lines[9+len(pairs)+1:], "tree %s", kind)
+	}
+}
+
+func TestReplUndo(t *testing.T) {
+	random := rand.New(rand.NewSource(48))
+	for _, kind := range treeKinds {
+		tree, err := newReplTree(kind)
+		require.NoError(t, err)
+		history := [][][2]uint64{}
+		undo := []func() error{}
+		for i := 0; i < 200; i++ {
+			if len(undo) > 0 && random.Intn(4) == 0 {
+				require.NoError(t, undo[len(undo)-1]())
+				undo = undo[:len(undo)-1]
+				require.Equal(t, history[len(history)-1], tree.rangeOf(0, 100), "tree %s, step %d", kind, i)
+				history = history[:len(history)-1]
+				continue
+			}
+			history = append(history, tree.rangeOf(0, 100))
+			if key := uint64(random.Intn(32)); random.Intn(3) == 0 {
+				undo = append(undo, tree.del(key))
+			} else {
+				undo = append(undo, tree.put(key, uint64(random.Intn(1000))))
+			}
+		}
+	}
+}
+
+// panickingTree panics on every put, as a broken tree variant would.
+type panickingTree struct {
+	replTree
+}
+
+func (t panickingTree) put(key, value uint64) func() error {
+	panic("broken tree")
+}
+
+func TestReplRecoversPanic(t *testing.T) {
+	tree, err := newReplTree("bptree")
+	require.NoError(t, err)
+	out := bytes.Buffer{}
+	r := &repl{tree: panickingTree{tree}, out: &out}
+	require.NoError(t, r.run(strings.NewReader("put 1 10\nget 1"), false))
+	assert.Equal(t, "error: put 1 10: broken tree\nkey 1 not found\n", out.String())
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	cairo "github.com/canepat/bst/cairo-avl"
+	cairo_bptree "github.com/canepat/bst/cairo-bptree"
+	"github.com/canepat/bst/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const DEFAULT_SERVE_ADDR string = "127.0.0.1:8023"
+const maxRequestBytes = 16 << 20
+
+// JSON-RPC 2.0 error codes
+const (
+	parseError     = -32700
+	invalidRequest = -32600
+	methodNotFound = -32601
+	invalidParams  = -32602
+)
+
+type rpcRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+type rpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type keyParams struct {
+	Key uint64 `json:"key"`
+}
+
+type rangeParams struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// batchParams are the upserts as keys and values at the same positions plus the deletes, all in any order.
+type batchParams struct {
+	Keys    []uint64 `json:"keys"`
+	Values  []uint64 `json:"values"`
+	Deletes []uint64 `json:"deletes"`
+}
+
+type getResult struct {
+	Value uint64 `json:"value"`
+	Found bool   `json:"found"`
+}
+
+type rangeResult struct {
+	Keys   []uint64 `json:"keys"`
+	Values []uint64 `json:"values"`
+}
+
+type statsResult struct {
+	ExposedCount  uint `json:"exposed"`
+	RehashedCount uint `json:"rehashed"`
+	CreatedCount  uint `json:"created"`
+	UpdatedCount  uint `json:"updated"`
+	DeletedCount  uint `json:"deleted"`
+	OpeningHashes uint `json:"openingHashes"`
+	ClosingHashes uint `json:"closingHashes"`
+}
+
+func newStatsResult(stats *cairo_bptree.Stats) *statsResult {
+	if stats == nil {
+		return nil
+	}
+	return &statsResult{stats.ExposedCount, stats.RehashedCount, stats.CreatedCount, stats.UpdatedCount,
+		stats.DeletedCount, stats.OpeningHashes, stats.ClosingHashes}
+}
+
+type applyResult struct {
+	RootHash    string       `json:"rootHash"`
+	UpsertStats *statsResult `json:"upsertStats"`
+	DeleteStats *statsResult `json:"deleteStats"`
+}
+
+type proofResult struct {
+	RootHash string                   `json:"rootHash"`
+	Proof    *cairo_bptree.MultiProof `json:"proof"`
+}
+
+type treeStatsResult struct {
+	Len         int          `json:"len"`
+	Nodes       int          `json:"nodes"`
+	Height      int          `json:"height"`
+	RootHash    string       `json:"rootHash"`
+	UpsertStats *statsResult `json:"upsertStats"` // of the last batch, nil before any
+	DeleteStats *statsResult `json:"deleteStats"`
+}
+
+type avlApplyResult struct {
+	Size         int    `json:"size"`
+	ExposedCount uint64 `json:"exposed"`
+	HeightCount  uint64 `json:"heightTaken"`
+}
+
+type avlStatsResult struct {
+	Size      int            `json:"size"`
+	Height    int            `json:"height"`
+	LastApply avlApplyResult `json:"lastApply"`
+}
+
+// server hosts a Tree23 and optionally a cairo-avl tree. Requests are served one at a time.
+type server struct {
+	mutex       sync.Mutex
+	tree        *cairo_bptree.Tree23
+	upsertStats *cairo_bptree.Stats
+	deleteStats *cairo_bptree.Stats
+	avl         *cairoAvlTree // nil if not served
+	avlStats    avlApplyResult
+	methods     map[string]func(params json.RawMessage) (interface{}, error)
+	registry    *metrics.Registry
+	metrics     *cairo_bptree.Metrics
+	latency     *metrics.Histogram
+}
+
+func newServer(tree *cairo_bptree.Tree23, withAvl bool) *server {
+	s := &server{tree: tree, registry: metrics.NewRegistry()}
+	s.registry.RegisterRuntime()
+	s.metrics = cairo_bptree.NewMetrics(s.registry)
+	s.latency = s.registry.NewHistogram("bst_rpc_duration_seconds", "Time spent serving the JSON-RPC requests.",
+		metrics.ExponentialBuckets(0.00001, 10, 8), "method")
+	s.methods = map[string]func(params json.RawMessage) (interface{}, error){
+		"tree.get":      s.get,
+		"tree.range":    s.rangeOf,
+		"tree.apply":    s.apply,
+		"tree.rootHash": s.rootHash,
+		"tree.proof":    s.proof,
+		"tree.stats":    s.stats,
+	}
+	if withAvl {
+		s.avl = &cairoAvlTree{counters: &cairo.Counters{}}
+		s.methods["avl.get"] = s.avlGet
+		s.methods["avl.range"] = s.avlRange
+		s.methods["avl.apply"] = s.avlApply
+		s.methods["avl.stats"] = s.avlStatsOf
+	}
+	return s
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSON-RPC requests must be POST", http.StatusMethodNotAllowed)
+		return
+	}
+	response := rpcResponse{Version: "2.0", ID: json.RawMessage("null")}
+	request := rpcRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(&request); err != nil {
+		response.Error = &rpcError{parseError, err.Error()}
+	} else {
+		if len(request.ID) > 0 {
+			response.ID = request.ID
+		}
+		response.Result, response.Error = s.call(request)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("cannot write response: %v\n", err)
+	}
+}
+
+func (s *server) call(request rpcRequest) (interface{}, *rpcError) {
+	if request.Version != "2.0" || request.Method == "" {
+		return nil, &rpcError{invalidRequest, "expected jsonrpc 2.0 request with method"}
+	}
+	method, found := s.methods[request.Method]
+	if !found {
+		return nil, &rpcError{methodNotFound, fmt.Sprintf("method %q not found", request.Method)}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	defer func(start time.Time) { s.latency.Observe(time.Since(start).Seconds(), request.Method) }(time.Now())
+	result, err := method(request.Params)
+	if err != nil {
+		if rpcErr, ok := err.(*rpcError); ok {
+			return nil, rpcErr
+		}
+		return nil, &rpcError{invalidParams, err.Error()}
+	}
+	return result, nil
+}
+
+// decode unmarshals params into v, missing params leaving v as it is.
+func decode(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &rpcError{invalidParams, err.Error()}
+	}
+	return nil
+}
+
+func felts(values []uint64) []cairo_bptree.Felt {
+	felts := make([]cairo_bptree.Felt, len(values))
+	for i, value := range values {
+		felts[i] = cairo_bptree.Felt(value)
+	}
+	return felts
+}
+
+func uints(felts []cairo_bptree.Felt) []uint64 {
+	values := make([]uint64, len(felts))
+	for i, felt := range felts {
+		values[i] = uint64(felt)
+	}
+	return values
+}
+
+func (s *server) get(params json.RawMessage) (interface{}, error) {
+	p := keyParams{}
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	value, found := s.tree.Get(cairo_bptree.Felt(p.Key))
+	return getResult{uint64(value), found}, nil
+}
+
+func (s *server) rangeOf(params json.RawMessage) (interface{}, error) {
+	p := rangeParams{}
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	kvItems := s.tree.Range(cairo_bptree.Felt(p.From), cairo_bptree.Felt(p.To))
+	return rangeResult{uints(kvItems.Keys()), uints(kvItems.Values())}, nil
+}
+
+func (s *server) batch(params json.RawMessage) (cairo_bptree.Batch, error) {
+	p := batchParams{}
+	if err := decode(params, &p); err != nil {
+		return cairo_bptree.Batch{}, err
+	}
+	return cairo_bptree.NewBatch(felts(p.Keys), felts(p.Values), felts(p.Deletes))
+}
+
+func (s *server) apply(params json.RawMessage) (interface{}, error) {
+	batch, err := s.batch(params)
+	if err != nil {
+		return nil, err
+	}
+	s.upsertStats, s.deleteStats = &cairo_bptree.Stats{}, &cairo_bptree.Stats{}
+	if batch.Upserts.Len() > 0 {
+		s.tree.UpsertWithMetrics(batch.Upserts, s.upsertStats, s.metrics)
+	}
+	if len(batch.Deletes) > 0 {
+		s.tree.DeleteWithMetrics(batch.Deletes, s.deleteStats, s.metrics)
+	}
+	return applyResult{hex.EncodeToString(s.tree.RootHash()), newStatsResult(s.upsertStats), newStatsResult(s.deleteStats)}, nil
+}
+
+func (s *server) rootHash(params json.RawMessage) (interface{}, error) {
+	return hex.EncodeToString(s.tree.RootHash()), nil
+}
+
+// proof returns the multiproof of a batch on the current tree, to be checked by ApplyWithProof.
+func (s *server) proof(params json.RawMessage) (interface{}, error) {
+	batch, err := s.batch(params)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := s.tree.MultiProof(batch)
+	if err != nil {
+		return nil, err
+	}
+	return proofResult{hex.EncodeToString(s.tree.RootHash()), proof}, nil
+}
+
+func (s *server) stats(params json.RawMessage) (interface{}, error) {
+	return treeStatsResult{s.tree.Len(), s.tree.Size(), s.tree.Height(), hex.EncodeToString(s.tree.RootHash()),
+		newStatsResult(s.upsertStats), newStatsResult(s.deleteStats)}, nil
+}
+
+func (s *server) avlGet(params json.RawMessage) (interface{}, error) {
+	p := keyParams{}
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	value, found := s.avl.get(p.Key)
+	return getResult{value, found}, nil
+}
+
+func (s *server) avlRange(params json.RawMessage) (interface{}, error) {
+	p := rangeParams{}
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	result := rangeResult{make([]uint64, 0), make([]uint64, 0)}
+	for _, pair := range s.avl.rangeOf(p.From, p.To) {
+		result.Keys, result.Values = append(result.Keys, pair[0]), append(result.Values, pair[1])
+	}
+	return result, nil
+}
+
+// avlApply applies the upserts by Union and then the deletes by Difference, one key at a time, skipping the
+// missing keys to delete.
+func (s *server) avlApply(params json.RawMessage) (interface{}, error) {
+	batch, err := s.batch(params)
+	if err != nil {
+		return nil, err
+	}
+	s.avlStats = avlApplyResult{}
+	count := func() {
+		s.avlStats.ExposedCount += s.avl.counters.ExposedCount
+		s.avlStats.HeightCount += s.avl.counters.HeightCount
+	}
+	keys, values := batch.Upserts.Keys(), batch.Upserts.Values()
+	for i := range keys {
+		s.avl.put(uint64(keys[i]), uint64(values[i]))
+		count()
+	}
+	for _, key := range batch.Deletes {
+		s.avl.del(uint64(key))
+		count()
+	}
+	s.avlStats.Size = s.avl.tree.Size()
+	return s.avlStats, nil
+}
+
+func (s *server) avlStatsOf(params json.RawMessage) (interface{}, error) {
+	return avlStatsResult{s.avl.tree.Size(), cairo.HeightAsInt(s.avl.tree), s.avlStats}, nil
+}
+
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", DEFAULT_SERVE_ADDR, "the address to listen on, loopback unless explicitly set")
+	loadFileName := flags.String("load", "", "the snapshot file name of the Tree23 to serve (empty tree if empty)")
+	withAvl := flags.Bool("avl", false, "flag indicating if a cairo-avl tree shall be served too under the avl methods")
+	metricsAddr := flags.String("metricsAddr", "", "the address serving Prometheus metrics on /metrics (metrics not served if empty)")
+	flags.Parse(args)
+
+	tree := cairo_bptree.NewEmptyTree23()
+	if *loadFileName != "" {
+		file, err := os.Open(*loadFileName)
+		if err != nil {
+			return err
+		}
+		tree, err = cairo_bptree.Load(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("cannot load %s: %v", *loadFileName, err)
+		}
+		log.Printf("Tree loaded: %s, #keys=%d\n", *loadFileName, tree.Len())
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	s := newServer(tree, *withAvl)
+	if *metricsAddr != "" {
+		metricsListener, err := metrics.ListenAndServe(*metricsAddr, s.registry)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		defer metricsListener.Close()
+		log.Printf("Metrics served on http://%s/metrics\n", metricsListener.Addr())
+	}
+	httpServer := &http.Server{Handler: s}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		log.Printf("Shutting down\n")
+		httpServer.Shutdown(context.Background())
+	}()
+	log.Printf("Serving JSON-RPC on http://%s\n", listener.Addr())
+	if err := httpServer.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	cairo_bptree "github.com/canepat/bst/cairo-bptree"
+	"github.com/canepat/bst/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testClient struct {
+	t   *testing.T
+	url string
+	id  int
+}
+
+// startServer serves s on a loopback listener closed at the end of the test.
+func startServer(t *testing.T, s *server) *testClient {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	httpServer := &http.Server{Handler: s}
+	go httpServer.Serve(listener)
+	t.Cleanup(func() { httpServer.Close() })
+	return &testClient{t: t, url: "http://" + listener.Addr().String()}
+}
+
+func (c *testClient) post(body string) rpcResponse {
+	response, err := http.Post(c.url, "application/json", bytes.NewBufferString(body))
+	require.NoError(c.t, err)
+	defer response.Body.Close()
+	require.Equal(c.t, http.StatusOK, response.StatusCode)
+	rpcResponse := rpcResponse{}
+	require.NoError(c.t, json.NewDecoder(response.Body).Decode(&rpcResponse))
+	assert.Equal(c.t, "2.0", rpcResponse.Version)
+	return rpcResponse
+}
+
+// call invokes method with params and decodes its result into result, returning the JSON-RPC error if any.
+func (c *testClient) call(method string, params, result interface{}) *rpcError {
+	c.id++
+	body, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": c.id, "method": method, "params": params})
+	require.NoError(c.t, err)
+	response := c.post(string(body))
+	assert.Equal(c.t, fmt.Sprint(c.id), string(response.ID))
+	if response.Error != nil {
+		return response.Error
+	}
+	encoded, err := json.Marshal(response.Result)
+	require.NoError(c.t, err)
+	require.NoError(c.t, json.Unmarshal(encoded, result))
+	return nil
+}
+
+func TestServe(t *testing.T) {
+	c := startServer(t, newServer(cairo_bptree.NewEmptyTree23(), false))
+
+	applied := applyResult{}
+	require.Nil(t, c.call("tree.apply", batchParams{Keys: []uint64{5, 1, 3, 8, 13, 21}, Values: []uint64{50, 10, 30, 80, 130, 210}}, &applied))
+	assert.NotZero(t, applied.UpsertStats.CreatedCount)
+	assert.Equal(t, uint(0), applied.DeleteStats.DeletedCount)
+
+	got := getResult{}
+	require.Nil(t, c.call("tree.get", keyParams{3}, &got))
+	assert.Equal(t, getResult{30, true}, got)
+	require.Nil(t, c.call("tree.get", keyParams{4}, &got))
+	assert.Equal(t, getResult{0, false}, got)
+
+	ranged := rangeResult{}
+	require.Nil(t, c.call("tree.range", rangeParams{2, 13}, &ranged))
+	assert.Equal(t, rangeResult{[]uint64{3, 5, 8, 13}, []uint64{30, 50, 80, 130}}, ranged)
+
+	batch := batchParams{Keys: []uint64{8, 2}, Values: []uint64{88, 20}, Deletes: []uint64{21, 1}}
+	proved := proofResult{}
+	require.Nil(t, c.call("tree.proof", batch, &proved))
+	rootHash := ""
+	require.Nil(t, c.call("tree.rootHash", nil, &rootHash))
+	assert.Equal(t, applied.RootHash, rootHash)
+	assert.Equal(t, rootHash, proved.RootHash)
+
+	require.Nil(t, c.call("tree.apply", batch, &applied))
+	assert.NotZero(t, applied.DeleteStats.RehashedCount)
+	oldRoot, err := hex.DecodeString(proved.RootHash)
+	require.NoError(t, err)
+	b, err := cairo_bptree.NewBatch(felts(batch.Keys), felts(batch.Values), felts(batch.Deletes))
+	require.NoError(t, err)
+	newRoot, err := cairo_bptree.ApplyWithProof(oldRoot, proved.Proof, b)
+	require.NoError(t, err)
+	assert.Equal(t, applied.RootHash, hex.EncodeToString(newRoot), "proof must reproduce the served root")
+
+	stats := treeStatsResult{}
+	require.Nil(t, c.call("tree.stats", nil, &stats))
+	assert.Equal(t, 5, stats.Len)
+	assert.Equal(t, applied.RootHash, stats.RootHash)
+	assert.Equal(t, applied.UpsertStats, stats.UpsertStats)
+	require.Nil(t, c.call("tree.range", rangeParams{0, 100}, &ranged))
+	assert.Equal(t, rangeResult{[]uint64{2, 3, 5, 8, 13}, []uint64{20, 30, 50, 88, 130}}, ranged)
+}
+
+func TestServeAvl(t *testing.T) {
+	c := startServer(t, newServer(cairo_bptree.NewEmptyTree23(), true))
+
+	applied := avlApplyResult{}
+	require.Nil(t, c.call("avl.apply", batchParams{Keys: []uint64{5, 1, 3, 8}, Values: []uint64{50, 10, 30, 80}, Deletes: []uint64{3}}, &applied))
+	assert.Equal(t, 3, applied.Size)
+
+	got := getResult{}
+	require.Nil(t, c.call("avl.get", keyParams{8}, &got))
+	assert.Equal(t, getResult{80, true}, got)
+	require.Nil(t, c.call("avl.get", keyParams{3}, &got))
+	assert.Equal(t, getResult{0, false}, got)
+
+	ranged := rangeResult{}
+	require.Nil(t, c.call("avl.range", rangeParams{0, 10}, &ranged))
+	assert.Equal(t, rangeResult{[]uint64{1, 5, 8}, []uint64{10, 50, 80}}, ranged)
+
+	stats := avlStatsResult{}
+	require.Nil(t, c.call("avl.stats", nil, &stats))
+	assert.Equal(t, 3, stats.Size)
+	assert.Equal(t, 2, stats.Height)
+	assert.Equal(t, applied, stats.LastApply)
+
+	// Deleting a missing key keeps the tree, even where Difference would drop it
+	c = startServer(t, newServer(cairo_bptree.NewEmptyTree23(), true))
+	keys, values := []uint64{44, 35, 15, 34, 5, 37, 30, 29}, []uint64{447, 754, 798, 354, 376, 296, 900, 446}
+	for i := range keys {
+		require.Nil(t, c.call("avl.apply", batchParams{Keys: keys[i : i+1], Values: values[i : i+1]}, &applied))
+	}
+	require.Nil(t, c.call("avl.apply", batchParams{Deletes: []uint64{21}}, &applied))
+	assert.Equal(t, 8, applied.Size)
+	require.Nil(t, c.call("avl.range", rangeParams{0, 100}, &ranged))
+	assert.Equal(t, rangeResult{[]uint64{5, 15, 29, 30, 34, 35, 37, 44}, []uint64{376, 798, 446, 900, 354, 754, 296, 447}}, ranged)
+
+	// The Tree23 is served independently
+	treeStats := treeStatsResult{}
+	require.Nil(t, c.call("tree.stats", nil, &treeStats))
+	assert.Equal(t, 0, treeStats.Len)
+}
+
+func TestServeErrors(t *testing.T) {
+	c := startServer(t, newServer(cairo_bptree.NewEmptyTree23(), false))
+
+	response := c.post("{")
+	require.NotNil(t, response.Error)
+	assert.Equal(t, parseError, response.Error.Code)
+	assert.Equal(t, "null", string(response.ID))
+
+	response = c.post(`{"jsonrpc": "1.0", "id": 7, "method": "tree.get"}`)
+	require.NotNil(t, response.Error)
+	assert.Equal(t, invalidRequest, response.Error.Code)
+	assert.Equal(t, "7", string(response.ID))
+
+	err := c.call("avl.get", keyParams{1}, &getResult{})
+	require.NotNil(t, err)
+	assert.Equal(t, methodNotFound, err.Code, "avl methods need -avl")
+
+	err = c.call("tree.get", map[string]string{"key": "one"}, &getResult{})
+	require.NotNil(t, err)
+	assert.Equal(t, invalidParams, err.Code)
+
+	err = c.call("tree.apply", batchParams{Keys: []uint64{1, 2}, Values: []uint64{10}}, &applyResult{})
+	require.NotNil(t, err)
+	assert.Equal(t, invalidParams, err.Code)
+
+	response2, httpErr := http.Get(c.url)
+	require.NoError(t, httpErr)
+	response2.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, response2.StatusCode)
+}
+
+func TestServeConcurrent(t *testing.T) {
+	c := startServer(t, newServer(cairo_bptree.NewEmptyTree23(), true))
+
+	const clients, batches = 8, 10
+	wg := sync.WaitGroup{}
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client := &testClient{t: t, url: c.url}
+			for j := 0; j < batches; j++ {
+				key := uint64(i*batches + j)
+				params := batchParams{Keys: []uint64{key}, Values: []uint64{key * 10}}
+				assert.Nil(t, client.call("tree.apply", params, &applyResult{}))
+				assert.Nil(t, client.call("avl.apply", params, &avlApplyResult{}))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := treeStatsResult{}
+	require.Nil(t, c.call("tree.stats", nil, &stats))
+	assert.Equal(t, clients*batches, stats.Len)
+	avlStats := avlStatsResult{}
+	require.Nil(t, c.call("avl.stats", nil, &avlStats))
+	assert.Equal(t, clients*batches, avlStats.Size)
+	ranged := rangeResult{}
+	require.Nil(t, c.call("tree.range", rangeParams{0, clients * batches}, &ranged))
+	for i, key := range ranged.Keys {
+		assert.Equal(t, uint64(i), key)
+		assert.Equal(t, key*10, ranged.Values[i])
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	s := newServer(cairo_bptree.NewEmptyTree23(), false)
+	c := startServer(t, s)
+	listener, err := metrics.ListenAndServe("127.0.0.1:0", s.registry)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	require.Nil(t, c.call("tree.apply", batchParams{Keys: []uint64{1, 2, 3, 4, 5}, Values: []uint64{10, 20, 30, 40, 50}}, &applyResult{}))
+	require.Nil(t, c.call("tree.apply", batchParams{Deletes: []uint64{2, 4}}, &applyResult{}))
+	require.Nil(t, c.call("tree.get", keyParams{1}, &getResult{}))
+
+	response, err := http.Get("http://" + listener.Addr().String() + "/metrics")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, metrics.ContentType, response.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	lines := strings.Split(string(body), "\n")
+	assert.Contains(t, lines, `bptree_batches_total{operation="delete"} 1`)
+	assert.Contains(t, lines, `bptree_batches_total{operation="upsert"} 1`)
+	assert.Contains(t, lines, `bptree_batch_size_sum{operation="upsert"} 5`)
+	assert.Contains(t, lines, `bptree_batch_size_sum{operation="delete"} 2`)
+	assert.Contains(t, lines, "bptree_tree_keys 3")
+	assert.Contains(t, lines, `bst_rpc_duration_seconds_count{method="tree.apply"} 2`)
+	assert.Contains(t, lines, `bst_rpc_duration_seconds_count{method="tree.get"} 1`)
+	types := map[string]string{
+		"bptree_exposed_nodes_total": "counter", "bptree_created_nodes_total": "counter", "bptree_updated_nodes_total": "counter",
+		"bptree_deleted_nodes_total": "counter", "bptree_opening_hashes_total": "counter", "bptree_closing_hashes_total": "counter",
+		"bptree_tree_height": "gauge", "bptree_operation_duration_seconds": "histogram", "go_memstats_heap_alloc_bytes": "gauge",
+	}
+	for name, kind := range types {
+		assert.Contains(t, lines, "# TYPE "+name+" "+kind)
+	}
+}
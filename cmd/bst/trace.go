@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/canepat/bst/graph"
+	log "github.com/sirupsen/logrus"
+)
+
+const DEFAULT_TRACE_DIR string = "testdata/trace"
+const DEFAULT_TRACE_FORMAT string = "svg"
+const DEFAULT_FRAME_SECONDS float64 = 1
+
+// animated is the trace format writing all frames into a single SVG.
+const animated = "animated"
+
+func runTrace(args []string) error {
+	flags := flag.NewFlagSet("trace", flag.ExitOnError)
+	dir := flags.String("outDir", DEFAULT_TRACE_DIR, "the directory where frames are saved")
+	format := flags.String("format", DEFAULT_TRACE_FORMAT, "the frame format: dot, mermaid, json, svg, png (needs Graphviz dot) or animated")
+	frameSeconds := flags.Float64("frameSeconds", DEFAULT_FRAME_SECONDS, "the seconds each frame is shown for in animated format")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s trace [flags] <trace JSON file>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one trace file, got %d", flags.NArg())
+	}
+	if *frameSeconds <= 0 {
+		return fmt.Errorf("frameSeconds must be positive, got %v", *frameSeconds)
+	}
+
+	traceFileName := flags.Arg(0)
+	traceFile, err := os.Open(traceFileName)
+	if err != nil {
+		return err
+	}
+	defer traceFile.Close()
+	trace, err := graph.ReadTrace(traceFile)
+	if err != nil {
+		return fmt.Errorf("cannot read trace file %s: %v", traceFileName, err)
+	}
+	log.Printf("Trace of %s read: %s, #frames=%d\n", trace.Operation, traceFileName, len(trace.Frames))
+
+	if strings.EqualFold(*format, animated) {
+		name := strings.TrimSuffix(filepath.Base(traceFileName), filepath.Ext(traceFileName))
+		filename := filepath.Join(*dir, name+".svg")
+		if err := trace.SaveAnimatedSVG(filename, *frameSeconds); err != nil {
+			return err
+		}
+		log.Printf("Animated SVG file saved: %s\n", filename)
+		return nil
+	}
+	frameFormat, err := graph.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+	filenames, err := trace.SaveFrames(*dir, frameFormat)
+	if err != nil {
+		return err
+	}
+	log.Printf("Frame files saved: %d in %s\n", len(filenames), *dir)
+	return nil
+}
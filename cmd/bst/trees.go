@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+
+	"github.com/canepat/bst/avl"
+	cairo "github.com/canepat/bst/cairo-avl"
+	cairo_bptree "github.com/canepat/bst/cairo-bptree"
+	"github.com/canepat/bst/graph"
+)
+
+// replTree is a tree explored by the repl, having unsigned integer keys and values. Mutating methods return the
+// function undoing them.
+type replTree interface {
+	graph.Exporter
+	put(key, value uint64) func() error
+	del(key uint64) func() error
+	get(key uint64) (uint64, bool)
+	rangeOf(from, to uint64) [][2]uint64
+	root() string
+	stats() string
+	validate() error
+	save(w io.Writer) error
+	load(r io.Reader) (func() error, error)
+}
+
+var treeKinds = []string{"avl", "cairo-avl", "bptree"}
+
+func newReplTree(kind string) (replTree, error) {
+	switch kind {
+	case "avl":
+		return &avlTree{}, nil
+	case "cairo-avl":
+		return &cairoAvlTree{counters: &cairo.Counters{}}, nil
+	case "bptree":
+		return &bptree{tree: cairo_bptree.NewEmptyTree23()}, nil
+	}
+	return nil, fmt.Errorf("unknown tree %q, expected one of %v", kind, treeKinds)
+}
+
+// writePairs writes a pair per line, the format saved by AVL trees.
+func writePairs(w io.Writer, pairs [][2]uint64) error {
+	writer := bufio.NewWriter(w)
+	for _, pair := range pairs {
+		fmt.Fprintf(writer, "%d %d\n", pair[0], pair[1])
+	}
+	return writer.Flush()
+}
+
+// sortedPairs sorts pairs by key, AVL walks not being in key order.
+func sortedPairs(pairs [][2]uint64) [][2]uint64 {
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+	return pairs
+}
+
+func readPairs(r io.Reader) ([][2]uint64, error) {
+	pairs := make([][2]uint64, 0)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		var pair [2]uint64
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %d", &pair[0], &pair[1]); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, scanner.Err()
+}
+
+type avlTree struct {
+	tree *avl.Node
+}
+
+func (t *avlTree) Export(w io.Writer, format graph.Format) error {
+	return t.tree.Export(w, format)
+}
+
+// snapshot returns the function rebuilding the tree from its current pairs: Insert and Delete rotate nodes in
+// place, so the previous root no longer holds the previous tree.
+func (t *avlTree) snapshot() func() error {
+	pairs := t.rangeOf(0, ^uint64(0))
+	return func() error {
+		t.tree = nil
+		for _, pair := range pairs {
+			t.insert(pair[0], pair[1])
+		}
+		return nil
+	}
+}
+
+func (t *avlTree) insert(key, value uint64) {
+	t.tree = avl.Insert(t.tree, new(big.Int).SetUint64(key), new(big.Int).SetUint64(value))
+}
+
+func (t *avlTree) put(key, value uint64) func() error {
+	undo := t.snapshot()
+	t.insert(key, value)
+	return undo
+}
+
+func (t *avlTree) del(key uint64) func() error {
+	undo := t.snapshot()
+	t.tree = avl.Delete(t.tree, new(big.Int).SetUint64(key))
+	return undo
+}
+
+func (t *avlTree) get(key uint64) (uint64, bool) {
+	n := avl.Search(t.tree, new(big.Int).SetUint64(key))
+	if n == nil {
+		return 0, false
+	}
+	return n.Value.Uint64(), true
+}
+
+func (t *avlTree) rangeOf(from, to uint64) [][2]uint64 {
+	pairs := make([][2]uint64, 0)
+	for _, n := range t.tree.WalkNodesInOrder() {
+		if key := n.Key.Uint64(); key >= from && key <= to {
+			pairs = append(pairs, [2]uint64{key, n.Value.Uint64()})
+		}
+	}
+	return sortedPairs(pairs)
+}
+
+func (t *avlTree) root() string {
+	if t.tree == nil {
+		return "empty"
+	}
+	return fmt.Sprintf("key=%v value=%v height=%d", t.tree.Key, t.tree.Value, avl.HeightAsInt(t.tree))
+}
+
+func (t *avlTree) stats() string {
+	return fmt.Sprintf("size=%d height=%d", len(t.tree.WalkKeysInOrder()), avl.HeightAsInt(t.tree))
+}
+
+func (t *avlTree) validate() error {
+	if !t.tree.IsBST() {
+		return fmt.Errorf("BST property failed")
+	}
+	if !t.tree.IsBalanced() {
+		return fmt.Errorf("AVL balance property failed")
+	}
+	return nil
+}
+
+func (t *avlTree) save(w io.Writer) error {
+	return writePairs(w, t.rangeOf(0, ^uint64(0)))
+}
+
+func (t *avlTree) load(r io.Reader) (func() error, error) {
+	pairs, err := readPairs(r)
+	if err != nil {
+		return nil, err
+	}
+	undo := t.snapshot()
+	t.tree = nil
+	for _, pair := range pairs {
+		t.insert(pair[0], pair[1])
+	}
+	return undo, nil
+}
+
+type cairoAvlTree struct {
+	tree     *cairo.Node
+	counters *cairo.Counters // of the last operation
+}
+
+func (t *cairoAvlTree) Export(w io.Writer, format graph.Format) error {
+	return t.tree.Export(w, format)
+}
+
+func (t *cairoAvlTree) restore(tree *cairo.Node) func() error {
+	return func() error {
+		t.tree, t.counters = tree, &cairo.Counters{}
+		return nil
+	}
+}
+
+func (t *cairoAvlTree) put(key, value uint64) func() error {
+	undo := t.restore(t.tree)
+	t.counters = &cairo.Counters{}
+	change := cairo.NewDict(new(cairo.Felt).SetUint64(key), new(cairo.Felt).SetUint64(value), nil, nil, nil, nil)
+	t.tree = cairo.Union(t.tree, change, t.counters)
+	return undo
+}
+
+func (t *cairoAvlTree) del(key uint64) func() error {
+	undo := t.restore(t.tree)
+	t.counters = &cairo.Counters{}
+	change := cairo.NewDict(new(cairo.Felt).SetUint64(key), cairo.NewFelt(0), nil, nil, nil, nil)
+	t.tree = cairo.Difference(t.tree, change, t.counters)
+	return undo
+}
+
+func (t *cairoAvlTree) get(key uint64) (uint64, bool) {
+	n := t.tree.Search(new(cairo.Felt).SetUint64(key))
+	if n == nil || n.Value() == nil {
+		return 0, false
+	}
+	return n.Value().Uint64(), true
+}
+
+func (t *cairoAvlTree) rangeOf(from, to uint64) [][2]uint64 {
+	pairs := make([][2]uint64, 0)
+	for _, n := range t.tree.WalkNodesInOrder() {
+		if key := n.Key().Uint64(); key >= from && key <= to && n.Value() != nil {
+			pairs = append(pairs, [2]uint64{key, n.Value().Uint64()})
+		}
+	}
+	return sortedPairs(pairs)
+}
+
+func (t *cairoAvlTree) root() string {
+	if t.tree == nil {
+		return "empty"
+	}
+	return fmt.Sprintf("key=%v value=%v height=%d", t.tree.Key(), t.tree.Value(), cairo.HeightAsInt(t.tree))
+}
+
+func (t *cairoAvlTree) stats() string {
+	return fmt.Sprintf("size=%d height=%d exposed=%d heightTaken=%d rehashed=%d", t.tree.Size(), cairo.HeightAsInt(t.tree),
+		t.counters.ExposedCount, t.counters.HeightCount, t.tree.CountNewHashes())
+}
+
+func (t *cairoAvlTree) validate() error {
+	if !t.tree.IsBST() {
+		return fmt.Errorf("BST property failed")
+	}
+	if !t.tree.IsBalanced() {
+		return fmt.Errorf("AVL balance property failed")
+	}
+	return nil
+}
+
+func (t *cairoAvlTree) save(w io.Writer) error {
+	return writePairs(w, t.rangeOf(0, ^uint64(0)))
+}
+
+func (t *cairoAvlTree) load(r io.Reader) (func() error, error) {
+	pairs, err := readPairs(r)
+	if err != nil {
+		return nil, err
+	}
+	undo := t.restore(t.tree)
+	t.tree = nil
+	for _, pair := range pairs {
+		t.put(pair[0], pair[1])
+	}
+	t.counters = &cairo.Counters{}
+	return undo, nil
+}
+
+type bptree struct {
+	tree *cairo_bptree.Tree23
+	last *cairo_bptree.Stats // of the last batch, nil if undone
+}
+
+func (t *bptree) Export(w io.Writer, format graph.Format) error {
+	return t.tree.Export(w, format)
+}
+
+// rollback returns the function rolling back the batch which recorded undo.
+func (t *bptree) rollback(undo *cairo_bptree.UndoLog) func() error {
+	return func() error {
+		t.last = nil
+		return t.tree.Rollback(undo)
+	}
+}
+
+func (t *bptree) put(key, value uint64) func() error {
+	undo := &cairo_bptree.UndoLog{}
+	kvItems, _ := cairo_bptree.NewKeyValues([]cairo_bptree.Felt{cairo_bptree.Felt(key)}, []cairo_bptree.Felt{cairo_bptree.Felt(value)})
+	t.last = &cairo_bptree.Stats{UndoLog: undo}
+	t.tree.UpsertWithStats(kvItems, t.last)
+	return t.rollback(undo)
+}
+
+func (t *bptree) del(key uint64) func() error {
+	undo := &cairo_bptree.UndoLog{}
+	t.last = &cairo_bptree.Stats{UndoLog: undo}
+	t.tree.DeleteWithStats([]cairo_bptree.Felt{cairo_bptree.Felt(key)}, t.last)
+	return t.rollback(undo)
+}
+
+func (t *bptree) get(key uint64) (uint64, bool) {
+	value, found := t.tree.Get(cairo_bptree.Felt(key))
+	return uint64(value), found
+}
+
+func (t *bptree) rangeOf(from, to uint64) [][2]uint64 {
+	kvItems := t.tree.Range(cairo_bptree.Felt(from), cairo_bptree.Felt(to))
+	keys, values := kvItems.Keys(), kvItems.Values()
+	pairs := make([][2]uint64, len(keys))
+	for i := range keys {
+		pairs[i] = [2]uint64{uint64(keys[i]), uint64(values[i])}
+	}
+	return pairs
+}
+
+func (t *bptree) root() string {
+	if t.tree.Len() == 0 {
+		return "empty"
+	}
+	return fmt.Sprintf("hash=%s height=%d", hex.EncodeToString(t.tree.RootHash()), t.tree.Height())
+}
+
+func (t *bptree) stats() string {
+	s := fmt.Sprintf("size=%d height=%d", t.tree.Len(), t.tree.Height())
+	if t.last != nil {
+		s += fmt.Sprintf(" exposed=%d rehashed=%d created=%d updated=%d deleted=%d openingHashes=%d closingHashes=%d",
+			t.last.ExposedCount, t.last.RehashedCount, t.last.CreatedCount, t.last.UpdatedCount, t.last.DeletedCount,
+			t.last.OpeningHashes, t.last.ClosingHashes)
+	}
+	return s
+}
+
+func (t *bptree) validate() error {
+	// The error describes the last node checked even if the tree is valid
+	if valid, err := t.tree.IsValid(); !valid {
+		return err
+	}
+	return nil
+}
+
+func (t *bptree) save(w io.Writer) error {
+	return t.tree.Save(w)
+}
+
+func (t *bptree) load(r io.Reader) (func() error, error) {
+	tree, err := cairo_bptree.Load(r)
+	if err != nil {
+		return nil, err
+	}
+	previous := t.tree
+	t.tree, t.last = tree, nil
+	return func() error {
+		t.tree = previous
+		return nil
+	}, nil
+}
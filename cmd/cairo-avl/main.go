@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	cairo "github.com/canepat/bst/cairo-avl"
+	"github.com/canepat/bst/graph"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -21,6 +22,59 @@ func outputNameFromInputName(inputFileName string) string {
 	return strings.ReplaceAll(inputFileName, ".", "_")
 }
 
+func saveGraph(tree graph.Exporter, name string) {
+	if !options.graph {
+		return
+	}
+	format, _ := graph.ParseFormat(options.graphFormat)
+	filename, err := graph.SaveTree(options.graphDir, name, tree, format)
+	if err != nil {
+		log.Errorf("cannot save %s graph: %v\n", name, err)
+		return
+	}
+	log.Printf("Graph file saved: %s\n", filename)
+}
+
+func newBatchReport(state *cairo.Node) *cairo.BatchReport {
+	if options.reportFileName == "" {
+		return nil
+	}
+	return cairo.NewBatchReport(state)
+}
+
+func saveReport(report graph.Report, suffix string) {
+	reportFileName := options.reportFileName + suffix + ".html"
+	if err := graph.SaveHTML(reportFileName, report); err != nil {
+		log.Errorf("cannot save report file %s: %v\n", reportFileName, err)
+		return
+	}
+	log.Printf("Report file saved: %s\n", reportFileName)
+}
+
+func newTracer(operation string) *cairo.Tracer {
+	if options.traceFileName == "" {
+		return nil
+	}
+	return cairo.NewTracer(operation)
+}
+
+func saveTrace(tracer *cairo.Tracer, suffix string) {
+	if tracer == nil {
+		return
+	}
+	traceFile, err := os.Create(options.traceFileName + suffix + ".json")
+	if err != nil {
+		log.Errorf("cannot create trace file: %v\n", err)
+		return
+	}
+	defer traceFile.Close()
+	if err := tracer.Trace().WriteJSON(traceFile); err != nil {
+		log.Errorf("cannot write trace file %s: %v\n", traceFile.Name(), err)
+		return
+	}
+	log.Printf("Trace file saved: %s, #frames=%d\n", traceFile.Name(), len(tracer.Trace().Frames))
+}
+
 func readFromBinaryFile(binaryFilename string, readFunction func(*bufio.Reader) interface{}) interface{} {
 	binaryFile, err := os.Open(binaryFilename)
 	check(err)
@@ -32,7 +86,7 @@ func readFromBinaryFile(binaryFilename string, readFunction func(*bufio.Reader)
 func readStateFromBinaryFile(stateFilename string, keySize int, nested bool) (t *cairo.Node, err error) {
 	readFromBinaryFile(stateFilename, func(statesReader *bufio.Reader) interface{} {
 		t, err = cairo.StateFromBinary(statesReader, keySize, nested)
-		t.GraphAndPicture(outputNameFromInputName(stateFilename), /*debug=*/false)
+		saveGraph(t, outputNameFromInputName(stateFilename))
 		return t
 	})
 	return t, err
@@ -41,7 +95,7 @@ func readStateFromBinaryFile(stateFilename string, keySize int, nested bool) (t
 func readStateChangesFromBinaryFile(stateChangesFileName string, keySize int, nested bool) (d *cairo.Dict, err error) {
 	readFromBinaryFile(stateChangesFileName, func(statesReader *bufio.Reader) interface{} {
 		d, err = cairo.StateChangesFromBinary(statesReader, keySize, nested)
-		d.GraphAndPicture(outputNameFromInputName(stateChangesFileName))
+		saveGraph(d, outputNameFromInputName(stateChangesFileName))
 		return d
 	})
 	return d, err
@@ -58,7 +112,7 @@ func readFromCsvFile(csvFileName string, scanFromCsv func(*bufio.Scanner) interf
 func readStateFromCsvFile(stateFileName string) (t *cairo.Node, err error) {
 	readFromCsvFile(stateFileName, func(state *bufio.Scanner) interface{} {
 		t, err = cairo.StateFromCsv(state)
-		t.GraphAndPicture(outputNameFromInputName(stateFileName), /*debug=*/false)
+		saveGraph(t, outputNameFromInputName(stateFileName))
 		return t
 	})
 	return t, err
@@ -67,7 +121,7 @@ func readStateFromCsvFile(stateFileName string) (t *cairo.Node, err error) {
 func readStateChangesFromCsvFile(stateChangesFileName string) (d *cairo.Dict, err error) {
 	readFromCsvFile(stateChangesFileName, func(stateChanges *bufio.Scanner) interface{} {
 		d, err = cairo.StateChangesFromCsv(stateChanges)
-		d.GraphAndPicture(outputNameFromInputName(stateChangesFileName))
+		saveGraph(d, outputNameFromInputName(stateChangesFileName))
 		return d
 	})
 	return d, err
@@ -91,6 +145,10 @@ func init() {
 	flag.BoolVar(&options.nested, "nested", false, "flag indicating if tree should be nested or not")
 	flag.StringVar(&options.logLevel, "logLevel", "INFO", "the logging level")
 	flag.BoolVar(&options.graph, "graph", false, "flag indicating if tree graph should be saved or not")
+	flag.StringVar(&options.graphDir, "graphDir", "testdata/graph", "the directory where tree graphs are saved")
+	flag.StringVar(&options.graphFormat, "graphFormat", "svg", "the tree graph format: dot, mermaid, json, svg or png (needs Graphviz dot)")
+	flag.StringVar(&options.reportFileName, "reportFileName", "", "the before/after HTML report file name prefix (report not saved if empty)")
+	flag.StringVar(&options.traceFileName, "traceFileName", "", "the step-by-step trace JSON file name prefix, meant for small trees (trace not saved if empty)")
 }
 
 type Options struct {
@@ -100,6 +158,10 @@ type Options struct {
 	nested			bool
 	logLevel		string
 	graph			bool
+	graphDir		string
+	graphFormat		string
+	reportFileName		string
+	traceFileName		string
 }
 
 func main() {
@@ -114,9 +176,11 @@ func main() {
 	level, err := log.ParseLevel(options.logLevel)
 	if err != nil {
 		log.Fatalln("logLevel argument error: ", err)
-		os.Exit(0)
 	}
 	log.SetLevel(level)
+	if _, err := graph.ParseFormat(options.graphFormat); options.graph && err != nil {
+		log.Fatalln("graphFormat argument error: ", err)
+	}
 
 	log.Printf("Name of the state file: %s\n", options.stateFileName)
 	log.Printf("Name of the state changes file: %s\n", options.stateChangesFileName)
@@ -131,35 +195,32 @@ func main() {
 	if stateFileExt == ".csv" && stateChangesFileExt == ".csv" {
 		state, err = readStateFromCsvFile(options.stateFileName)
 		if err != nil {
-			log.Fatalln("error reading CSV state file: %s", err)
-			os.Exit(1)
+			log.Fatalf("error reading CSV state file: %v\n", err)
 		}
 		stateChanges, err = readStateChangesFromCsvFile(options.stateChangesFileName)
 		if err != nil {
-			log.Fatalln("error reading CSV state change file: %s", err)
-			os.Exit(1)
+			log.Fatalf("error reading CSV state change file: %v\n", err)
 		}
 	} else {
 		state, err = readStateFromBinaryFile(options.stateFileName, options.keySize, options.nested)
 		if err != nil {
-			log.Fatalln("error reading BIN state file: %s", err)
-			os.Exit(1)
+			log.Fatalf("error reading BIN state file: %v\n", err)
 		}
 		stateChanges, err = readStateChangesFromBinaryFile(options.stateChangesFileName, options.keySize, options.nested)
 		if err != nil {
-			log.Fatalln("error reading BIN state change file: %s", err)
-			os.Exit(1)
+			log.Fatalf("error reading BIN state change file: %v\n", err)
 		}
 	}
 
-	if options.graph {
-		state.GraphAndPicture("state_" + outputNameFromInputName(options.stateFileName), /*debug=*/false)
-	}
+	saveGraph(state, "state_" + outputNameFromInputName(options.stateFileName))
 
-	unionStats := &cairo.Counters{}
+	batchReport := newBatchReport(state)
+	unionStats := &cairo.Counters{Tracer: newTracer("UNION")}
 	newState := cairo.Union(state, stateChanges, unionStats)
-	if options.graph {
-		newState.GraphAndPicture("stateAfterUnion_" + outputNameFromInputName(options.stateFileName), /*debug=*/false)
+	saveTrace(unionStats.Tracer, "_union")
+	saveGraph(newState, "stateAfterUnion_" + outputNameFromInputName(options.stateFileName))
+	if batchReport != nil {
+		saveReport(batchReport.Report("UNION", newState, unionStats), "_union")
 	}
 
 	log.Printf("UNION: Number of nodes in the current state tree: %d\n", state.Size())
@@ -169,10 +230,13 @@ func main() {
 	log.Printf("UNION: Number of nodes exposed: %d\n", unionStats.ExposedCount)
 	log.Printf("UNION: Number of nodes with height taken: %d\n", unionStats.HeightCount)
 
-	diffStats := &cairo.Counters{}
+	batchReport = newBatchReport(state)
+	diffStats := &cairo.Counters{Tracer: newTracer("DIFFERENCE")}
 	newState = cairo.Difference(state, stateChanges, diffStats)
-	if options.graph {
-		newState.GraphAndPicture("stateAfterDiff_" + outputNameFromInputName(options.stateFileName), /*debug=*/false)
+	saveTrace(diffStats.Tracer, "_difference")
+	saveGraph(newState, "stateAfterDiff_" + outputNameFromInputName(options.stateFileName))
+	if batchReport != nil {
+		saveReport(batchReport.Report("DIFFERENCE", newState, diffStats), "_difference")
 	}
 
 	log.Printf("DIFFERENCE: Number of nodes in the current state tree: %d\n", state.Size())
@@ -3,8 +3,12 @@ package main
 import (
 	"flag"
 	"os"
+	"os/signal"
+	"time"
 
 	cairo_bptree "github.com/canepat/bst/cairo-bptree"
+	"github.com/canepat/bst/graph"
+	"github.com/canepat/bst/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -14,8 +18,15 @@ const DEFAULT_KEY_SIZE uint = 4
 const DEFAULT_NESTED bool = false
 const DEFAULT_LOG_LEVEL string = "INFO"
 const DEFAULT_GRAPH bool = false
+const DEFAULT_GRAPH_DIR string = "testdata/graph"
+const DEFAULT_GRAPH_FORMAT string = "svg"
+const DEFAULT_WITNESS_FILE_NAME string = ""
+const DEFAULT_REPORT_FILE_NAME string = ""
+const DEFAULT_TRACE_FILE_NAME string = ""
+const DEFAULT_METRICS_ADDR string = ""
 
 var options Options
+var treeMetrics *cairo_bptree.Metrics
 
 func init() {
 	const hasCustomFormatter = false
@@ -37,6 +48,12 @@ func init() {
 	flag.BoolVar(&options.nested, "nested", DEFAULT_NESTED, "flag indicating if tree should be nested or not")
 	flag.StringVar(&options.logLevel, "logLevel", DEFAULT_LOG_LEVEL, "the logging level")
 	flag.BoolVar(&options.graph, "graph", DEFAULT_GRAPH, "flag indicating if tree graph should be saved or not")
+	flag.StringVar(&options.graphDir, "graphDir", DEFAULT_GRAPH_DIR, "the directory where tree graphs are saved")
+	flag.StringVar(&options.graphFormat, "graphFormat", DEFAULT_GRAPH_FORMAT, "the tree graph format: dot, mermaid, json, svg or png (needs Graphviz dot)")
+	flag.StringVar(&options.witnessFileName, "witnessFileName", DEFAULT_WITNESS_FILE_NAME, "the witness JSON file name prefix (witness not saved if empty)")
+	flag.StringVar(&options.reportFileName, "reportFileName", DEFAULT_REPORT_FILE_NAME, "the before/after HTML report file name prefix (report not saved if empty)")
+	flag.StringVar(&options.traceFileName, "traceFileName", DEFAULT_TRACE_FILE_NAME, "the step-by-step trace JSON file name prefix, meant for small trees (trace not saved if empty)")
+	flag.StringVar(&options.metricsAddr, "metricsAddr", DEFAULT_METRICS_ADDR, "the address serving Prometheus metrics on /metrics until interrupted, e.g. 127.0.0.1:9090 (metrics not served if empty)")
 }
 
 type Options struct {
@@ -50,6 +67,122 @@ type Options struct {
 	nested			bool
 	logLevel		string
 	graph			bool
+	graphDir		string
+	graphFormat		string
+	witnessFileName		string
+	reportFileName		string
+	traceFileName		string
+	metricsAddr		string
+}
+
+func saveGraph(tree *cairo_bptree.Tree23, name string) {
+	if !options.graph {
+		return
+	}
+	format, _ := graph.ParseFormat(options.graphFormat)
+	filename, err := graph.SaveTree(options.graphDir, name, tree, format)
+	if err != nil {
+		log.Errorf("cannot save %s graph: %v\n", name, err)
+		return
+	}
+	log.Printf("Graph file saved: %s\n", filename)
+}
+
+func saveWitness(witness *cairo_bptree.Witness, suffix string) {
+	witnessFile, err := os.Create(options.witnessFileName + suffix + ".json")
+	if err != nil {
+		log.Errorf("cannot create witness file: %v\n", err)
+		return
+	}
+	defer witnessFile.Close()
+	if err := witness.WriteJSON(witnessFile); err != nil {
+		log.Errorf("cannot write witness file %s: %v\n", witnessFile.Name(), err)
+		return
+	}
+	log.Printf("Witness file saved: %s, #nodes=%d\n", witnessFile.Name(), len(witness.Nodes))
+}
+
+func newBatchReport(state *cairo_bptree.Tree23) *cairo_bptree.BatchReport {
+	if options.reportFileName == "" {
+		return nil
+	}
+	batchReport, err := cairo_bptree.NewBatchReport(state)
+	if err != nil {
+		log.Errorf("cannot picture the tree before the batch: %v\n", err)
+		return nil
+	}
+	return batchReport
+}
+
+func saveReport(batchReport *cairo_bptree.BatchReport, title string, state *cairo_bptree.Tree23, stats *cairo_bptree.Stats, suffix string) {
+	report, err := batchReport.Report(title, state, stats)
+	if err != nil {
+		log.Errorf("cannot picture the tree after the batch: %v\n", err)
+		return
+	}
+	reportFileName := options.reportFileName + suffix + ".html"
+	if err := graph.SaveHTML(reportFileName, report); err != nil {
+		log.Errorf("cannot save report file %s: %v\n", reportFileName, err)
+		return
+	}
+	log.Printf("Report file saved: %s\n", reportFileName)
+}
+
+func newTracer(state *cairo_bptree.Tree23, operation string) *cairo_bptree.Tracer {
+	if options.traceFileName == "" {
+		return nil
+	}
+	return cairo_bptree.NewTracer(state, operation)
+}
+
+func saveTrace(tracer *cairo_bptree.Tracer, suffix string) {
+	trace, err := tracer.Stop()
+	if err != nil {
+		log.Errorf("cannot trace the batch: %v\n", err)
+		return
+	}
+	traceFile, err := os.Create(options.traceFileName + suffix + ".json")
+	if err != nil {
+		log.Errorf("cannot create trace file: %v\n", err)
+		return
+	}
+	defer traceFile.Close()
+	if err := trace.WriteJSON(traceFile); err != nil {
+		log.Errorf("cannot write trace file %s: %v\n", traceFile.Name(), err)
+		return
+	}
+	log.Printf("Trace file saved: %s, #frames=%d\n", traceFile.Name(), len(trace.Frames))
+}
+
+func serveMetrics() {
+	if options.metricsAddr == "" {
+		return
+	}
+	registry := metrics.NewRegistry()
+	registry.RegisterRuntime()
+	treeMetrics = cairo_bptree.NewMetrics(registry)
+	listener, err := metrics.ListenAndServe(options.metricsAddr, registry)
+	if err != nil {
+		log.Fatalf("cannot serve metrics: %v\n", err)
+	}
+	log.Printf("Metrics served on http://%s/metrics\n", listener.Addr())
+}
+
+func observe(operation string, state *cairo_bptree.Tree23, batchSize int, stats *cairo_bptree.Stats, start time.Time) {
+	if treeMetrics != nil {
+		treeMetrics.Observe(operation, state, batchSize, stats, time.Since(start))
+	}
+}
+
+// waitMetrics keeps serving metrics until interrupted, the bulk operations being done.
+func waitMetrics() {
+	if treeMetrics == nil {
+		return
+	}
+	log.Printf("Serving metrics until interrupted\n")
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
 }
 
 func bulkUpsert(keyFactory cairo_bptree.KeyFactory, kvPairs, stateChanges cairo_bptree.KeyValues) {
@@ -57,18 +190,36 @@ func bulkUpsert(keyFactory cairo_bptree.KeyFactory, kvPairs, stateChanges cairo_
 	state := cairo_bptree.NewTree23(kvPairs)
 	log.Printf("UPSERT: created tree: %v\n", state)
 
-	if options.graph {
-		state.GraphAndPicture("state")
-	}
+	saveGraph(state, "state")
 
 	log.Printf("UPSERT: number of nodes in the current state tree: %d\n", state.Size())
+	log.Printf("UPSERT: profile of the current state tree: %s\n", state.Profile())
 	log.Printf("UPSERT: number of state changes: %d\n", stateChanges.Len())
 	log.Debugf("UPSERT: state changes as key-value pairs: %v\n", stateChanges)
 
+	batchReport := newBatchReport(state)
+	tracer := newTracer(state, "UPSERT")
 	stats := &cairo_bptree.Stats{}
-	stateAfterUpsert := state.UpsertWithStats(stateChanges, stats)
+	var stateAfterUpsert *cairo_bptree.Tree23
+	batchSize, start := stateChanges.Len(), time.Now()
+	if options.witnessFileName != "" {
+		var witness *cairo_bptree.Witness
+		var err error
+		if stateAfterUpsert, witness, err = state.UpsertWithWitness(stateChanges, stats); err != nil {
+			log.Fatalf("UPSERT: cannot build witness: %v\n", err)
+		}
+		observe("upsert", stateAfterUpsert, batchSize, stats, start)
+		saveWitness(witness, "_upsert")
+	} else {
+		stateAfterUpsert = state.UpsertWithStats(stateChanges, stats)
+		observe("upsert", stateAfterUpsert, batchSize, stats, start)
+	}
+	if tracer != nil {
+		saveTrace(tracer, "_upsert")
+	}
 
 	log.Printf("UPSERT: number of nodes in the next state tree: %d\n", stateAfterUpsert.Size())
+	log.Printf("UPSERT: profile of the next state tree: %s\n", stateAfterUpsert.Profile())
 	log.Printf("UPSERT: number of re-hashed nodes for the next state: %d\n", stats.RehashedCount)
 	log.Printf("UPSERT: number of existing nodes exposed: %d\n", stats.ExposedCount)
 	log.Printf("UPSERT: number of hashes (opening): %d\n", stats.OpeningHashes)
@@ -77,8 +228,9 @@ func bulkUpsert(keyFactory cairo_bptree.KeyFactory, kvPairs, stateChanges cairo_
 	log.Printf("UPSERT: number of updated values: %d\n", stats.UpdatedCount)
 	log.Printf("UPSERT: number of hashes (closing): %d\n", stats.ClosingHashes)
 
-	if options.graph {
-		stateAfterUpsert.GraphAndPicture("stateAfterUpsert")
+	saveGraph(stateAfterUpsert, "stateAfterUpsert")
+	if batchReport != nil {
+		saveReport(batchReport, "UPSERT", stateAfterUpsert, stats, "_upsert")
 	}
 }
 
@@ -88,13 +240,33 @@ func bulkDelete(keyFactory cairo_bptree.KeyFactory, kvPairs cairo_bptree.KeyValu
 	log.Printf("DELETE: created tree: %v\n", state)
 
 	log.Printf("DELETE: number of nodes in the current state tree: %d\n", state.Size())
+	log.Printf("DELETE: profile of the current state tree: %s\n", state.Profile())
 	log.Printf("DELETE: number of state deletes: %d\n", stateDeletes.Len())
 	log.Debugf("DELETE: state deletes as keys: %v\n", stateDeletes)
 
+	batchReport := newBatchReport(state)
+	tracer := newTracer(state, "DELETE")
 	stats := &cairo_bptree.Stats{}
-	stateAfterDelete := state.DeleteWithStats(stateDeletes, stats)
+	var stateAfterDelete *cairo_bptree.Tree23
+	start := time.Now()
+	if options.witnessFileName != "" {
+		var witness *cairo_bptree.Witness
+		var err error
+		if stateAfterDelete, witness, err = state.DeleteWithWitness(stateDeletes, stats); err != nil {
+			log.Fatalf("DELETE: cannot build witness: %v\n", err)
+		}
+		observe("delete", stateAfterDelete, stateDeletes.Len(), stats, start)
+		saveWitness(witness, "_delete")
+	} else {
+		stateAfterDelete = state.DeleteWithStats(stateDeletes, stats)
+		observe("delete", stateAfterDelete, stateDeletes.Len(), stats, start)
+	}
+	if tracer != nil {
+		saveTrace(tracer, "_delete")
+	}
 
 	log.Printf("DELETE: number of nodes in the next state tree: %d\n", stateAfterDelete.Size())
+	log.Printf("DELETE: profile of the next state tree: %s\n", stateAfterDelete.Profile())
 	log.Printf("DELETE: number of re-hashed nodes for the next state: %d\n", stats.RehashedCount)
 	log.Printf("DELETE: number of existing nodes exposed: %d\n", stats.ExposedCount)
 	log.Printf("DELETE: number of hashes (opening): %d\n", stats.OpeningHashes)
@@ -103,8 +275,9 @@ func bulkDelete(keyFactory cairo_bptree.KeyFactory, kvPairs cairo_bptree.KeyValu
 	log.Printf("DELETE: number of updated nodes: %d\n", stats.UpdatedCount)
 	log.Printf("DELETE: number of hashes (closing): %d\n", stats.ClosingHashes)
 
-	if options.graph {
-		stateAfterDelete.GraphAndPicture("stateAfterDelete")
+	saveGraph(stateAfterDelete, "stateAfterDelete")
+	if batchReport != nil {
+		saveReport(batchReport, "DELETE", stateAfterDelete, stats, "_delete")
 	}
 }
 
@@ -138,6 +311,12 @@ func main() {
 	level, _ := log.ParseLevel(logLevel)
 	log.SetLevel(level)
 
+	if _, err := graph.ParseFormat(options.graphFormat); options.graph && err != nil {
+		log.Fatalf("graphFormat argument error: %v\n", err)
+	}
+
+	serveMetrics()
+
 	log.Printf("Generate state and state-changes files: %t\n", generate)
 	if generate {
 		log.Printf("Size of the state file in bytes: %d\n", stateFileSize)
@@ -186,4 +365,6 @@ func main() {
 	log.Printf("Reading unique keys from: %s\n", stateChangesFile.Name())
 	stateDeletes := keyFactory.NewUniqueKeys(stateChangesFile.NewReader())
 	bulkDelete(keyFactory, kvPairs, stateDeletes)
+
+	waitMetrics()
 }
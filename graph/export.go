@@ -0,0 +1,182 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+type Format string
+
+const (
+	DOT     Format = "dot"
+	Mermaid Format = "mermaid"
+	JSON    Format = "json"
+	SVG     Format = "svg"
+	PNG     Format = "png" // rendered by the dot executable
+)
+
+var formats = []Format{DOT, Mermaid, JSON, SVG, PNG}
+
+func ParseFormat(s string) (Format, error) {
+	for _, format := range formats {
+		if strings.EqualFold(s, string(format)) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("unknown graph format %q, expected one of %v", s, formats)
+}
+
+// Extension returns the file name extension of format.
+func (f Format) Extension() string {
+	if f == Mermaid {
+		return "mmd"
+	}
+	return string(f)
+}
+
+// Export writes the tree rooted at root, which may be nil, in format. Node IDs are the paths from the root, e.g.
+// MLR is the right child of the left child of the root, so the same tree is always exported the same way.
+func Export(w io.Writer, root *Node, format Format) error {
+	buffer := bytes.Buffer{}
+	var err error
+	switch format {
+	case DOT:
+		writeDOT(&buffer, root)
+	case Mermaid:
+		writeMermaid(&buffer, root)
+	case JSON:
+		err = writeJSON(&buffer, root)
+	case SVG:
+		err = WriteSVG(&buffer, root)
+	case PNG:
+		err = writePNG(&buffer, root)
+	default:
+		err = fmt.Errorf("unknown graph format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buffer.Bytes())
+	return err
+}
+
+// walk visits the nodes in pre-order together with their IDs.
+func walk(n *Node, id string, visit func(n *Node, id string)) {
+	if n == nil {
+		return
+	}
+	visit(n, id)
+	for _, edge := range n.Edges {
+		walk(edge.To, id+edge.Port, visit)
+	}
+}
+
+// writeDOT writes nodes as records having fields on top and ports below.
+func writeDOT(buffer *bytes.Buffer, root *Node) {
+	buffer.WriteString("strict digraph {\nnode [shape=record];\n")
+	walk(root, "M", func(n *Node, id string) {
+		fields := make([]string, len(n.Fields))
+		for i, field := range n.Fields {
+			fields[i] = escapeRecord(field)
+		}
+		label := "{{<C>" + strings.Join(fields, "|") + "}"
+		if len(n.Edges) > 0 {
+			ports := make([]string, len(n.Edges))
+			for i, edge := range n.Edges {
+				ports[i] = "<" + edge.Port + ">" + edge.Port
+			}
+			label += "|{" + strings.Join(ports, "|") + "}"
+		}
+		label += "}"
+		fmt.Fprintf(buffer, "%q [label=\"%s\" style=filled fillcolor=%q", id, label, fill(n))
+		if n.FontColor != "" {
+			fmt.Fprintf(buffer, " fontcolor=%q", n.FontColor)
+		}
+		buffer.WriteString("];\n")
+	})
+	walk(root, "M", func(n *Node, id string) {
+		for _, edge := range n.Edges {
+			fmt.Fprintf(buffer, "%q:%s -> %q:C;\n", id, edge.Port, id+edge.Port)
+		}
+	})
+	buffer.WriteString("}\n")
+}
+
+func escapeRecord(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "{", `\{`, "}", `\}`, "|", `\|`, "<", `\<`, ">", `\>`).Replace(s)
+}
+
+func writeMermaid(buffer *bytes.Buffer, root *Node) {
+	buffer.WriteString("flowchart TD\n")
+	walk(root, "M", func(n *Node, id string) {
+		fmt.Fprintf(buffer, "%s[\"%s\"]\n", id, strings.ReplaceAll(strings.Join(n.Fields, " | "), `"`, "#quot;"))
+		fmt.Fprintf(buffer, "style %s fill:%s", id, fill(n))
+		if n.FontColor != "" {
+			fmt.Fprintf(buffer, ",color:%s", n.FontColor)
+		}
+		buffer.WriteString("\n")
+	})
+	walk(root, "M", func(n *Node, id string) {
+		for _, edge := range n.Edges {
+			fmt.Fprintf(buffer, "%s -->|%s| %s\n", id, edge.Port, id+edge.Port)
+		}
+	})
+}
+
+type jsonNode struct {
+	ID        string   `json:"id"`
+	Fields    []string `json:"fields"`
+	Fill      string   `json:"fill"`
+	FontColor string   `json:"fontColor,omitempty"`
+	Mark      Mark     `json:"mark,omitempty"`
+}
+
+type jsonEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Port string `json:"port"`
+}
+
+type jsonGraph struct {
+	Nodes []jsonNode `json:"nodes"`
+	Edges []jsonEdge `json:"edges"`
+}
+
+func writeJSON(buffer *bytes.Buffer, root *Node) error {
+	document := jsonGraph{Nodes: make([]jsonNode, 0), Edges: make([]jsonEdge, 0)}
+	walk(root, "M", func(n *Node, id string) {
+		document.Nodes = append(document.Nodes, jsonNode{ID: id, Fields: n.Fields, Fill: fill(n), FontColor: n.FontColor, Mark: n.Mark})
+		for _, edge := range n.Edges {
+			document.Edges = append(document.Edges, jsonEdge{From: id, To: id + edge.Port, Port: edge.Port})
+		}
+	})
+	encoder := json.NewEncoder(buffer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(document)
+}
+
+func writePNG(buffer *bytes.Buffer, root *Node) error {
+	dotExecutable, err := exec.LookPath("dot")
+	if err != nil {
+		return fmt.Errorf("png format needs the Graphviz dot executable: %v", err)
+	}
+	dot, stderr := bytes.Buffer{}, bytes.Buffer{}
+	writeDOT(&dot, root)
+	cmdDot := exec.Command(dotExecutable, "-Tpng")
+	cmdDot.Stdin, cmdDot.Stdout, cmdDot.Stderr = &dot, buffer, &stderr
+	if err := cmdDot.Run(); err != nil {
+		return fmt.Errorf("dot failed: %v: %s", err, stderr.String())
+	}
+	return nil
+}
+
+func fill(n *Node) string {
+	if n.Fill == "" {
+		return "white"
+	}
+	return n.Fill
+}
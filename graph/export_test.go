@@ -0,0 +1,63 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportDOT(t *testing.T) {
+	buffer := bytes.Buffer{}
+	require.NoError(t, Export(&buffer, sampleTree(), DOT))
+	dot := buffer.String()
+	assert.Contains(t, dot, "\"M\" [label=\"{{<C>k=[4]|\\<&\\>}|{<L>L|<R>R}}\" style=filled fillcolor=\"#D9E7D6\" fontcolor=\"red\"];\n")
+	assert.Contains(t, dot, "\"MLR\" [label=\"{{<C>k=[2 3] 4}}\" style=filled fillcolor=\"#FDF3D0\"];\n")
+	assert.Contains(t, dot, "\"ML\":R -> \"MLR\":C;\n")
+	assert.Equal(t, 7, bytes.Count(buffer.Bytes(), []byte("[label=")), "different number of nodes")
+	assert.Equal(t, 6, bytes.Count(buffer.Bytes(), []byte(" -> ")), "different number of edges")
+}
+
+func TestExportMermaid(t *testing.T) {
+	buffer := bytes.Buffer{}
+	require.NoError(t, Export(&buffer, sampleTree(), Mermaid))
+	mermaid := buffer.String()
+	assert.Contains(t, mermaid, "flowchart TD\nM[\"k=[4] | <&>\"]\nstyle M fill:#D9E7D6,color:red\n")
+	assert.Contains(t, mermaid, "MR -->|L| MRL\n")
+}
+
+func TestExportJSON(t *testing.T) {
+	buffer := bytes.Buffer{}
+	require.NoError(t, Export(&buffer, sampleTree(), JSON))
+	document := jsonGraph{}
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &document))
+	require.Len(t, document.Nodes, 7)
+	require.Len(t, document.Edges, 6)
+	assert.Equal(t, jsonNode{ID: "M", Fields: []string{"k=[4]", "<&>"}, Fill: Palette[2], FontColor: "red"}, document.Nodes[0])
+	assert.Equal(t, jsonEdge{From: "M", To: "ML", Port: "L"}, document.Edges[0])
+
+	buffer.Reset()
+	require.NoError(t, Export(&buffer, nil, JSON))
+	assert.JSONEq(t, `{"nodes": [], "edges": []}`, buffer.String())
+}
+
+func TestExportDeterministic(t *testing.T) {
+	for _, format := range []Format{DOT, Mermaid, JSON, SVG} {
+		first, second := bytes.Buffer{}, bytes.Buffer{}
+		require.NoError(t, Export(&first, sampleTree(), format))
+		require.NoError(t, Export(&second, sampleTree(), format))
+		assert.Equal(t, first.String(), second.String(), "format %s: different output", format)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	format, err := ParseFormat("Mermaid")
+	require.NoError(t, err)
+	assert.Equal(t, Mermaid, format)
+	assert.Equal(t, "mmd", format.Extension())
+	_, err = ParseFormat("gif")
+	assert.Error(t, err)
+	assert.Error(t, Export(&bytes.Buffer{}, sampleTree(), Format("gif")))
+}
@@ -0,0 +1,101 @@
+package graph
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Palette holds the fill colours used by all trees, e.g. by nesting level or by exposed and updated flags.
+var Palette = []string{"#FDF3D0", "#DCE8FA", "#D9E7D6", "#F1CFCD", "#F5F5F5", "#E1D5E7", "#FFE6CC", "white"}
+
+// Node is a tree node as drawn: record fields from left to right, colours and edges to its children.
+type Node struct {
+	Fields    []string `json:"fields"`
+	Fill      string   `json:"fill,omitempty"`
+	FontColor string   `json:"fontColor,omitempty"` // black if empty
+	Mark      Mark     `json:"mark,omitempty"`
+	Edges     []Edge   `json:"edges,omitempty"`
+}
+
+// Mark tells what a batch did to a node, highlighted by WriteHTML.
+type Mark string
+
+const (
+	Unchanged Mark = ""
+	Exposed   Mark = "exposed"
+	Created   Mark = "created"
+	Updated   Mark = "updated"
+	Deleted   Mark = "deleted"
+)
+
+// Edge goes from the port of a node, e.g. L, R or N, to a child. Ports of a node must be different.
+type Edge struct {
+	Port string `json:"port"`
+	To   *Node  `json:"to"`
+}
+
+// Save exports the tree rooted at root into filename plus the extension of format, creating its directory.
+func Save(filename string, root *Node, format Format) error {
+	_, err := SaveTree(filepath.Dir(filename), filepath.Base(filename), rootExporter{root}, format)
+	return err
+}
+
+// Picture saves the tree rooted at root as filename.png using the dot executable if available, otherwise as
+// filename.svg using the built-in layout.
+func Picture(filename string, root *Node) error {
+	return Save(filename, root, PictureFormat())
+}
+
+// PictureFormat returns PNG if the dot executable is available, otherwise SVG.
+func PictureFormat() Format {
+	if _, err := exec.LookPath("dot"); err != nil {
+		return SVG
+	}
+	return PNG
+}
+
+// SaveAndPicture exports tree into dir as name.dot plus a picture in PictureFormat, creating dir.
+func SaveAndPicture(dir, name string, tree Exporter) error {
+	if _, err := SaveTree(dir, name, tree, DOT); err != nil {
+		return err
+	}
+	_, err := SaveTree(dir, name, tree, PictureFormat())
+	return err
+}
+
+// Exporter is a tree of any package that can be exported.
+type Exporter interface {
+	Export(w io.Writer, format Format) error
+}
+
+// NewExporter returns the Exporter of the tree rooted at root, e.g. to save trees converted with debug labels.
+func NewExporter(root *Node) Exporter {
+	return rootExporter{root}
+}
+
+type rootExporter struct {
+	root *Node
+}
+
+func (e rootExporter) Export(w io.Writer, format Format) error {
+	return Export(w, e.root, format)
+}
+
+// SaveTree exports tree into name plus the extension of format inside dir, creating dir, and returns the file name.
+func SaveTree(dir, name string, tree Exporter, format Format) (string, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	filename := filepath.Join(dir, name+"."+format.Extension())
+	f, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	if err := tree.Export(f, format); err != nil {
+		f.Close()
+		return "", err
+	}
+	return filename, f.Close()
+}
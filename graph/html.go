@@ -0,0 +1,130 @@
+package graph
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Report is the picture of a batch: the tree before and after it, both possibly nil, and its counters.
+type Report struct {
+	Title  string
+	Before *Node
+	After  *Node
+	Stats  []Stat
+}
+
+type Stat struct {
+	Name  string
+	Value uint64
+}
+
+type htmlNode struct {
+	Port      string
+	Label     string
+	Fill      string
+	FontColor string
+	Mark      Mark
+	Open      bool
+	Children  []*htmlNode
+}
+
+// htmlTree converts the subtree rooted at n, opening only the subtrees holding marked nodes.
+func htmlTree(n *Node, port string) *htmlNode {
+	if n == nil {
+		return nil
+	}
+	h := &htmlNode{Port: port, Label: strings.Join(n.Fields, " | "), Fill: fill(n), FontColor: n.FontColor, Mark: n.Mark}
+	if h.FontColor == "" {
+		h.FontColor = "black"
+	}
+	for _, edge := range n.Edges {
+		child := htmlTree(edge.To, edge.Port)
+		if child != nil {
+			h.Open = h.Open || child.Mark != Unchanged || child.Open
+			h.Children = append(h.Children, child)
+		}
+	}
+	return h
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; margin: 16px; }
+.trees { display: flex; gap: 16px; align-items: flex-start; }
+.tree { flex: 1; overflow: auto; border: 1px solid #ccc; padding: 8px; }
+ul { list-style: none; margin: 0; padding-left: 20px; }
+summary { cursor: pointer; }
+.leaf { padding-left: 14px; }
+.port { color: #888; margin-right: 4px; }
+.box { display: inline-block; margin: 2px 0; padding: 1px 6px; border: 2px solid #999; font-family: monospace; }
+.exposed { border-color: #FF8C00; }
+.created { border-color: #2E8B57; }
+.updated { border-color: #1E5AC8; }
+.deleted { border-color: #D22; text-decoration: line-through; }
+table { border-collapse: collapse; margin-top: 16px; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+td.value { text-align: right; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>
+<button onclick="toggle(true)">Expand all</button>
+<button onclick="toggle(false)">Collapse all</button>
+<span class="box exposed">exposed</span>
+<span class="box created">created</span>
+<span class="box updated">updated</span>
+<span class="box deleted">deleted</span>
+</p>
+<div class="trees">
+<div class="tree"><h2>Before</h2>{{with .Before}}{{template "node" .}}{{else}}<p>empty</p>{{end}}</div>
+<div class="tree"><h2>After</h2>{{with .After}}{{template "node" .}}{{else}}<p>empty</p>{{end}}</div>
+</div>
+{{if .Stats}}<table>
+<tr><th>Counter</th><th>Value</th></tr>
+{{range .Stats}}<tr><td>{{.Name}}</td><td class="value">{{.Value}}</td></tr>
+{{end}}</table>{{end}}
+<script>
+function toggle(open) {
+	document.querySelectorAll("details").forEach(function (d) { d.open = open; });
+}
+</script>
+</body>
+</html>
+{{define "box"}}{{if .Port}}<span class="port">{{.Port}}</span>{{end}}<span class="box {{.Mark}}" style="background: {{.Fill}}; color: {{.FontColor}}">{{.Label}}</span>{{end}}
+{{define "node"}}{{if .Children}}<details{{if .Open}} open{{end}}><summary>{{template "box" .}}</summary>
+<ul>{{range .Children}}<li>{{template "node" .}}</li>{{end}}</ul>
+</details>{{else}}<div class="leaf">{{template "box" .}}</div>{{end}}{{end}}
+`))
+
+// WriteHTML writes report as a single HTML page with no external resources. Subtrees are collapsible and the
+// ones without marked nodes start collapsed.
+func WriteHTML(w io.Writer, report Report) error {
+	buffer := bytes.Buffer{}
+	err := htmlTemplate.Execute(&buffer, struct {
+		Title         string
+		Before, After *htmlNode
+		Stats         []Stat
+	}{report.Title, htmlTree(report.Before, ""), htmlTree(report.After, ""), report.Stats})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buffer.Bytes())
+	return err
+}
+
+// SaveHTML writes report into filename, see WriteHTML.
+func SaveHTML(filename string, report Report) error {
+	buffer := bytes.Buffer{}
+	if err := WriteHTML(&buffer, report); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buffer.Bytes(), 0644)
+}
@@ -0,0 +1,42 @@
+package graph
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteHTML(t *testing.T) {
+	before, after := sampleTree(), sampleTree()
+	before.Edges[0].To.Edges[1].To.Mark = Deleted
+	after.Mark, after.Edges[0].To.Mark = Updated, Exposed
+	after.Edges[0].To.Edges[0].To.Mark = Created
+	buffer := bytes.Buffer{}
+	report := Report{Title: "upsert", Before: before, After: after, Stats: []Stat{{"Exposed", 2}, {"Created", 1}}}
+	require.NoError(t, WriteHTML(&buffer, report))
+	page := buffer.String()
+	assert.Equal(t, 2, strings.Count(page, `<span class="box exposed"`), "legend and exposed node")
+	assert.Equal(t, 2, strings.Count(page, `<span class="box created"`), "legend and created node")
+	assert.Equal(t, 2, strings.Count(page, `<span class="box updated"`), "legend and updated node")
+	assert.Equal(t, 2, strings.Count(page, `<span class="box deleted"`), "legend and deleted node")
+	assert.Contains(t, page, "k=[4] | &lt;&amp;&gt;", "label not escaped")
+	assert.Contains(t, page, "background: "+Palette[1], "fill missing")
+	assert.Contains(t, page, "color: red", "font colour missing")
+	assert.NotContains(t, page, "ZgotmplZ", "style rejected")
+	assert.Contains(t, page, "<td>Created</td><td class=\"value\">1</td>")
+	assert.NotContains(t, page, "<link", "external resource")
+	assert.NotContains(t, page, "src=", "external resource")
+	// Left subtrees hold marked nodes in both trees, right subtrees are unchanged
+	assert.Equal(t, 4, strings.Count(page, "<details open>"))
+	assert.Equal(t, 2, strings.Count(page, "<details>"))
+}
+
+func TestWriteHTMLEmpty(t *testing.T) {
+	buffer := bytes.Buffer{}
+	require.NoError(t, WriteHTML(&buffer, Report{Title: "delete", Before: sampleTree()}))
+	assert.Contains(t, buffer.String(), "<p>empty</p>")
+	assert.NotContains(t, buffer.String(), "<table>")
+}
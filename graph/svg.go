@@ -0,0 +1,139 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+const (
+	charWidth   = 7.0
+	fieldMargin = 6.0
+	nodeHeight  = 24.0
+	levelHeight = 64.0
+	nodeGap     = 12.0
+	margin      = 10.0
+)
+
+// box is the position of a node laid out by layout.
+type box struct {
+	node         *Node
+	x, y         float64 // top left corner
+	width        float64
+	fieldWidths  []float64
+	subtreeWidth float64
+	children     []*box
+}
+
+// WriteSVG lays out the tree rooted at root, which may be nil, and writes it as SVG. Each subtree gets its own
+// horizontal band, wide enough for its children or its root, so nodes never overlap.
+func WriteSVG(w io.Writer, root *Node) error {
+	top, width, height := layout(root)
+	buffer := bytes.Buffer{}
+	writeSVGHeader(&buffer, width, height)
+	if top != nil {
+		writeEdges(&buffer, top)
+		writeBoxes(&buffer, top)
+	}
+	buffer.WriteString("</svg>\n")
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
+
+// layout places the tree rooted at root, which may be nil, and returns its top box and the picture size.
+func layout(root *Node) (top *box, width, height float64) {
+	if root == nil {
+		return nil, 2 * margin, 2 * margin
+	}
+	top = measure(root)
+	depth := place(top, margin, margin)
+	return top, top.subtreeWidth + 2*margin, float64(depth-1)*levelHeight + nodeHeight + 2*margin
+}
+
+func writeSVGHeader(buffer *bytes.Buffer, width, height float64) {
+	fmt.Fprintf(buffer, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%.0f\" height=\"%.0f\" viewBox=\"0 0 %.0f %.0f\" font-family=\"monospace\" font-size=\"12\">\n", width, height, width, height)
+}
+
+func measure(n *Node) *box {
+	b := &box{node: n, fieldWidths: make([]float64, len(n.Fields))}
+	for i, field := range n.Fields {
+		b.fieldWidths[i] = float64(utf8.RuneCountInString(field))*charWidth + 2*fieldMargin
+		b.width += b.fieldWidths[i]
+	}
+	if len(n.Fields) == 0 {
+		b.width = 2 * fieldMargin
+	}
+	childrenWidth := 0.0
+	for i, edge := range n.Edges {
+		child := measure(edge.To)
+		b.children = append(b.children, child)
+		if i > 0 {
+			childrenWidth += nodeGap
+		}
+		childrenWidth += child.subtreeWidth
+	}
+	b.subtreeWidth = b.width
+	if childrenWidth > b.subtreeWidth {
+		b.subtreeWidth = childrenWidth
+	}
+	return b
+}
+
+// place centres b over its band starting at left, children side by side below it, and returns the depth.
+func place(b *box, left, y float64) int {
+	b.x, b.y = left+(b.subtreeWidth-b.width)/2, y
+	childrenWidth := -nodeGap
+	for _, child := range b.children {
+		childrenWidth += child.subtreeWidth + nodeGap
+	}
+	depth, childLeft := 1, left+(b.subtreeWidth-childrenWidth)/2
+	for _, child := range b.children {
+		if childDepth := place(child, childLeft, y+levelHeight) + 1; childDepth > depth {
+			depth = childDepth
+		}
+		childLeft += child.subtreeWidth + nodeGap
+	}
+	return depth
+}
+
+// writeEdges draws the edges from ports spread along the bottom of each node to the top of its children.
+func writeEdges(buffer *bytes.Buffer, b *box) {
+	for i, child := range b.children {
+		x := b.x + b.width*float64(i+1)/float64(len(b.children)+1)
+		fmt.Fprintf(buffer, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"black\"/>\n", x, b.y+nodeHeight, child.x+child.width/2, child.y)
+		if port := b.node.Edges[i].Port; port != "" {
+			fmt.Fprintf(buffer, "<text x=\"%.1f\" y=\"%.1f\" font-size=\"9\" text-anchor=\"middle\">%s</text>\n", x, b.y+nodeHeight+10, escape(port))
+		}
+		writeEdges(buffer, child)
+	}
+}
+
+func writeBoxes(buffer *bytes.Buffer, b *box) {
+	fill, fontColor := b.node.Fill, b.node.FontColor
+	if fill == "" {
+		fill = "white"
+	}
+	if fontColor == "" {
+		fontColor = "black"
+	}
+	fmt.Fprintf(buffer, "<rect x=\"%.1f\" y=\"%.1f\" width=\"%.1f\" height=\"%.1f\" rx=\"3\" fill=\"%s\" stroke=\"black\"/>\n", b.x, b.y, b.width, nodeHeight, escape(fill))
+	x := b.x
+	for i, field := range b.node.Fields {
+		if i > 0 {
+			fmt.Fprintf(buffer, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"black\"/>\n", x, b.y, x, b.y+nodeHeight)
+		}
+		fmt.Fprintf(buffer, "<text x=\"%.1f\" y=\"%.1f\" fill=\"%s\" text-anchor=\"middle\">%s</text>\n", x+b.fieldWidths[i]/2, b.y+nodeHeight/2+4, escape(fontColor), escape(field))
+		x += b.fieldWidths[i]
+	}
+	for _, child := range b.children {
+		writeBoxes(buffer, child)
+	}
+}
+
+func escape(s string) string {
+	buffer := bytes.Buffer{}
+	_ = xml.EscapeText(&buffer, []byte(s))
+	return buffer.String()
+}
@@ -0,0 +1,105 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func leaf(label, fill string) *Node {
+	return &Node{Fields: []string{label}, Fill: fill}
+}
+
+func sampleTree() *Node {
+	left := &Node{Fields: []string{"k=[2]"}, Fill: Palette[1], Edges: []Edge{{"L", leaf("k=[1] 2", Palette[2])}, {"R", leaf("k=[2 3] 4", Palette[0])}}}
+	right := &Node{Fields: []string{"k=[6]"}, Fill: Palette[0], Edges: []Edge{{"L", leaf("k=[4 5] 6", Palette[0])}, {"R", leaf("k=[6] nil", Palette[0])}}}
+	return &Node{Fields: []string{"k=[4]", "<&>"}, Fill: Palette[2], FontColor: "red", Edges: []Edge{{"L", left}, {"R", right}}}
+}
+
+func TestWriteSVG(t *testing.T) {
+	buffer := bytes.Buffer{}
+	require.NoError(t, WriteSVG(&buffer, sampleTree()))
+	decoder := xml.NewDecoder(bytes.NewReader(buffer.Bytes()))
+	rects, texts := 0, make([]string, 0)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		if element, ok := token.(xml.StartElement); ok {
+			switch element.Name.Local {
+			case "rect":
+				rects++
+			case "text":
+				text, err := decoder.Token()
+				require.NoError(t, err)
+				texts = append(texts, string(text.(xml.CharData)))
+			}
+		}
+	}
+	assert.Equal(t, 7, rects, "different number of nodes")
+	assert.Contains(t, texts, "<&>", "field not escaped")
+	assert.Contains(t, texts, "k=[6] nil")
+	svg := buffer.String()
+	for _, color := range []string{Palette[0], Palette[1], Palette[2], "red"} {
+		assert.Contains(t, svg, color, "colour missing")
+	}
+}
+
+func TestLayoutNoOverlap(t *testing.T) {
+	top := measure(sampleTree())
+	assert.Equal(t, 3, place(top, 0, 0))
+	levels := make(map[float64][]*box)
+	var collect func(b *box)
+	collect = func(b *box) {
+		levels[b.y] = append(levels[b.y], b)
+		for _, child := range b.children {
+			assert.Greater(t, child.y, b.y, "child above parent")
+			collect(child)
+		}
+	}
+	collect(top)
+	for y, boxes := range levels {
+		for i := 1; i < len(boxes); i++ {
+			assert.LessOrEqual(t, boxes[i-1].x+boxes[i-1].width, boxes[i].x, "overlapping nodes at y=%v", y)
+		}
+	}
+}
+
+func TestWriteSVGEmpty(t *testing.T) {
+	buffer := bytes.Buffer{}
+	require.NoError(t, WriteSVG(&buffer, nil))
+	assert.True(t, strings.HasPrefix(buffer.String(), "<svg"))
+	assert.NotContains(t, buffer.String(), "<rect")
+}
+
+func TestPictureWithoutDot(t *testing.T) {
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", "")
+	filename := filepath.Join(t.TempDir(), "tree")
+	require.NoError(t, Picture(filename, sampleTree()))
+	svg, err := ioutil.ReadFile(filename + ".svg")
+	require.NoError(t, err)
+	assert.Contains(t, string(svg), "k=[4 5] 6")
+}
+
+func TestSaveAndPictureWithoutDot(t *testing.T) {
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", "")
+	dir := filepath.Join(t.TempDir(), "graph")
+	require.NoError(t, SaveAndPicture(dir, "tree", NewExporter(sampleTree())))
+	for _, extension := range []string{".dot", ".svg"} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, "tree"+extension))
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "k=[4 5] 6")
+	}
+}
@@ -0,0 +1,132 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Frame is a step of a traced operation: the event and the trees involved in it, named by the edge ports. Frames
+// are placed either by recursion depth or, if Height is set, by height above the leaves.
+type Frame struct {
+	Event  string `json:"event"`
+	Depth  int    `json:"depth"`
+	Height *int   `json:"height,omitempty"`
+	Trees  []Edge `json:"trees"`
+}
+
+// Trace is the sequence of frames recorded during an operation, e.g. a bulk upsert.
+type Trace struct {
+	Operation string  `json:"operation"`
+	Frames    []Frame `json:"frames"`
+}
+
+func NewTrace(operation string) *Trace {
+	return &Trace{Operation: operation, Frames: make([]Frame, 0)}
+}
+
+// Add appends a frame, trees being snapshots not changed afterwards.
+func (t *Trace) Add(event string, depth int, trees ...Edge) {
+	t.Frames = append(t.Frames, Frame{Event: event, Depth: depth, Trees: trees})
+}
+
+// AddAtHeight appends a frame placed by height above the leaves instead of recursion depth.
+func (t *Trace) AddAtHeight(event string, height int, trees ...Edge) {
+	t.Frames = append(t.Frames, Frame{Event: event, Height: &height, Trees: trees})
+}
+
+// Node returns the picture of the frame at step: a root describing the event above the trees, nil ones included.
+func (f Frame) Node(step int) *Node {
+	level := "depth=" + strconv.Itoa(f.Depth)
+	if f.Height != nil {
+		level = "height=" + strconv.Itoa(*f.Height)
+	}
+	root := &Node{Fields: []string{"#" + strconv.Itoa(step), f.Event, level}, Fill: Palette[4]}
+	for _, tree := range f.Trees {
+		if tree.To == nil {
+			tree.To = &Node{Fields: []string{"nil"}, Fill: Palette[7]}
+		}
+		root.Edges = append(root.Edges, tree)
+	}
+	return root
+}
+
+func (t *Trace) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(t)
+}
+
+func ReadTrace(r io.Reader) (*Trace, error) {
+	trace := &Trace{}
+	if err := json.NewDecoder(r).Decode(trace); err != nil {
+		return nil, err
+	}
+	return trace, nil
+}
+
+// SaveFrames exports every frame in format as a numbered file inside dir, creating dir, and returns the file names.
+func (t *Trace) SaveFrames(dir string, format Format) ([]string, error) {
+	filenames := make([]string, 0, len(t.Frames))
+	for step, frame := range t.Frames {
+		filename, err := SaveTree(dir, fmt.Sprintf("frame_%04d", step), rootExporter{frame.Node(step)}, format)
+		if err != nil {
+			return filenames, err
+		}
+		filenames = append(filenames, filename)
+	}
+	return filenames, nil
+}
+
+// WriteAnimatedSVG writes the frames as a single SVG showing each of them for the given seconds, then looping.
+func (t *Trace) WriteAnimatedSVG(w io.Writer, seconds float64) error {
+	tops := make([]*box, len(t.Frames))
+	width, height := 2*margin, 2*margin
+	for step, frame := range t.Frames {
+		var frameWidth, frameHeight float64
+		tops[step], frameWidth, frameHeight = layout(frame.Node(step))
+		if frameWidth > width {
+			width = frameWidth
+		}
+		if frameHeight > height {
+			height = frameHeight
+		}
+	}
+	buffer := bytes.Buffer{}
+	writeSVGHeader(&buffer, width, height)
+	count := float64(len(tops))
+	for step, top := range tops {
+		begin, end := float64(step)/count, float64(step+1)/count
+		if step == 0 {
+			buffer.WriteString("<g>\n")
+			fmt.Fprintf(&buffer, "<animate attributeName=\"visibility\" values=\"visible;hidden\" keyTimes=\"0;%.6f\"", end)
+		} else {
+			buffer.WriteString("<g visibility=\"hidden\">\n")
+			fmt.Fprintf(&buffer, "<animate attributeName=\"visibility\" values=\"hidden;visible;hidden\" keyTimes=\"0;%.6f;%.6f\"", begin, end)
+		}
+		fmt.Fprintf(&buffer, " dur=\"%.3fs\" calcMode=\"discrete\" repeatCount=\"indefinite\"/>\n", seconds*count)
+		writeEdges(&buffer, top)
+		writeBoxes(&buffer, top)
+		buffer.WriteString("</g>\n")
+	}
+	buffer.WriteString("</svg>\n")
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
+
+// SaveAnimatedSVG writes the animated frames into filename, see WriteAnimatedSVG.
+func (t *Trace) SaveAnimatedSVG(filename string, seconds float64) error {
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		return err
+	}
+	buffer := bytes.Buffer{}
+	if err := t.WriteAnimatedSVG(&buffer, seconds); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buffer.Bytes(), 0644)
+}
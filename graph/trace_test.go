@@ -0,0 +1,80 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sampleTrace() *Trace {
+	trace := NewTrace("union")
+	trace.Add("start", 0, Edge{"tree", sampleTree()})
+	trace.Add("split k=4", 1, Edge{"L", sampleTree().Edges[0].To}, Edge{"R", sampleTree().Edges[1].To}, Edge{"N", nil})
+	trace.Add("end", 0, Edge{"tree", leaf("k=[1] nil", Palette[0])})
+	return trace
+}
+
+func TestTraceJSON(t *testing.T) {
+	buffer := bytes.Buffer{}
+	require.NoError(t, sampleTrace().WriteJSON(&buffer))
+	trace, err := ReadTrace(&buffer)
+	require.NoError(t, err)
+	assert.Equal(t, sampleTrace(), trace)
+}
+
+func TestFrameNode(t *testing.T) {
+	root := sampleTrace().Frames[1].Node(1)
+	assert.Equal(t, []string{"#1", "split k=4", "depth=1"}, root.Fields)
+	require.Len(t, root.Edges, 3)
+	assert.Equal(t, []string{"nil"}, root.Edges[2].To.Fields, "nil tree not drawn")
+
+	trace := NewTrace("upsert")
+	trace.AddAtHeight("exposed k=[1]", 0, Edge{"tree", leaf("k=[1] nil", Palette[0])})
+	assert.Equal(t, []string{"#0", "exposed k=[1]", "height=0"}, trace.Frames[0].Node(0).Fields)
+}
+
+func TestSaveFrames(t *testing.T) {
+	dir := t.TempDir()
+	filenames, err := sampleTrace().SaveFrames(dir, DOT)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "frame_0000.dot"), filepath.Join(dir, "frame_0001.dot"), filepath.Join(dir, "frame_0002.dot")}, filenames)
+	dot, err := ioutil.ReadFile(filenames[1])
+	require.NoError(t, err)
+	assert.Contains(t, string(dot), "split k=4")
+}
+
+func TestWriteAnimatedSVG(t *testing.T) {
+	buffer := bytes.Buffer{}
+	require.NoError(t, sampleTrace().WriteAnimatedSVG(&buffer, 0.5))
+	decoder := xml.NewDecoder(bytes.NewReader(buffer.Bytes()))
+	groups, animations := 0, make([]xml.StartElement, 0)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		if element, ok := token.(xml.StartElement); ok {
+			switch element.Name.Local {
+			case "g":
+				groups++
+			case "animate":
+				animations = append(animations, element)
+			}
+		}
+	}
+	assert.Equal(t, 3, groups, "one group per frame")
+	require.Len(t, animations, 3)
+	for _, animation := range animations {
+		for _, attribute := range animation.Attr {
+			if attribute.Name.Local == "dur" {
+				assert.Equal(t, "1.500s", attribute.Value)
+			}
+		}
+	}
+	assert.Contains(t, buffer.String(), `keyTimes="0;0.333333;0.666667"`)
+}
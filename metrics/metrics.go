@@ -0,0 +1,279 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Registry holds metric families, written in registration order. It is safe for concurrent use.
+type Registry struct {
+	mutex    sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+type kind string
+
+const (
+	counterKind   kind = "counter"
+	gaugeKind     kind = "gauge"
+	histogramKind kind = "histogram"
+)
+
+// family is a metric with its series, one per combination of label values.
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64 // upper bounds of histograms, +Inf excluded
+	fn      func() float64
+	series  map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // counter or gauge value, histogram sum
+	counts      []uint64 // histogram cumulative counts by bucket, +Inf last
+}
+
+func (r *Registry) register(f *family) *family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, other := range r.families {
+		ensure(other.name != f.name, fmt.Sprintf("metric %s already registered", f.name))
+	}
+	f.series = make(map[string]*series)
+	r.families = append(r.families, f)
+	return f
+}
+
+// with returns the series of labelValues, creating it. The registry must be locked.
+func (f *family) with(labelValues []string) *series {
+	ensure(len(labelValues) == len(f.labels), fmt.Sprintf("metric %s expects labels %v, got values %v", f.name, f.labels, labelValues))
+	key := strings.Join(labelValues, "\xff")
+	s, found := f.series[key]
+	if !found {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		if f.kind == histogramKind {
+			s.counts = make([]uint64, len(f.buckets)+1)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter is a monotonically increasing value, e.g. the number of nodes exposed by all batches.
+type Counter struct {
+	registry *Registry
+	family   *family
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r, r.register(&family{name: name, help: help, kind: counterKind, labels: labels})}
+}
+
+// Add increases the counter of labelValues by delta, which must not be negative.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	ensure(delta >= 0, fmt.Sprintf("counter %s cannot decrease", c.family.name))
+	c.registry.mutex.Lock()
+	defer c.registry.mutex.Unlock()
+	c.family.with(labelValues).value += delta
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Gauge is a value going up and down, e.g. the tree height.
+type Gauge struct {
+	registry *Registry
+	family   *family
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r, r.register(&family{name: name, help: help, kind: gaugeKind, labels: labels})}
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.registry.mutex.Lock()
+	defer g.registry.mutex.Unlock()
+	g.family.with(labelValues).value = value
+}
+
+// NewGaugeFunc registers a gauge without labels whose value is returned by fn at every scrape.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, kind: gaugeKind, fn: fn})
+}
+
+// Histogram counts observed values into buckets, e.g. batch sizes or latencies in seconds.
+type Histogram struct {
+	registry *Registry
+	family   *family
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds, in increasing order.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	ensure(sort.Float64sAreSorted(buckets), fmt.Sprintf("histogram %s buckets not sorted", name))
+	return &Histogram{r, r.register(&family{name: name, help: help, kind: histogramKind, labels: labels, buckets: buckets})}
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.registry.mutex.Lock()
+	defer h.registry.mutex.Unlock()
+	s := h.family.with(labelValues)
+	s.value += value
+	for i, bound := range h.family.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.counts[len(h.family.buckets)]++
+}
+
+// ExponentialBuckets returns count bucket bounds from start, each factor times the previous one.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// RegisterRuntime registers the heap usage and the number of goroutines, read at every scrape.
+func (r *Registry) RegisterRuntime() {
+	memStats := func(field func(*runtime.MemStats) uint64) func() float64 {
+		return func() float64 {
+			m := runtime.MemStats{}
+			runtime.ReadMemStats(&m)
+			return float64(field(&m))
+		}
+	}
+	r.NewGaugeFunc("go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects.", memStats(func(m *runtime.MemStats) uint64 { return m.HeapAlloc }))
+	r.NewGaugeFunc("go_memstats_heap_inuse_bytes", "Bytes in in-use heap spans.", memStats(func(m *runtime.MemStats) uint64 { return m.HeapInuse }))
+	r.NewGaugeFunc("go_memstats_heap_objects", "Number of allocated heap objects.", memStats(func(m *runtime.MemStats) uint64 { return m.HeapObjects }))
+	r.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 { return float64(runtime.NumGoroutine()) })
+}
+
+// WriteText writes all the metrics in the Prometheus text exposition format, series sorted by label values.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	families := append([]*family{}, r.families...)
+	r.mutex.Unlock()
+	writer := bufio.NewWriter(w)
+	for _, f := range families {
+		fmt.Fprintf(writer, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(writer, "# TYPE %s %s\n", f.name, f.kind)
+		if f.fn != nil {
+			fmt.Fprintf(writer, "%s %s\n", f.name, formatValue(f.fn()))
+			continue
+		}
+		r.mutex.Lock()
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			f.write(writer, f.series[key])
+		}
+		r.mutex.Unlock()
+	}
+	return writer.Flush()
+}
+
+func (f *family) write(w io.Writer, s *series) {
+	if f.kind != histogramKind {
+		fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatValue(s.value))
+		return
+	}
+	for i, count := range s.counts {
+		bound := math.Inf(1)
+		if i < len(f.buckets) {
+			bound = f.buckets[i]
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "le", formatValue(bound)), count)
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatValue(s.value))
+	fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), s.counts[len(s.counts)-1])
+}
+
+// formatLabels returns the label set, with the extra label appended if not empty.
+func formatLabels(labels, values []string, extraLabel, extraValue string) string {
+	pairs := make([]string, 0, len(labels)+1)
+	for i, label := range labels {
+		pairs = append(pairs, label+"=\""+escapeLabelValue(values[i])+"\"")
+	}
+	if extraLabel != "" {
+		pairs = append(pairs, extraLabel+"=\""+escapeLabelValue(extraValue)+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+var labelValueEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"")
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+// ServeHTTP writes the metrics as the response to a scrape.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	if err := r.WriteText(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ListenAndServe serves r on /metrics at addr in the background and returns the listener, to be closed to stop.
+func ListenAndServe(addr string, r *Registry) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	go http.Serve(listener, mux)
+	return listener, nil
+}
+
+func ensure(condition bool, message string) {
+	if !condition {
+		panic(message)
+	}
+}
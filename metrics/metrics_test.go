@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	nodes := r.NewCounter("nodes_total", "Nodes by operation.", "operation")
+	height := r.NewGauge("tree_height", "Tree height.")
+	latency := r.NewHistogram("operation_seconds", "Operation latency.", []float64{0.1, 1}, "operation")
+	r.NewGaugeFunc("answer", "The \"answer\"\nsecond line.", func() float64 { return 42 })
+
+	nodes.Add(3, "upsert")
+	nodes.Inc("delete")
+	nodes.Add(2, "upsert")
+	height.Set(4)
+	latency.Observe(0.05, "upsert")
+	latency.Observe(0.5, "upsert")
+	latency.Observe(2, "upsert")
+
+	text := strings.Builder{}
+	require.NoError(t, r.WriteText(&text))
+	expected := `# HELP nodes_total Nodes by operation.
+# TYPE nodes_total counter
+nodes_total{operation="delete"} 1
+nodes_total{operation="upsert"} 5
+# HELP tree_height Tree height.
+# TYPE tree_height gauge
+tree_height 4
+# HELP operation_seconds Operation latency.
+# TYPE operation_seconds histogram
+operation_seconds_bucket{operation="upsert",le="0.1"} 1
+operation_seconds_bucket{operation="upsert",le="1"} 2
+operation_seconds_bucket{operation="upsert",le="+Inf"} 3
+operation_seconds_sum{operation="upsert"} 2.55
+operation_seconds_count{operation="upsert"} 3
+# HELP answer The "answer"\nsecond line.
+# TYPE answer gauge
+answer 42
+`
+	assert.Equal(t, expected, text.String())
+}
+
+func TestRegistryMisuse(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounter("c", "", "a")
+	assert.Panics(t, func() { r.NewGauge("c", "") }, "duplicate name")
+	assert.Panics(t, func() { counter.Inc() }, "missing label value")
+	assert.Panics(t, func() { counter.Add(-1, "x") }, "counter decrease")
+	assert.Panics(t, func() { r.NewHistogram("h", "", []float64{2, 1}) }, "unsorted buckets")
+}
+
+func TestExponentialBuckets(t *testing.T) {
+	assert.Equal(t, []float64{1, 10, 100, 1000}, ExponentialBuckets(1, 10, 4))
+}
+
+func TestListenAndServe(t *testing.T) {
+	r := NewRegistry()
+	r.RegisterRuntime()
+	r.NewCounter("batches_total", "Batches.").Inc()
+	listener, err := ListenAndServe("127.0.0.1:0", r)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	response, err := http.Get("http://" + listener.Addr().String() + "/metrics")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, ContentType, response.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "\nbatches_total 1\n")
+	assert.Contains(t, string(body), "# TYPE go_memstats_heap_alloc_bytes gauge\ngo_memstats_heap_alloc_bytes ")
+	assert.Contains(t, string(body), "\ngo_goroutines ")
+}